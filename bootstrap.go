@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+// bootstrapTimeout bounds management commands of bootstrap command, materialized views backfill may take a while
+const bootstrapTimeout = 10 * time.Minute
+
+// bootstrap parses configs the same way as plugin does, then creates trace tables, ingestion mappings and policies.
+// Executed commands are logged to out, returned exit code is non-zero when configs are invalid or any command fails.
+func bootstrap(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: jaeger-kusto bootstrap [flags]")
+		fmt.Fprintln(out, "Creates trace tables, ingestion mappings, retention and caching policies and materialized views.")
+		fs.PrintDefaults()
+	}
+	flags := config.NewFlags(fs)
+	var options store.BootstrapOptions
+	fs.IntVar(&options.RetentionDays, "retention-days", 30, "soft delete period of trace tables in days, 0 keeps current policy")
+	fs.IntVar(&options.HotCacheDays, "hot-cache-days", 7, "hot cache period of trace tables in days, 0 keeps current policy")
+	fs.BoolVar(&options.MaterializedViews, "materialized-views", false, "create services and operations materialized views over trace tables")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	pluginConfig, err := flags.ParsePluginConfig()
+	if !report(out, "plugin configuration", err) {
+		return 1
+	}
+	kustoConfig, err := flags.ParseKustoConfig(pluginConfig)
+	if !report(out, "kusto configuration", err) {
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	logger := hclog.New(&hclog.LoggerOptions{Name: config.ServiceName, Level: hclog.Info, Output: out})
+	if !report(out, "kusto tables, mappings and policies", store.Bootstrap(ctx, pluginConfig, kustoConfig, options, logger)) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+)
+
+const kustoFlagPrefix = "kusto."
+
+// Flags registers command line flag for every field of plugin and kusto configs, e.g. -writer-batch-max-bytes or
+// -kusto.client-secret. Values are applied in the following order, each one overriding previous:
+// defaults, config file, environment variables, command line flags.
+type Flags struct {
+	ConfigPath string
+
+	plugin map[string]string
+	kusto  map[string]string
+}
+
+// NewFlags registers flags of plugin and kusto configs in the flag set
+func NewFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{plugin: map[string]string{}, kusto: map[string]string{}}
+	fs.StringVar(&f.ConfigPath, "config", "", "The path to the plugin's configuration file, JSON or YAML")
+	registerFlags(fs, "", PluginEnvironmentPrefix, reflect.TypeOf(PluginConfig{}), f.plugin)
+	registerFlags(fs, kustoFlagPrefix, KustoEnvironmentPrefix, reflect.TypeOf(KustoConfig{}), f.kusto)
+	return f
+}
+
+// ParsePluginConfig reads plugin config from file, environment and flags. When file is read, but some values are
+// invalid, config is returned along with the error, so that settings it points to, e.g. kusto config, can be checked.
+func (f *Flags) ParsePluginConfig() (*PluginConfig, error) {
+	return parseConfig(f.ConfigPath, f.plugin)
+}
+
+// ParseKustoConfig reads kusto config from file set in plugin config, environment and flags
+func (f *Flags) ParseKustoConfig(pc *PluginConfig) (*KustoConfig, error) {
+	return parseKustoConfig(pc.KustoConfigPath, f.kusto, pc.ReadNoTruncation, pc.ReadNoTimeout)
+}
+
+func registerFlags(fs *flag.FlagSet, prefix string, envPrefix string, dataType reflect.Type, values map[string]string) {
+	for _, field := range configurableFields(dataType) {
+		name := jsonName(field)
+		usage := fmt.Sprintf("Overrides %s (env %s_%s)", name, envPrefix, toEnvironmentVariable(field.Name))
+		if kind := field.Type.Kind(); kind == reflect.Slice || kind == reflect.Struct || kind == reflect.Ptr {
+			usage += ", JSON encoded"
+		}
+		fs.Var(&fieldFlag{values: values, field: field.Name, isBool: field.Type.Kind() == reflect.Bool}, prefix+toFlagName(name), usage)
+	}
+}
+
+// setFlagFields sets fields of data from values of flags, which were set in command line
+func setFlagFields(data interface{}, values map[string]string) error {
+	return setFields(data, func(field reflect.StructField) (string, bool) {
+		value, ok := values[field.Name]
+		return value, ok
+	})
+}
+
+// fieldFlag collects value of config field, which is parsed when config is read
+type fieldFlag struct {
+	values map[string]string
+	field  string
+	isBool bool
+}
+
+func (f *fieldFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.field]
+}
+
+func (f *fieldFlag) Set(value string) error {
+	f.values[f.field] = value
+	return nil
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.isBool
+}
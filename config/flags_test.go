@@ -0,0 +1,133 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(testing *testing.T, name string, content string) string {
+	path := filepath.Join(testing.TempDir(), name)
+	require.NoError(testing, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func Test_LoadConfigFormats(testing *testing.T) {
+	files := map[string]string{
+		"config.json": `{"endpoint": "https://test.kusto.windows.net", "database": "jaeger", "useManagedIdentity": true}`,
+		"config.yaml": "endpoint: https://test.kusto.windows.net\ndatabase: jaeger\nuseManagedIdentity: true\n",
+		"config.yml":  "endpoint: https://test.kusto.windows.net\ndatabase: jaeger\nuseManagedIdentity: true\n",
+		"config":      "{\n  \"endpoint\": \"https://test.kusto.windows.net\",\n  \"database\": \"jaeger\",\n  \"useManagedIdentity\": true\n}",
+		"config.conf": "endpoint: https://test.kusto.windows.net\ndatabase: jaeger\nuseManagedIdentity: true\n",
+	}
+
+	for name, content := range files {
+		kc, err := ParseKustoConfig(writeConfigFile(testing, name, content), false, false)
+		require.NoError(testing, err, name)
+		assert.Equal(testing, "https://test.kusto.windows.net", kc.Endpoint, name)
+		assert.Equal(testing, "jaeger", kc.Database, name)
+		assert.True(testing, kc.UseManagedIdentity, name)
+	}
+}
+
+func Test_KustoConfigEnvironment(testing *testing.T) {
+	path := writeConfigFile(testing, "kusto.yaml", "endpoint: https://test.kusto.windows.net\ndatabase: jaeger\nclientId: id\ntenantId: tenant\n")
+	testing.Setenv("JAEGER_KUSTO_CLIENT_SECRET", "secret")
+	testing.Setenv("JAEGER_KUSTO_DATABASE", "prod")
+	testing.Setenv("JAEGER_KUSTO_READ_TABLES", `[{"table": "OTELTraces"}, {"database": "archive", "table": "OTELTraces"}]`)
+
+	kc, err := ParseKustoConfig(path, false, false)
+	require.NoError(testing, err)
+	assert.Equal(testing, "secret", kc.ClientSecret)
+	assert.Equal(testing, "prod", kc.Database)
+	require.Len(testing, kc.ReadTables, 2)
+	assert.Equal(testing, "archive", kc.ReadTables[1].Database)
+
+	testing.Setenv("JAEGER_KUSTO_READ_TABLES", "OTELTraces")
+	_, err = ParseKustoConfig(path, false, false)
+	assert.ErrorContains(testing, err, "readTables")
+}
+
+func Test_KustoConfigWithoutFile(testing *testing.T) {
+	testing.Setenv("JAEGER_KUSTO_ENDPOINT", "https://test.kusto.windows.net")
+	testing.Setenv("JAEGER_KUSTO_DATABASE", "jaeger")
+	testing.Setenv("JAEGER_KUSTO_USE_MANAGED_IDENTITY", "true")
+
+	kc, err := ParseKustoConfig("", false, false)
+	require.NoError(testing, err)
+	assert.Equal(testing, "jaeger", kc.Database)
+}
+
+func Test_FlagsPrecedence(testing *testing.T) {
+	pluginPath := writeConfigFile(testing, "plugin.yaml", "logLevel: info\nwriterWorkersCount: 2\nwriterBatchMaxBytes: 100\n")
+	kustoPath := writeConfigFile(testing, "kusto.json", `{"endpoint": "https://file.kusto.windows.net", "database": "file", "clientId": "id", "clientSecret": "file", "tenantId": "tenant"}`)
+	testing.Setenv("JAEGER_KUSTO_PLUGIN_KUSTO_CONFIG_PATH", kustoPath)
+	testing.Setenv("JAEGER_KUSTO_PLUGIN_WRITER_WORKERS_COUNT", "3")
+	testing.Setenv("JAEGER_KUSTO_PLUGIN_LOG_LEVEL", "warn")
+	testing.Setenv("JAEGER_KUSTO_CLIENT_SECRET", "env")
+	testing.Setenv("JAEGER_KUSTO_DATABASE", "env")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	require.NoError(testing, fs.Parse([]string{
+		"-config", pluginPath,
+		"-log-level", "debug",
+		"-read-no-truncation",
+		"-kusto.database", "flag",
+	}))
+
+	pc, err := flags.ParsePluginConfig()
+	require.NoError(testing, err)
+	assert.Equal(testing, "debug", pc.LogLevel)
+	assert.Equal(testing, 3, pc.WriterWorkersCount)
+	assert.Equal(testing, 100, pc.WriterBatchMaxBytes)
+	assert.True(testing, pc.ReadNoTruncation)
+
+	kc, err := flags.ParseKustoConfig(pc)
+	require.NoError(testing, err)
+	assert.Equal(testing, "https://file.kusto.windows.net", kc.Endpoint)
+	assert.Equal(testing, "env", kc.ClientSecret)
+	assert.Equal(testing, "flag", kc.Database)
+}
+
+func Test_FlagsInvalidValue(testing *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	require.NoError(testing, fs.Parse([]string{"-writer-workers-count", "many"}))
+
+	_, err := flags.ParsePluginConfig()
+	assert.ErrorContains(testing, err, "writerWorkersCount")
+}
+
+func Test_FlagsInvalidValueKeepsParsedConfig(testing *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	require.NoError(testing, fs.Parse([]string{"-log-level", "loud", "-kusto-config-path", "kusto.yaml"}))
+
+	// kusto config can still be found and checked
+	pc, err := flags.ParsePluginConfig()
+	assert.ErrorContains(testing, err, `invalid logLevel "loud"`)
+	require.NotNil(testing, pc)
+	assert.Equal(testing, "kusto.yaml", pc.KustoConfigPath)
+}
+
+func Test_ToFlagName(testing *testing.T) {
+	assert.Equal(testing, "writer-batch-max-bytes", toFlagName("writerBatchMaxBytes"))
+	assert.Equal(testing, "client-secret", toFlagName("clientSecret"))
+}
+
+func Test_ParseConfigReportsEveryProblem(testing *testing.T) {
+	testing.Setenv("JAEGER_KUSTO_PLUGIN_WRITER_BATCH_MAX_BYTES", "many")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	require.NoError(testing, fs.Parse([]string{"-writer-workers-count", "-1", "-log-level", "loud"}))
+
+	_, err := flags.ParsePluginConfig()
+	assert.ErrorContains(testing, err, "invalid value of writerBatchMaxBytes")
+	assert.ErrorContains(testing, err, "writerWorkersCount must be positive")
+	assert.ErrorContains(testing, err, `invalid logLevel "loud"`)
+}
@@ -2,33 +2,115 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 )
 
 // KustoConfig contains AzureAD service principal and Kusto cluster configs
 type KustoConfig struct {
-	ClientID             string              `json:"clientId"`
-	ClientSecret         string              `json:"clientSecret"`
-	TenantID             string              `json:"tenantId"`
-	UseManagedIdentity   bool                `json:"useManagedIdentity,omitempty"`
-	UseWorkloadIdentity  bool                `json:"useWorkloadIdentity,omitempty"`
-	Endpoint             string              `json:"endpoint"`
-	Database             string              `json:"database"`
-	TraceTableName       string              `json:"traceTableName"`
-	ClientRequestOptions []kusto.QueryOption `json:"clientRequestOptions,omitempty"`
+	ClientID            string `json:"clientId"`
+	ClientSecret        string `json:"clientSecret"`
+	TenantID            string `json:"tenantId"`
+	UseManagedIdentity  bool   `json:"useManagedIdentity,omitempty"`
+	UseWorkloadIdentity bool   `json:"useWorkloadIdentity,omitempty"`
+	// ClientCertificatePath is PFX or PEM file with certificate and private key of clientId service principal
+	ClientCertificatePath     string `json:"clientCertificatePath,omitempty"`
+	ClientCertificatePassword string `json:"clientCertificatePassword,omitempty"`
+	// SendCertificateChain enables subject name / issuer authentication of the certificate
+	SendCertificateChain bool `json:"sendCertificateChain,omitempty"`
+	// UseAzureCLI authenticates with account logged in to Azure CLI
+	UseAzureCLI bool `json:"useAzureCli,omitempty"`
+	// FederatedTokenFilePath is file with federated token exchanged for token of clientId application in tenantId
+	FederatedTokenFilePath string `json:"federatedTokenFilePath,omitempty"`
+	// TokenCredential is custom token provider set by hosts embedding the plugin, it can't be set in config files
+	TokenCredential       azcore.TokenCredential `json:"-"`
+	Endpoint              string                 `json:"endpoint"`
+	Database              string                 `json:"database"`
+	TraceTableName        string                 `json:"traceTableName"`
+	ClientRequestOptions  []kusto.QueryOption    `json:"clientRequestOptions,omitempty"`
+	ReadTables            []TableReference       `json:"readTables,omitempty"`
+	DependenciesTableName string                 `json:"dependenciesTableName,omitempty"`
+	TenantHeader          string                 `json:"tenantHeader,omitempty"`
+	RoutingRules          []RoutingRule          `json:"routingRules,omitempty"`
+	// Reader and Writer set cluster and identity of queries and ingestion, management commands of dependencies aggregation
+	// keep using endpoint and identity above
+	Reader *ClusterConfig `json:"reader,omitempty"`
+	Writer *ClusterConfig `json:"writer,omitempty"`
+	// StagingTableSuffix is set when spans are ingested to staging tables, named as trace table with the suffix,
+	// which are converted to OTELTraces schema by update policies
+	StagingTableSuffix string `json:"stagingTableSuffix,omitempty"`
 }
 
-// ParseKustoConfig reads file at path and returns instance of KustoConfig or error
+// ClusterConfig overrides endpoint and identity of kusto config for reading or writing.
+// Authentication settings replace those of kusto config when any of them is set.
+type ClusterConfig struct {
+	Endpoint                  string `json:"endpoint,omitempty"`
+	ClientID                  string `json:"clientId,omitempty"`
+	ClientSecret              string `json:"clientSecret,omitempty"`
+	TenantID                  string `json:"tenantId,omitempty"`
+	UseManagedIdentity        bool   `json:"useManagedIdentity,omitempty"`
+	UseWorkloadIdentity       bool   `json:"useWorkloadIdentity,omitempty"`
+	ClientCertificatePath     string `json:"clientCertificatePath,omitempty"`
+	ClientCertificatePassword string `json:"clientCertificatePassword,omitempty"`
+	SendCertificateChain      bool   `json:"sendCertificateChain,omitempty"`
+	UseAzureCLI               bool   `json:"useAzureCli,omitempty"`
+	FederatedTokenFilePath    string `json:"federatedTokenFilePath,omitempty"`
+}
+
+// TableReference points to a trace table queried by reader, optionally located in another database or cluster
+type TableReference struct {
+	Cluster  string `json:"cluster,omitempty"`
+	Database string `json:"database,omitempty"`
+	Table    string `json:"table"`
+}
+
+// RoutingRule maps spans and queries to a dedicated database and trace table.
+// Every condition that is set must match, rules are evaluated in order and the first matching rule wins.
+// Queries read every table spans of their tenant, or spans without tenant, can be routed to, as service and resource
+// attributes are matched per span.
+type RoutingRule struct {
+	Tenant                 string `json:"tenant,omitempty"`
+	ServiceName            string `json:"serviceName,omitempty"`
+	ResourceAttribute      string `json:"resourceAttribute,omitempty"`
+	ResourceAttributeValue string `json:"resourceAttributeValue,omitempty"`
+	Database               string `json:"database,omitempty"`
+	TraceTableName         string `json:"traceTableName"`
+}
+
+// ingestPrefix is prefix of host of cluster ingestion endpoint
+const ingestPrefix = "ingest-"
+
+// KustoEnvironmentPrefix is prefix of environment variables overriding kusto config, e.g. JAEGER_KUSTO_CLIENT_SECRET
+const KustoEnvironmentPrefix = "JAEGER_KUSTO"
+
+// ParseKustoConfig reads file at path and returns instance of KustoConfig or error.
+// Values of file are overridden by environment variables, file is optional when path is empty.
 func ParseKustoConfig(path string, requestNoTruncation bool, requestNoTimeout bool) (*KustoConfig, error) {
+	return parseKustoConfig(path, nil, requestNoTruncation, requestNoTimeout)
+}
+
+func parseKustoConfig(path string, flagValues map[string]string, requestNoTruncation bool, requestNoTimeout bool) (*KustoConfig, error) {
 	c := &KustoConfig{}
 	queryOptions := make([]kusto.QueryOption, 0)
 
-	if err := load(path, c); err != nil {
-		return nil, err
+	if path != "" {
+		if err := load(path, c); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := c.Validate(); err != nil {
+	// every problem of environment variables, flags and values is reported at once
+	err := errors.Join(
+		override(KustoEnvironmentPrefix, c),
+		setFlagFields(c, flagValues),
+		c.Validate(),
+	)
+	if err != nil {
 		return nil, err
 	}
 
@@ -45,23 +127,175 @@ func ParseKustoConfig(path string, requestNoTruncation bool, requestNoTimeout bo
 	return c, nil
 }
 
-// Validate returns error if any of required fields missing
+// Validate returns error listing every problem of the config by field name, defaults are set for missing optional fields
 func (kc *KustoConfig) Validate() error {
+	var problems []error
 	if kc.Database == "" {
-		return errors.New("missing database in kusto configuration")
+		problems = append(problems, errors.New("missing database in kusto configuration"))
 	}
 	if kc.Endpoint == "" {
-		return errors.New("missing endpoint in kusto configuration")
+		problems = append(problems, errors.New("missing endpoint in kusto configuration"))
 	}
-	// If the config indicates a non ManagedIdentity or WorkloadIdentity, then the ClientID, ClientSecret, and TenantID must be provided.
-	if !kc.UseManagedIdentity && !kc.UseWorkloadIdentity {
-		if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
-			return errors.New("missing client configuration (ClientId, ClientSecret, TenantId) & ManagedIdentity is missing for kusto")
+	problems = append(problems, kc.validateAuthentication()...)
+	if kc.Reader != nil {
+		for _, problem := range kc.ReaderConfig().validateAuthentication() {
+			problems = append(problems, fmt.Errorf("invalid reader: %w", problem))
+		}
+	}
+	if kc.Writer != nil {
+		for _, problem := range kc.WriterConfig().validateAuthentication() {
+			problems = append(problems, fmt.Errorf("invalid writer: %w", problem))
 		}
 	}
 	//if no Tracetable name provided, default to OTELTraces.
 	if kc.TraceTableName == "" {
 		kc.TraceTableName = "OTELTraces"
 	}
+	// jaeger uses x-tenant header to pass tenant by default
+	if kc.TenantHeader == "" {
+		kc.TenantHeader = "x-tenant"
+	}
+	for i := range kc.ReadTables {
+		if kc.ReadTables[i].Table == "" {
+			problems = append(problems, fmt.Errorf("missing table in readTables[%d]", i))
+		}
+		if kc.ReadTables[i].Database == "" {
+			kc.ReadTables[i].Database = kc.Database
+		}
+	}
+	tableTenants := map[string]string{kc.Database + "." + kc.TraceTableName: ""}
+	for i := range kc.RoutingRules {
+		rule := &kc.RoutingRules[i]
+		if err := rule.validate(kc.Database); err != nil {
+			problems = append(problems, fmt.Errorf("invalid routingRules[%d]: %w", i, err))
+			continue
+		}
+		// tenants read every table their rules write to, so tables of tenant rules must not be shared with other rules
+		table := rule.Database + "." + rule.TraceTableName
+		if tenant, ok := tableTenants[table]; ok && tenant != rule.Tenant {
+			problems = append(problems, fmt.Errorf("invalid routingRules[%d]: table %s is already used by rules of another tenant", i, table))
+		} else {
+			tableTenants[table] = rule.Tenant
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// ReaderConfig returns kusto config of queries, with endpoint and identity of reader when it is set
+func (kc *KustoConfig) ReaderConfig() *KustoConfig {
+	return kc.withCluster(kc.Reader, kc.Endpoint)
+}
+
+// WriterConfig returns kusto config of ingestion, with endpoint and identity of writer when it is set.
+// Writer endpoint defaults to the cluster endpoint, kusto client sends ingestion commands to its ingest- host itself.
+func (kc *KustoConfig) WriterConfig() *KustoConfig {
+	return kc.withCluster(kc.Writer, kc.Endpoint)
+}
+
+// EngineEndpoint returns endpoint kusto client is created for. Kusto client rejects endpoints with ingest- prefix
+// of host and adds the prefix to ingestion commands itself, so the prefix of writer endpoint set as
+// https://ingest-<cluster>.<region>.kusto.windows.net is dropped.
+func (kc *KustoConfig) EngineEndpoint() string {
+	u, err := url.Parse(kc.Endpoint)
+	if err != nil || !strings.HasPrefix(u.Host, ingestPrefix) {
+		return kc.Endpoint
+	}
+	u.Host = strings.TrimPrefix(u.Host, ingestPrefix)
+	return u.String()
+}
+
+func (kc *KustoConfig) withCluster(cluster *ClusterConfig, defaultEndpoint string) *KustoConfig {
+	c := *kc
+	c.Reader, c.Writer = nil, nil
+	c.Endpoint = defaultEndpoint
+	if cluster == nil {
+		return &c
+	}
+
+	if cluster.Endpoint != "" {
+		c.Endpoint = cluster.Endpoint
+	}
+	if *cluster != (ClusterConfig{Endpoint: cluster.Endpoint}) {
+		c.ClientID = cluster.ClientID
+		c.ClientSecret = cluster.ClientSecret
+		c.TenantID = cluster.TenantID
+		c.UseManagedIdentity = cluster.UseManagedIdentity
+		c.UseWorkloadIdentity = cluster.UseWorkloadIdentity
+		c.ClientCertificatePath = cluster.ClientCertificatePath
+		c.ClientCertificatePassword = cluster.ClientCertificatePassword
+		c.SendCertificateChain = cluster.SendCertificateChain
+		c.UseAzureCLI = cluster.UseAzureCLI
+		c.FederatedTokenFilePath = cluster.FederatedTokenFilePath
+		c.TokenCredential = nil
+	}
+	return &c
+}
+
+// validateAuthentication returns problems of authentication settings, at most one authentication method can be chosen.
+// When none is chosen, application key of clientId, clientSecret and tenantId is used.
+func (kc *KustoConfig) validateAuthentication() []error {
+	var methods []string
+	if kc.UseManagedIdentity {
+		methods = append(methods, "useManagedIdentity")
+	}
+	if kc.UseWorkloadIdentity {
+		methods = append(methods, "useWorkloadIdentity")
+	}
+	if kc.UseAzureCLI {
+		methods = append(methods, "useAzureCli")
+	}
+	if kc.ClientCertificatePath != "" {
+		methods = append(methods, "clientCertificatePath")
+	}
+	if kc.FederatedTokenFilePath != "" {
+		methods = append(methods, "federatedTokenFilePath")
+	}
+	if kc.TokenCredential != nil {
+		methods = append(methods, "custom token credential")
+	}
+
+	var problems []error
+	switch {
+	case len(methods) > 1:
+		problems = append(problems, fmt.Errorf("only one authentication method can be set, got %s", strings.Join(methods, ", ")))
+	case len(methods) == 0:
+		if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
+			problems = append(problems, errors.New("missing client configuration (clientId, clientSecret, tenantId) & no other authentication method (useManagedIdentity, useWorkloadIdentity, useAzureCli, clientCertificatePath, federatedTokenFilePath) is set for kusto"))
+		}
+	}
+	if kc.ClientCertificatePath != "" || kc.FederatedTokenFilePath != "" {
+		if kc.ClientID == "" || kc.TenantID == "" {
+			problems = append(problems, errors.New("clientId and tenantId must be set for clientCertificatePath and federatedTokenFilePath"))
+		}
+	}
+	if kc.ClientCertificatePath == "" && (kc.ClientCertificatePassword != "" || kc.SendCertificateChain) {
+		problems = append(problems, errors.New("clientCertificatePassword and sendCertificateChain require clientCertificatePath"))
+	}
+	if kc.ClientCertificatePath != "" {
+		if _, err := os.Stat(kc.ClientCertificatePath); err != nil {
+			problems = append(problems, fmt.Errorf("invalid clientCertificatePath: %w", err))
+		}
+	}
+	if kc.FederatedTokenFilePath != "" {
+		if _, err := os.Stat(kc.FederatedTokenFilePath); err != nil {
+			problems = append(problems, fmt.Errorf("invalid federatedTokenFilePath: %w", err))
+		}
+	}
+	return problems
+}
+
+func (rr *RoutingRule) validate(defaultDatabase string) error {
+	if rr.TraceTableName == "" {
+		return errors.New("missing traceTableName")
+	}
+	if rr.Tenant == "" && rr.ServiceName == "" && rr.ResourceAttribute == "" {
+		return errors.New("at least one of tenant, serviceName or resourceAttribute must be set")
+	}
+	if rr.ResourceAttribute == "" && rr.ResourceAttributeValue != "" {
+		return errors.New("resourceAttributeValue set without resourceAttribute")
+	}
+	if rr.Database == "" {
+		rr.Database = defaultDatabase
+	}
 	return nil
 }
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValidateRoutingRules(testing *testing.T) {
+	kc := &KustoConfig{
+		UseManagedIdentity: true,
+		Endpoint:           "https://test.kusto.windows.net",
+		Database:           "shared",
+		RoutingRules: []RoutingRule{
+			{ServiceName: "billing", TraceTableName: "BillingTraces"},
+		},
+	}
+
+	assert.NoError(testing, kc.Validate())
+	assert.Equal(testing, "shared", kc.RoutingRules[0].Database)
+	assert.Equal(testing, "x-tenant", kc.TenantHeader)
+
+	kc.RoutingRules = append(kc.RoutingRules, RoutingRule{TraceTableName: "NoConditions"})
+	assert.Error(testing, kc.Validate())
+
+	kc.RoutingRules = []RoutingRule{{Tenant: "team-a"}}
+	assert.Error(testing, kc.Validate())
+
+	kc.RoutingRules = []RoutingRule{
+		{Tenant: "team-a", TraceTableName: "TeamTraces"},
+		{Tenant: "team-b", TraceTableName: "TeamTraces"},
+	}
+	assert.ErrorContains(testing, kc.Validate(), "table shared.TeamTraces is already used by rules of another tenant")
+}
+
+func Test_ValidateReportsEveryProblem(testing *testing.T) {
+	kc := &KustoConfig{
+		ReadTables:   []TableReference{{Database: "archive"}},
+		RoutingRules: []RoutingRule{{Tenant: "team-a"}},
+	}
+
+	err := kc.Validate()
+	assert.ErrorContains(testing, err, "missing database")
+	assert.ErrorContains(testing, err, "missing endpoint")
+	assert.ErrorContains(testing, err, "clientId, clientSecret, tenantId")
+	assert.ErrorContains(testing, err, "missing table in readTables[0]")
+	assert.ErrorContains(testing, err, "invalid routingRules[0]: missing traceTableName")
+}
+
+type staticTokenCredential struct{}
+
+func (staticTokenCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token"}, nil
+}
+
+func Test_ValidateAuthentication(testing *testing.T) {
+	certificate := filepath.Join(testing.TempDir(), "client.pem")
+	require.NoError(testing, os.WriteFile(certificate, []byte("certificate"), 0o600))
+	tokenFile := filepath.Join(testing.TempDir(), "token")
+	require.NoError(testing, os.WriteFile(tokenFile, []byte("token"), 0o600))
+
+	newConfig := func() *KustoConfig {
+		return &KustoConfig{Endpoint: "https://test.kusto.windows.net", Database: "shared"}
+	}
+
+	kc := newConfig()
+	kc.UseAzureCLI = true
+	assert.NoError(testing, kc.Validate())
+
+	kc = newConfig()
+	kc.TokenCredential = staticTokenCredential{}
+	assert.NoError(testing, kc.Validate())
+
+	kc = newConfig()
+	kc.ClientID, kc.TenantID = "client", "tenant"
+	kc.ClientCertificatePath, kc.ClientCertificatePassword, kc.SendCertificateChain = certificate, "password", true
+	assert.NoError(testing, kc.Validate())
+
+	kc = newConfig()
+	kc.ClientID, kc.TenantID, kc.FederatedTokenFilePath = "client", "tenant", tokenFile
+	assert.NoError(testing, kc.Validate())
+
+	kc = newConfig()
+	kc.UseManagedIdentity, kc.UseAzureCLI, kc.ClientCertificatePath = true, true, certificate
+	assert.ErrorContains(testing, kc.Validate(), "only one authentication method can be set, got useManagedIdentity, useAzureCli, clientCertificatePath")
+
+	kc = newConfig()
+	kc.ClientCertificatePath = filepath.Join(testing.TempDir(), "missing.pfx")
+	err := kc.Validate()
+	assert.ErrorContains(testing, err, "clientId and tenantId must be set")
+	assert.ErrorContains(testing, err, "invalid clientCertificatePath")
+
+	kc = newConfig()
+	kc.ClientID, kc.TenantID, kc.ClientCertificatePassword = "client", "tenant", "password"
+	assert.ErrorContains(testing, kc.Validate(), "clientCertificatePassword and sendCertificateChain require clientCertificatePath")
+}
+
+func Test_ReaderAndWriterConfig(testing *testing.T) {
+	kc := &KustoConfig{
+		Endpoint:           "https://jaeger.westeurope.kusto.windows.net",
+		Database:           "shared",
+		UseManagedIdentity: true,
+	}
+	assert.Equal(testing, kc.Endpoint, kc.ReaderConfig().Endpoint)
+	assert.Equal(testing, kc.Endpoint, kc.WriterConfig().Endpoint)
+	assert.True(testing, kc.WriterConfig().UseManagedIdentity)
+
+	kc.Reader = &ClusterConfig{Endpoint: "https://jaeger-follower.westeurope.kusto.windows.net"}
+	kc.Writer = &ClusterConfig{ClientID: "writer", TenantID: "tenant", FederatedTokenFilePath: "/var/run/secrets/token"}
+
+	reader := kc.ReaderConfig()
+	assert.Equal(testing, "https://jaeger-follower.westeurope.kusto.windows.net", reader.Endpoint)
+	assert.True(testing, reader.UseManagedIdentity)
+	assert.Nil(testing, reader.Reader)
+
+	writer := kc.WriterConfig()
+	assert.Equal(testing, kc.Endpoint, writer.Endpoint)
+	assert.False(testing, writer.UseManagedIdentity)
+	assert.Equal(testing, "writer", writer.ClientID)
+	assert.Equal(testing, "/var/run/secrets/token", writer.FederatedTokenFilePath)
+
+	kc.Writer.Endpoint = "https://ingest-jaeger.westeurope.kusto.windows.net"
+	assert.Equal(testing, kc.Writer.Endpoint, kc.WriterConfig().Endpoint)
+	assert.Equal(testing, kc.Endpoint, kc.WriterConfig().EngineEndpoint())
+	assert.ErrorContains(testing, kc.Validate(), "invalid writer: invalid federatedTokenFilePath")
+
+	kc.Writer = &ClusterConfig{ClientID: "writer"}
+	assert.ErrorContains(testing, kc.Validate(), "invalid writer: missing client configuration")
+}
@@ -6,17 +6,21 @@ import (
 
 // NewLogger returns configured logger from global options
 func NewLogger(pc *PluginConfig) hclog.Logger {
-	level := hclog.LevelFromString(pc.LogLevel)
-	if level == hclog.NoLevel {
-		// log level used by default
-		level = hclog.Warn
-	}
-
 	return hclog.New(
 		&hclog.LoggerOptions{
-			Level:      level,
+			Level:      LogLevel(pc),
 			Name:       ServiceName,
 			JSONFormat: pc.LogJson,
 		},
 	)
 }
+
+// LogLevel returns level of logger from global options, it's applied to running logger on config reload
+func LogLevel(pc *PluginConfig) hclog.Level {
+	level := hclog.LevelFromString(pc.LogLevel)
+	if level == hclog.NoLevel {
+		// log level used by default
+		level = hclog.Warn
+	}
+	return level
+}
@@ -1,62 +1,197 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
 const (
 	ServiceName             = "jaeger-kusto"
 	PluginEnvironmentPrefix = "JAEGER_KUSTO_PLUGIN"
 )
 
+// Mode selects storage components served by the plugin
+type Mode string
+
+const (
+	// ModeRead serves span and dependencies readers only, e.g. for Jaeger query
+	ModeRead Mode = "read"
+	// ModeWrite serves span writer only, e.g. for Jaeger collector
+	ModeWrite Mode = "write"
+	// ModeBoth serves readers and writer
+	ModeBoth Mode = "both"
+)
+
+// Reads returns true when readers are served in the mode
+func (m Mode) Reads() bool {
+	return m != ModeWrite
+}
+
+// Writes returns true when span writer is served in the mode
+func (m Mode) Writes() bool {
+	return m != ModeRead
+}
+
 // PluginConfig contains global options
 type PluginConfig struct {
-	DiagnosticsProfilingEnabled bool    `json:"diagnosticsProfilingEnabled"`
-	DiagnosticsListenAddress    string  `json:"diagnosticsListenAddress"`
-	KustoConfigPath             string  `json:"kustoConfigPath"`
-	LogLevel                    string  `json:"logLevel"`
-	LogJson                     bool    `json:"logJson"`
-	RemoteMode                  bool    `json:"remoteMode"`
-	RemoteListenAddress         string  `json:"remoteListenAddress"`
-	TracingSamplerPercentage    float64 `json:"tracingSamplerPercentage"`
-	TracingRPCMetrics           bool    `json:"tracingRPCMetrics"`
-	WriterBatchMaxBytes         int     `json:"writerBatchMaxBytes"`
-	WriterBatchTimeoutSeconds   int     `json:"writerBatchTimeoutSeconds"`
-	WriterSpanBufferSize        int     `json:"writerSpanBufferSize"`
-	WriterWorkersCount          int     `json:"writerWorkersCount"`
-	DisableJaegerUiTraces       bool    `json:"disableJaegerUiTraces"`
-	ReadNoTruncation            bool    `json:"readNoTruncation"`
-	ReadNoTimeout               bool    `json:"readNoTimeout"`
+	DiagnosticsProfilingEnabled  bool    `json:"diagnosticsProfilingEnabled"`
+	DiagnosticsListenAddress     string  `json:"diagnosticsListenAddress"`
+	KustoConfigPath              string  `json:"kustoConfigPath"`
+	Mode                         Mode    `json:"mode"`
+	LogLevel                     string  `json:"logLevel"`
+	LogJson                      bool    `json:"logJson"`
+	RemoteMode                   bool    `json:"remoteMode"`
+	RemoteListenAddress          string  `json:"remoteListenAddress"`
+	TracingSamplerPercentage     float64 `json:"tracingSamplerPercentage"`
+	TracingRPCMetrics            bool    `json:"tracingRPCMetrics"`
+	WriterBatchMaxBytes          int     `json:"writerBatchMaxBytes"`
+	WriterBatchTimeoutSeconds    int     `json:"writerBatchTimeoutSeconds"`
+	WriterSpanBufferSize         int     `json:"writerSpanBufferSize"`
+	WriterWorkersCount           int     `json:"writerWorkersCount"`
+	WriterShutdownTimeoutSeconds int     `json:"writerShutdownTimeoutSeconds"`
+	WriterIngestionFormat        string  `json:"writerIngestionFormat"`
+	WriterIngestionMappingRef    string  `json:"writerIngestionMappingRef"`
+	WriterCompressionEnabled     bool    `json:"writerCompressionEnabled"`
+	DisableJaegerUiTraces        bool    `json:"disableJaegerUiTraces"`
+	ReadNoTruncation             bool    `json:"readNoTruncation"`
+	ReadNoTimeout                bool    `json:"readNoTimeout"`
+
+	ReadMetadataLookbackHours       int `json:"readMetadataLookbackHours"`
+	ReadMetadataCacheRefreshSeconds int `json:"readMetadataCacheRefreshSeconds"`
+
+	ReadMaxSpansPerTrace int `json:"readMaxSpansPerTrace"`
+	ReadMaxSearchRows    int `json:"readMaxSearchRows"`
+
+	ReadTagExpressionsEnabled bool `json:"readTagExpressionsEnabled"`
+
+	DependenciesAggregationEnabled    bool `json:"dependenciesAggregationEnabled"`
+	DependenciesAggregationBinMinutes int  `json:"dependenciesAggregationBinMinutes"`
+	DependenciesByOperation           bool `json:"dependenciesByOperation"`
+
+	WriterIngestionStatusReporting      bool `json:"writerIngestionStatusReporting"`
+	WriterIngestionStatusConcurrency    int  `json:"writerIngestionStatusConcurrency"`
+	WriterIngestionStatusTimeoutSeconds int  `json:"writerIngestionStatusTimeoutSeconds"`
+
+	ConfigWatchIntervalSeconds int `json:"configWatchIntervalSeconds"`
 }
 
 // NewDefaultPluginConfig returns default configuration options
 func NewDefaultPluginConfig() *PluginConfig {
 	return &PluginConfig{
-		DiagnosticsProfilingEnabled: false,
-		DiagnosticsListenAddress:    ":6060",
-		KustoConfigPath:             "",
-		LogLevel:                    "warn",
-		LogJson:                     false,
-		RemoteMode:                  false,
-		RemoteListenAddress:         "tcp://:8989",
-		TracingSamplerPercentage:    0.0,     // disabled by default
-		TracingRPCMetrics:           false,   // disabled by default
-		WriterBatchMaxBytes:         1048576, // 1 Mb by default
-		WriterBatchTimeoutSeconds:   5,
-		WriterSpanBufferSize:        100,
-		WriterWorkersCount:          5,
-		DisableJaegerUiTraces:       true, //disable UI logs of jaeger into OTELTraces. No traces from Jaeger UI will be sent
-		ReadNoTruncation:            false,
-		ReadNoTimeout:               false,
+		DiagnosticsProfilingEnabled:  false,
+		DiagnosticsListenAddress:     ":6060",
+		KustoConfigPath:              "",
+		Mode:                         ModeBoth,
+		LogLevel:                     "warn",
+		LogJson:                      false,
+		RemoteMode:                   false,
+		RemoteListenAddress:          "tcp://:8989",
+		TracingSamplerPercentage:     0.0,     // disabled by default
+		TracingRPCMetrics:            false,   // disabled by default
+		WriterBatchMaxBytes:          1048576, // 1 Mb by default
+		WriterBatchTimeoutSeconds:    5,
+		WriterSpanBufferSize:         100,
+		WriterWorkersCount:           5,
+		WriterShutdownTimeoutSeconds: 30,
+		WriterIngestionFormat:        "csv",
+		WriterIngestionMappingRef:    "",
+		WriterCompressionEnabled:     true,
+		DisableJaegerUiTraces:        true, //disable UI logs of jaeger into OTELTraces. No traces from Jaeger UI will be sent
+		ReadNoTruncation:             false,
+		ReadNoTimeout:                false,
+
+		ReadMetadataLookbackHours:       168, // services and operations seen in the last 7 days
+		ReadMetadataCacheRefreshSeconds: 0,   // cache disabled by default
+
+		ReadMaxSpansPerTrace: 0, // unlimited
+		ReadMaxSearchRows:    0, // unlimited
+
+		ReadTagExpressionsEnabled: false, // tags are compared literally by default
+
+		DependenciesAggregationEnabled:    false,
+		DependenciesAggregationBinMinutes: 60,
+		DependenciesByOperation:           false,
+
+		WriterIngestionStatusReporting:      false, // status table reporting slows down ingestion, enable it for troubleshooting
+		WriterIngestionStatusConcurrency:    10,
+		WriterIngestionStatusTimeoutSeconds: 600,
+
+		ConfigWatchIntervalSeconds: 10, // config files are checked for changes every 10 seconds, 0 disables watching
 	}
 }
 
-// ParseConfig reads file at path and returns instance of PluginConfig or error
+// ParseConfig reads file at path and returns instance of PluginConfig or error.
+// Values of file are overridden by environment variables, file is optional when path is empty.
 func ParseConfig(path string) (*PluginConfig, error) {
-	pc := NewDefaultPluginConfig()
-	if err := load(path, pc); err != nil {
+	pc, err := parseConfig(path, nil)
+	if err != nil {
 		return nil, err
 	}
+	return pc, nil
+}
 
-	if err := override(PluginEnvironmentPrefix, pc); err != nil {
-		return nil, err
+func parseConfig(path string, flagValues map[string]string) (*PluginConfig, error) {
+	pc := NewDefaultPluginConfig()
+	if path != "" {
+		if err := load(path, pc); err != nil {
+			return nil, err
+		}
 	}
 
-	return pc, nil
+	// every problem of environment variables, flags and values is reported at once
+	err := errors.Join(
+		override(PluginEnvironmentPrefix, pc),
+		setFlagFields(pc, flagValues),
+		pc.Validate(),
+	)
+	return pc, err
+}
+
+// Validate returns error listing every invalid option by field name
+func (pc *PluginConfig) Validate() error {
+	var problems []error
+	if pc.LogLevel != "" && hclog.LevelFromString(pc.LogLevel) == hclog.NoLevel {
+		problems = append(problems, fmt.Errorf("invalid logLevel %q, expected one of: trace, debug, info, warn, error, off", pc.LogLevel))
+	}
+	switch pc.Mode {
+	case "", ModeRead, ModeWrite, ModeBoth:
+	default:
+		problems = append(problems, fmt.Errorf("unsupported mode %q, expected one of: read, write, both", pc.Mode))
+	}
+	if pc.RemoteMode {
+		if _, err := url.Parse(pc.RemoteListenAddress); err != nil || !strings.Contains(pc.RemoteListenAddress, "://") {
+			problems = append(problems, fmt.Errorf("invalid remoteListenAddress %q, expected scheme://address, e.g. tcp://:8989", pc.RemoteListenAddress))
+		}
+	}
+	if pc.WriterBatchMaxBytes <= 0 {
+		problems = append(problems, errors.New("writerBatchMaxBytes must be positive"))
+	}
+	if pc.WriterBatchTimeoutSeconds <= 0 {
+		problems = append(problems, errors.New("writerBatchTimeoutSeconds must be positive"))
+	}
+	if pc.WriterSpanBufferSize < 0 {
+		problems = append(problems, errors.New("writerSpanBufferSize must not be negative"))
+	}
+	if pc.WriterWorkersCount <= 0 {
+		problems = append(problems, errors.New("writerWorkersCount must be positive"))
+	}
+	switch strings.ToLower(pc.WriterIngestionFormat) {
+	case "", "csv", "json", "multijson":
+	default:
+		problems = append(problems, fmt.Errorf("unsupported writerIngestionFormat %q, expected one of: csv, json, multijson", pc.WriterIngestionFormat))
+	}
+	if pc.DependenciesAggregationEnabled && pc.DependenciesAggregationBinMinutes <= 0 {
+		problems = append(problems, errors.New("dependenciesAggregationBinMinutes must be positive when dependenciesAggregationEnabled is set"))
+	}
+	if pc.WriterIngestionStatusReporting && pc.WriterIngestionStatusConcurrency <= 0 {
+		problems = append(problems, errors.New("writerIngestionStatusConcurrency must be positive when writerIngestionStatusReporting is set"))
+	}
+	if pc.ConfigWatchIntervalSeconds < 0 {
+		problems = append(problems, errors.New("configWatchIntervalSeconds must not be negative"))
+	}
+	return errors.Join(problems...)
 }
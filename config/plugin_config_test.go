@@ -0,0 +1,36 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PluginConfigValidate(testing *testing.T) {
+	pc := NewDefaultPluginConfig()
+	assert.NoError(testing, pc.Validate())
+
+	pc.LogLevel = "loud"
+	pc.WriterWorkersCount = 0
+	pc.WriterIngestionFormat = "parquet"
+	pc.RemoteMode = true
+	pc.RemoteListenAddress = ":8989"
+	err := pc.Validate()
+	assert.ErrorContains(testing, err, `invalid logLevel "loud"`)
+	assert.ErrorContains(testing, err, "writerWorkersCount must be positive")
+	assert.ErrorContains(testing, err, `unsupported writerIngestionFormat "parquet"`)
+	assert.ErrorContains(testing, err, `invalid remoteListenAddress ":8989"`)
+}
+
+func Test_PluginConfigMode(testing *testing.T) {
+	pc := NewDefaultPluginConfig()
+	assert.Equal(testing, ModeBoth, pc.Mode)
+	assert.True(testing, pc.Mode.Reads())
+	assert.True(testing, pc.Mode.Writes())
+
+	assert.False(testing, ModeRead.Writes())
+	assert.False(testing, ModeWrite.Reads())
+
+	pc.Mode = "query"
+	assert.ErrorContains(testing, pc.Validate(), `unsupported mode "query", expected one of: read, write, both`)
+}
@@ -1,65 +1,140 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/spf13/viper"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"unicode"
+
+	"github.com/spf13/viper"
 )
 
+// load reads config file at path, file format is detected by extension (.json, .yaml or .yml) or by content
+// for files without known extension
 func load(path string, data interface{}) error {
 	if path == "" {
 		return errors.New("empty path to config")
 	}
 
-	_, err := os.ReadFile(path)
+	content, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
 	v := viper.New()
-	v.SetConfigFile(path)
-	v.SetConfigType("json")
+	v.SetConfigType(configType(path, content))
 
-	if err := v.ReadInConfig(); err != nil {
-		return err
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("failed to read config %s: %w", path, err)
 	}
 
 	return v.Unmarshal(data)
 }
 
+func configType(path string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		return "json"
+	}
+	return "yaml"
+}
+
+// override sets fields of data from environment variables named as prefix and field name in upper snake case,
+// e.g. JAEGER_KUSTO_CLIENT_SECRET sets ClientSecret with JAEGER_KUSTO prefix
 func override(prefix string, data interface{}) error {
-	v := viper.New()
-	v.SetEnvPrefix(prefix)
+	return setFields(data, func(field reflect.StructField) (string, bool) {
+		return os.LookupEnv(fmt.Sprintf("%s_%s", prefix, toEnvironmentVariable(field.Name)))
+	})
+}
 
-	pointerType := reflect.TypeOf(data)
-	if pointerType.Kind() != reflect.Ptr {
-		return errors.New("data not a pointer to struct")
-	}
-	dataType := pointerType.Elem()
-	if dataType.Kind() != reflect.Struct {
+// setFields sets every configurable field of data, which value returns, in the order of fields.
+// Returned error lists all fields with invalid values.
+func setFields(data interface{}, value func(field reflect.StructField) (string, bool)) error {
+	pointer := reflect.ValueOf(data)
+	if pointer.Kind() != reflect.Ptr || pointer.Elem().Kind() != reflect.Struct {
 		return errors.New("data not a pointer to struct")
 	}
 
-	keys := make([]string, dataType.NumField())
-	for i := 0; i < dataType.NumField(); i++ {
-		keys = append(keys, dataType.Field(i).Name)
+	var problems []error
+	for _, field := range configurableFields(pointer.Elem().Type()) {
+		raw, ok := value(field)
+		if !ok {
+			continue
+		}
+		if err := setField(pointer.Elem().FieldByIndex(field.Index), raw); err != nil {
+			problems = append(problems, fmt.Errorf("invalid value of %s: %w", jsonName(field), err))
+		}
 	}
+	return errors.Join(problems...)
+}
 
-	for _, key := range keys {
-		if key == "" {
+// configurableFields returns exported fields, which can be set from text, fields holding functions are skipped
+func configurableFields(dataType reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < dataType.NumField(); i++ {
+		field := dataType.Field(i)
+		if !field.IsExported() || jsonName(field) == "-" {
+			continue
+		}
+		elem := field.Type
+		for elem.Kind() == reflect.Slice || elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Func {
 			continue
 		}
+		fields = append(fields, field)
+	}
+	return fields
+}
 
-		variable := fmt.Sprintf("%s_%s", prefix, toEnvironmentVariable(key))
-		if err := v.BindEnv(key, variable); err != nil {
+// setField parses scalar values from text, lists and objects are expected to be JSON encoded
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(value)
+	case reflect.Float32, reflect.Float64:
+		value, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
 			return err
 		}
+		field.SetFloat(value)
+	default:
+		return json.Unmarshal([]byte(raw), field.Addr().Interface())
 	}
+	return nil
+}
 
-	return v.Unmarshal(data)
+// jsonName returns name of the field in config files
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
 }
 
 func toEnvironmentVariable(name string) string {
@@ -78,3 +153,8 @@ func toEnvironmentVariable(name string) string {
 
 	return output
 }
+
+// toFlagName converts name of config field to kebab case, e.g. writerBatchMaxBytes to writer-batch-max-bytes
+func toFlagName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(toEnvironmentVariable(name)), "_", "-")
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// WatchFiles calls onChange when content of any of files changes, until ctx is done. Files are polled rather than
+// watched with file system notifications, as editors and kubernetes config maps replace files instead of writing them.
+// Missing files are treated as empty, so that creating or removing a file is a change too.
+func WatchFiles(ctx context.Context, paths []string, interval time.Duration, onChange func()) {
+	checksums := make([][sha256.Size]byte, len(paths))
+	for i, path := range paths {
+		checksums[i] = fileChecksum(path)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed := false
+			for i, path := range paths {
+				if checksum := fileChecksum(path); checksum != checksums[i] {
+					checksums[i] = checksum
+					changed = true
+				}
+			}
+			if changed {
+				onChange()
+			}
+		}
+	}
+}
+
+func fileChecksum(path string) [sha256.Size]byte {
+	content, _ := os.ReadFile(path)
+	return sha256.Sum256(content)
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WatchFiles(testing *testing.T) {
+	path := writeConfigFile(testing, "plugin.yaml", "logLevel: warn\n")
+	missing := filepath.Join(testing.TempDir(), "kusto.yaml")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var changes atomic.Int32
+	go WatchFiles(ctx, []string{path, missing}, 10*time.Millisecond, func() { changes.Add(1) })
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(testing, int32(0), changes.Load())
+
+	require.NoError(testing, os.WriteFile(path, []byte("logLevel: debug\n"), 0o600))
+	assert.Eventually(testing, func() bool { return changes.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(testing, os.WriteFile(missing, []byte("database: jaeger\n"), 0o600))
+	assert.Eventually(testing, func() bool { return changes.Load() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_LogLevel(testing *testing.T) {
+	pc := NewDefaultPluginConfig()
+	pc.LogLevel = "debug"
+	logger := NewLogger(pc)
+	assert.True(testing, logger.IsDebug())
+
+	pc.LogLevel = "unknown"
+	logger.SetLevel(LogLevel(pc))
+	assert.False(testing, logger.IsInfo())
+	assert.True(testing, logger.IsWarn())
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/dodopizza/jaeger-kusto/runner"
@@ -11,12 +12,19 @@ import (
 )
 
 func main() {
-	configPath := ""
-	flag.StringVar(&configPath, "config", "", "The path to the plugin's configuration file")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		os.Exit(bootstrap(os.Args[2:], os.Stdout))
+	}
+
+	flags := config.NewFlags(flag.CommandLine)
 	flag.Parse()
 
-	pluginConfig, err := config.ParseConfig(configPath)
+	pluginConfig, err := flags.ParsePluginConfig()
 	if err != nil {
+		fmt.Fprintln(os.Stderr, "error occurred while reading plugin configuration:", err)
 		os.Exit(1)
 	}
 
@@ -28,7 +36,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	kustoConfig, err := config.ParseKustoConfig(pluginConfig.KustoConfigPath, pluginConfig.ReadNoTruncation, pluginConfig.ReadNoTimeout)
+	kustoConfig, err := flags.ParseKustoConfig(pluginConfig)
 	if err != nil {
 		logger.Error("error occurred while reading kusto configuration", "error", err)
 		os.Exit(1)
@@ -40,7 +48,11 @@ func main() {
 		os.Exit(2)
 	}
 
-	if err := runner.Serve(pluginConfig, kustoStore, logger); err != nil {
+	stopWatching := runner.WatchConfig(flags, pluginConfig, kustoStore, logger)
+
+	err = runner.Serve(pluginConfig, kustoStore, logger)
+	stopWatching()
+	if err != nil {
 		logger.Error("error occurred while invoking runner", "error", err)
 		os.Exit(3)
 	}
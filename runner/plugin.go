@@ -1,6 +1,8 @@
 package runner
 
 import (
+	"syscall"
+
 	"github.com/dodopizza/jaeger-kusto/config"
 	"github.com/hashicorp/go-hclog"
 	storageGRPC "github.com/jaegertracing/jaeger/plugin/storage/grpc"
@@ -21,8 +23,13 @@ func servePlugin(c *config.PluginConfig, store shared.StoragePlugin, logger hclo
 
 	logger.Info("starting plugin")
 	storageGRPC.ServeWithGRPCServer(&pluginServices, func(options []googleGRPC.ServerOption) *googleGRPC.Server {
-		return newGRPCServerWithTracer(tracer)
+		server := newGRPCServerWithTracer(tracer)
+		// interrupt signals are ignored by plugin, host process is responsible to stop it
+		registerGracefulShutdown(server, logger, syscall.SIGTERM)
+		return server
 	})
 
+	// plugin served until host killed it or termination signal received
+	closeStore(store, logger)
 	return nil
 }
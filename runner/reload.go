@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+)
+
+// ReloadablePlugin is implemented by stores able to apply changed configuration without restart
+type ReloadablePlugin interface {
+	Reload(pc *config.PluginConfig, kc *config.KustoConfig) error
+}
+
+// WatchConfig reloads configuration when config files change or process receives SIGHUP. Log level is applied
+// to logger, the rest of settings are applied by store. Configuration failing to parse is logged and ignored.
+// Files are watched with paths and interval of the latest applied configuration. Returned function stops watching
+// and waits for reload in progress.
+func WatchConfig(flags *config.Flags, pc *config.PluginConfig, store shared.StoragePlugin, logger hclog.Logger) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	reloads := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+			// reload is already pending and will read the latest files
+		}
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	var done sync.WaitGroup
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		watcher := watchConfigFiles(ctx, flags, pc, requestReload, logger)
+		defer func() { watcher.stop() }()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangups:
+				logger.Info("received SIGHUP, reloading configuration")
+				requestReload()
+			case <-reloads:
+				reloaded := reloadConfig(flags, store, logger)
+				if reloaded != nil && !watcher.watches(flags, reloaded) {
+					watcher.stop()
+					watcher = watchConfigFiles(ctx, flags, reloaded, requestReload, logger)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangups)
+		cancel()
+		done.Wait()
+	}
+}
+
+// configFilesWatcher polls config files for changes in background
+type configFilesWatcher struct {
+	paths    []string
+	interval time.Duration
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// configFilePaths returns paths of plugin and kusto config files
+func configFilePaths(flags *config.Flags, pc *config.PluginConfig) []string {
+	var paths []string
+	for _, path := range []string{flags.ConfigPath, pc.KustoConfigPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// watchConfigFiles starts watching config files of plugin config, unless watching is disabled
+func watchConfigFiles(ctx context.Context, flags *config.Flags, pc *config.PluginConfig, onChange func(), logger hclog.Logger) *configFilesWatcher {
+	watchCtx, stop := context.WithCancel(ctx)
+	w := &configFilesWatcher{
+		paths:    configFilePaths(flags, pc),
+		interval: time.Duration(pc.ConfigWatchIntervalSeconds) * time.Second,
+		done:     make(chan struct{}),
+	}
+	w.stop = func() {
+		stop()
+		<-w.done
+	}
+
+	if w.interval <= 0 || len(w.paths) == 0 {
+		close(w.done)
+		return w
+	}
+	logger.Info("watching config files", "paths", w.paths, "interval", w.interval)
+	go func() {
+		defer close(w.done)
+		config.WatchFiles(watchCtx, w.paths, w.interval, func() {
+			logger.Info("config files changed, reloading configuration")
+			onChange()
+		})
+	}()
+	return w
+}
+
+// watches returns true when watcher polls config files of plugin config with its interval
+func (w *configFilesWatcher) watches(flags *config.Flags, pc *config.PluginConfig) bool {
+	return reflect.DeepEqual(w.paths, configFilePaths(flags, pc)) &&
+		w.interval == time.Duration(pc.ConfigWatchIntervalSeconds)*time.Second
+}
+
+// reloadConfig parses configs the same way as on start and applies them to logger and store.
+// Returns applied plugin config, or nil when configuration is kept.
+func reloadConfig(flags *config.Flags, store shared.StoragePlugin, logger hclog.Logger) *config.PluginConfig {
+	pc, err := flags.ParsePluginConfig()
+	if err != nil {
+		logger.Error("error occurred while reloading plugin configuration, previous configuration is kept", "error", err)
+		return nil
+	}
+	kc, err := flags.ParseKustoConfig(pc)
+	if err != nil {
+		logger.Error("error occurred while reloading kusto configuration, previous configuration is kept", "error", err)
+		return nil
+	}
+
+	logger.SetLevel(config.LogLevel(pc))
+	if plugin, ok := store.(ReloadablePlugin); ok {
+		if err := plugin.Reload(pc, kc); err != nil {
+			logger.Error("error occurred while applying reloaded configuration to kusto storage", "error", err)
+			return nil
+		}
+	}
+	logger.Info("configuration reloaded")
+	return pc
+}
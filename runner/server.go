@@ -5,14 +5,10 @@ import (
 	"github.com/dodopizza/jaeger-kusto/config"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
-	"google.golang.org/grpc"
-	"io"
 	"net"
 	"net/url"
 	"os"
-	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 )
 
@@ -48,38 +44,9 @@ func serveServer(c *config.PluginConfig, store shared.StoragePlugin, logger hclo
 	}
 
 	logger.Info("starting server", "address", address, "scheme", scheme)
-	wg := registerGracefulShutdown(server, store, logger)
-	if err := server.Serve(listener); err != nil {
-		return err
-	}
-
-	wg.Wait()
-	return nil
-}
-
-func registerGracefulShutdown(server *grpc.Server, store shared.StoragePlugin, logger hclog.Logger) *sync.WaitGroup {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
-
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	go func() {
-		sig := <-signals
-		logger.Info("received signal, attempting gracefully stop server and plugin", "signal", sig)
-		server.GracefulStop()
-
-		// perform cleanup logic on writer
-		c, ok := store.SpanWriter().(io.Closer)
-		if ok {
-			_ = c.Close()
-		}
-
-		logger.Info("server stopped")
-		wg.Done()
-	}()
-
-	return wg
+	registerGracefulShutdown(server, logger, os.Interrupt, syscall.SIGTERM)
+	defer closeStore(store, logger)
+	return server.Serve(listener)
 }
 
 func parseListenAddress(addr string) (scheme, address string, err error) {
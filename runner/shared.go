@@ -1,6 +1,10 @@
 package runner
 
 import (
+	"io"
+	"os"
+	"os/signal"
+
 	"github.com/dodopizza/jaeger-kusto/config"
 	ot "github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
 	"github.com/hashicorp/go-hclog"
@@ -22,3 +26,33 @@ func newGRPCServerWithTracer(tracer opentracing.Tracer) *grpc.Server {
 		grpc.StreamInterceptor(ot.OpenTracingStreamServerInterceptor(tracer)),
 	)
 }
+
+// registerGracefulShutdown stops server gracefully when process receives any of provided signals
+func registerGracefulShutdown(server *grpc.Server, logger hclog.Logger, signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		sig := <-ch
+		logger.Info("received signal, attempting gracefully stop server", "signal", sig)
+		server.GracefulStop()
+		logger.Info("server stopped")
+	}()
+}
+
+// closeStore performs cleanup logic on store, stopping background jobs and flushing spans not yet written.
+// Stores, which can't be closed themselves, have their span writer closed.
+func closeStore(store shared.StoragePlugin, logger hclog.Logger) {
+	c, ok := store.(io.Closer)
+	if !ok {
+		c, ok = store.SpanWriter().(io.Closer)
+	}
+	if !ok {
+		return
+	}
+
+	logger.Info("closing store")
+	if err := c.Close(); err != nil {
+		logger.Error("error occurred while closing store", "error", err)
+	}
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/tushar2708/altcsv"
+)
+
+const (
+	// IngestionFormatCSV sends batches as CSV with all values quoted
+	IngestionFormatCSV = "csv"
+	// IngestionFormatJSON sends batches as JSON lines
+	IngestionFormatJSON = "json"
+	// IngestionFormatMultiJSON sends batches as a sequence of JSON objects
+	IngestionFormatMultiJSON = "multijson"
+)
+
+// parseIngestionFormat converts configured format name to ingestion data format
+func parseIngestionFormat(format string) (ingest.DataFormat, error) {
+	switch strings.ToLower(format) {
+	case "", IngestionFormatCSV:
+		return ingest.CSV, nil
+	case IngestionFormatJSON:
+		return ingest.JSON, nil
+	case IngestionFormatMultiJSON:
+		return ingest.MultiJSON, nil
+	default:
+		return ingest.DFUnknown, fmt.Errorf("unsupported ingestion format %q, expected one of: csv, json, multijson", format)
+	}
+}
+
+// spanBatch accumulates spans encoded in ingestion format, optionally compressing them with gzip
+type spanBatch struct {
+	format  ingest.DataFormat
+	payload bytes.Buffer
+	gz      *gzip.Writer
+	out     *countingWriter
+	csv     *altcsv.Writer
+	rows    int
+}
+
+// countingWriter counts bytes written before compression
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+func newSpanBatch(format ingest.DataFormat, compress bool) *spanBatch {
+	b := &spanBatch{
+		format: format,
+		out:    &countingWriter{},
+	}
+	if compress {
+		b.gz = gzip.NewWriter(&b.payload)
+	}
+	b.csv = altcsv.NewWriter(b.out)
+	b.csv.AllQuotes = true
+	b.Reset()
+	return b
+}
+
+// Add encodes span row produced by TransformSpanToStringArray
+func (b *spanBatch) Add(row []string) error {
+	if b.format == ingest.CSV {
+		if err := b.csv.Write(row); err != nil {
+			return err
+		}
+		b.csv.Flush()
+		if err := b.csv.Error(); err != nil {
+			return err
+		}
+	} else {
+		encoded, err := encodeSpanRowJSON(row)
+		if err != nil {
+			return err
+		}
+		if _, err := b.out.Write(encoded); err != nil {
+			return err
+		}
+	}
+
+	b.rows++
+	return nil
+}
+
+// Len returns size of batch before compression
+func (b *spanBatch) Len() int {
+	return b.out.n
+}
+
+// Rows returns number of spans in batch
+func (b *spanBatch) Rows() int {
+	return b.rows
+}
+
+// Bytes completes batch and returns payload ready for ingestion
+func (b *spanBatch) Bytes() ([]byte, error) {
+	if b.gz != nil {
+		if err := b.gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return b.payload.Bytes(), nil
+}
+
+// Reset discards batch contents so it can be reused
+func (b *spanBatch) Reset() {
+	b.payload.Reset()
+	b.rows = 0
+	b.out.n = 0
+	b.out.w = &b.payload
+	if b.gz != nil {
+		b.gz.Reset(&b.payload)
+		b.out.w = b.gz
+	}
+}
+
+// encodeSpanRowJSON encodes span row as a single line JSON object keyed by column names
+func encodeSpanRowJSON(row []string) ([]byte, error) {
+	if len(row) != len(kustoSpanColumns) {
+		return nil, fmt.Errorf("span row has %d values, expected %d", len(row), len(kustoSpanColumns))
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, column := range kustoSpanColumns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(column.Name)
+		buf.Write(name)
+		buf.WriteByte(':')
+
+		if column.Raw {
+			buf.WriteString(row[i])
+			continue
+		}
+		v, err := json.Marshal(row[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanBatch_JSON(t *testing.T) {
+	row, err := TransformSpanToStringArray(newBenchmarkSpan(1))
+	assert.NoError(t, err)
+
+	batch := newSpanBatch(ingest.JSON, false)
+	assert.NoError(t, batch.Add(row))
+	payload, err := batch.Bytes()
+	assert.NoError(t, err)
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(payload, &decoded))
+	assert.Equal(t, row[0], decoded["TraceID"])
+	assert.Equal(t, "GET /api/cart", decoded["OperationName"])
+	assert.Equal(t, float64(1), decoded["Flags"])
+	assert.IsType(t, map[string]interface{}{}, decoded["Tags"])
+	assert.Equal(t, len(payload), batch.Len())
+}
+
+func TestSpanBatch_Gzip(t *testing.T) {
+	row, err := TransformSpanToStringArray(newBenchmarkSpan(1))
+	assert.NoError(t, err)
+
+	plain := newSpanBatch(ingest.CSV, false)
+	compressed := newSpanBatch(ingest.CSV, true)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, plain.Add(row))
+		assert.NoError(t, compressed.Add(row))
+	}
+	expected, _ := plain.Bytes()
+	payload, err := compressed.Bytes()
+	assert.NoError(t, err)
+
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+	assert.Equal(t, len(expected), compressed.Len())
+
+	// batch must be reusable after reset
+	compressed.Reset()
+	assert.Equal(t, 0, compressed.Len())
+	assert.NoError(t, compressed.Add(row))
+	payload, err = compressed.Bytes()
+	assert.NoError(t, err)
+	r, err = gzip.NewReader(bytes.NewReader(payload))
+	assert.NoError(t, err)
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected[:len(expected)/2], data)
+}
+
+func TestParseIngestionFormat(t *testing.T) {
+	format, err := parseIngestionFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, ingest.CSV, format)
+
+	format, err = parseIngestionFormat("MultiJSON")
+	assert.NoError(t, err)
+	assert.Equal(t, ingest.MultiJSON, format)
+
+	_, err = parseIngestionFormat("parquet")
+	assert.Error(t, err)
+}
+
+func BenchmarkSpanBatch(b *testing.B) {
+	cases := []struct {
+		format   ingest.DataFormat
+		compress bool
+	}{
+		{ingest.CSV, false},
+		{ingest.CSV, true},
+		{ingest.JSON, false},
+		{ingest.JSON, true},
+	}
+
+	const spansPerBatch = 1000
+	rows := make([][]string, spansPerBatch)
+	for i := range rows {
+		row, err := TransformSpanToStringArray(newBenchmarkSpan(uint64(i + 1)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows[i] = row
+	}
+
+	for _, c := range cases {
+		b.Run(fmt.Sprintf("%s/gzip=%t", c.format, c.compress), func(b *testing.B) {
+			batch := newSpanBatch(c.format, c.compress)
+			sent := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch.Reset()
+				for _, row := range rows {
+					if err := batch.Add(row); err != nil {
+						b.Fatal(err)
+					}
+				}
+				payload, err := batch.Bytes()
+				if err != nil {
+					b.Fatal(err)
+				}
+				sent = len(payload)
+				b.SetBytes(int64(batch.Len()))
+			}
+			b.ReportMetric(float64(sent)/spansPerBatch, "sent-bytes/span")
+		})
+	}
+}
+
+func newBenchmarkSpan(id uint64) *model.Span {
+	return &model.Span{
+		TraceID:       model.NewTraceID(id, id),
+		SpanID:        model.NewSpanID(id),
+		OperationName: "GET /api/cart",
+		Flags:         1,
+		StartTime:     time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Duration:      13 * time.Millisecond,
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.String("http.url", "frontend-proxy:8080/api/cart"),
+			model.String("http.user_agent", "python-requests/2.31.0"),
+			model.Int64("http.status_code", 200),
+			model.Bool("app.synthetic_request", true),
+		},
+		Logs: []model.Log{{
+			Timestamp: time.Date(2024, time.March, 13, 7, 33, 1, 5000, time.UTC),
+			Fields:    []model.KeyValue{model.String("event", "cart loaded")},
+		}},
+		Process: &model.Process{
+			ServiceName: "frontend",
+			Tags: []model.KeyValue{
+				model.String("host.name", "334bf69ae415"),
+				model.String("telemetry.sdk.language", "nodejs"),
+			},
+		},
+	}
+}
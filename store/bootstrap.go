@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+)
+
+// DefaultIngestionMappingName is name of ingestion mappings created by Bootstrap, unless writerIngestionMappingRef is set
+const DefaultIngestionMappingName = "JaegerSpans"
+
+// BootstrapOptions are settings of tables created by Bootstrap, which aren't used by the plugin itself
+type BootstrapOptions struct {
+	// RetentionDays is soft delete period of trace tables, policy isn't changed when it's 0
+	RetentionDays int
+	// HotCacheDays is period of data kept in hot cache of trace tables, policy isn't changed when it's 0
+	HotCacheDays int
+	// MaterializedViews enables creation of services and operations views over every trace table
+	MaterializedViews bool
+}
+
+// bootstrapCommand is management command executed in the database
+type bootstrapCommand struct {
+	database string
+	stmt     *kql.Builder
+	// unless is management query, command is skipped when it returns any row
+	unless *kql.Builder
+}
+
+// Bootstrap creates trace tables of kusto config with OTELTraces schema, their retention and caching policies,
+// dependencies table when it's configured. When stagingTableSuffix is set, it also creates staging
+// tables for spans written by the plugin, with ingestion mappings for CSV and JSON and update policies converting
+// staged spans to OTELTraces rows. Every command is idempotent, existing tables get missing columns and current policies,
+// update policy is merged with other update policies of the trace table and is skipped when identical policy exists.
+func Bootstrap(ctx context.Context, pc *config.PluginConfig, kc *config.KustoConfig, options BootstrapOptions, logger hclog.Logger) error {
+	client, err := newKustoClient(kc, logger)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return runBootstrap(ctx, client, pc, kc, options, logger)
+}
+
+func runBootstrap(ctx context.Context, client kustoManagementClient, pc *config.PluginConfig, kc *config.KustoConfig, options BootstrapOptions, logger hclog.Logger) error {
+	for _, command := range bootstrapCommands(pc, kc, options) {
+		if command.unless != nil {
+			exists, err := hasRows(ctx, client, command.database, command.unless)
+			if err != nil {
+				return fmt.Errorf("failed to run %q in database %s: %w", firstLine(command.unless.String()), command.database, err)
+			}
+			if exists {
+				logger.Info("skipping management command", "database", command.database, "command", firstLine(command.stmt.String()))
+				continue
+			}
+		}
+		logger.Info("running management command", "database", command.database, "command", command.stmt.String())
+		iter, err := client.Mgmt(ctx, command.database, command.stmt)
+		if err != nil {
+			return fmt.Errorf("failed to run %q in database %s: %w", firstLine(command.stmt.String()), command.database, err)
+		}
+		iter.Stop()
+	}
+	return nil
+}
+
+// hasRows tells whether management query returns any row
+func hasRows(ctx context.Context, client kustoManagementClient, database string, query *kql.Builder) (bool, error) {
+	iter, err := client.Mgmt(ctx, database, query)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Stop()
+
+	found := false
+	err = iter.DoOnRowOrError(func(_ *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+func bootstrapCommands(pc *config.PluginConfig, kc *config.KustoConfig, options BootstrapOptions) []bootstrapCommand {
+	var commands []bootstrapCommand
+	add := func(database string, stmt *kql.Builder) {
+		commands = append(commands, bootstrapCommand{database: database, stmt: stmt})
+	}
+	addUnless := func(database string, stmt *kql.Builder, unless *kql.Builder) {
+		commands = append(commands, bootstrapCommand{database: database, stmt: stmt, unless: unless})
+	}
+
+	mappingName := pc.WriterIngestionMappingRef
+	if mappingName == "" {
+		mappingName = DefaultIngestionMappingName
+	}
+
+	for _, table := range newTableRouter(kc).Tables() {
+		add(table.Database, kql.New(".create-merge table ").AddTable(table.Table).AddUnsafe(tableSchema(otelTracesColumns)))
+		if options.RetentionDays > 0 {
+			add(table.Database, kql.New(".alter-merge table ").AddTable(table.Table).
+				AddUnsafe(fmt.Sprintf(" policy retention softdelete = %dd recoverability = enabled", options.RetentionDays)))
+		}
+		if options.HotCacheDays > 0 {
+			add(table.Database, kql.New(".alter table ").AddTable(table.Table).
+				AddUnsafe(fmt.Sprintf(" policy caching hot = %dd", options.HotCacheDays)))
+		}
+
+		if kc.StagingTableSuffix != "" {
+			staging := table.Table + kc.StagingTableSuffix
+			function := staging + "ToOTELTraces"
+			add(table.Database, kql.New(".create-merge table ").AddTable(staging).AddUnsafe(tableSchema(stagingColumns())))
+			// staged spans are kept only until update policy converts them
+			add(table.Database, kql.New(".alter-merge table ").AddTable(staging).AddLiteral(" policy retention softdelete = 0d"))
+			add(table.Database, kql.New(".create-or-alter table ").AddTable(staging).
+				AddUnsafe(fmt.Sprintf(" ingestion csv mapping %s %s", kql.QuoteString(mappingName, false), kql.QuoteString(csvMapping(), false))))
+			add(table.Database, kql.New(".create-or-alter table ").AddTable(staging).
+				AddUnsafe(fmt.Sprintf(" ingestion json mapping %s %s", kql.QuoteString(mappingName, false), kql.QuoteString(jsonMapping(), false))))
+			add(table.Database, kql.New(".create-or-alter function with (folder=\"jaeger\", docstring=\"Converts spans written by Jaeger plugin to OTELTraces schema\") ").
+				AddFunction(function).AddLiteral("() { ").AddTable(staging).AddLiteral(convertStagingSpansQuery).AddLiteral(" }"))
+			// other update policies of the trace table are kept, merged policy is added again unless it exists
+			addUnless(table.Database, kql.New(".alter-merge table ").AddTable(table.Table).
+				AddUnsafe(" policy update "+kql.QuoteString(updatePolicy(staging, function), false)),
+				kql.New(".show table ").AddTable(table.Table).AddLiteral(" policy update | mv-expand Policy = todynamic(Policy)").
+					AddLiteral(" | where tobool(Policy.IsEnabled) and tobool(Policy.IsTransactional) and tostring(Policy.Source) == ").AddString(staging).
+					AddLiteral(" and tostring(Policy.Query) == ").AddString(function+"()"))
+		}
+
+		if options.MaterializedViews {
+			add(table.Database, kql.New(".create ifnotexists materialized-view with (backfill=true) ").AddTable(table.Table+"Services").
+				AddLiteral(" on table ").AddTable(table.Table).AddLiteral(" { ").AddTable(table.Table).AddLiteral(servicesViewQuery).AddLiteral(" }"))
+			add(table.Database, kql.New(".create ifnotexists materialized-view with (backfill=true) ").AddTable(table.Table+"Operations").
+				AddLiteral(" on table ").AddTable(table.Table).AddLiteral(" { ").AddTable(table.Table).AddLiteral(operationsViewQuery).AddLiteral(" }"))
+		}
+	}
+
+	if kc.DependenciesTableName != "" {
+		add(kc.Database, kql.New(".create-merge table ").AddTable(kc.DependenciesTableName).AddLiteral(createDependenciesTableCommand))
+	}
+	return commands
+}
+
+// tableSchema formats columns as schema of table command, e.g. (TraceID:string, StartTime:datetime)
+func tableSchema(columns []kustoColumn) string {
+	schema := make([]string, len(columns))
+	for i, column := range columns {
+		schema[i] = fmt.Sprintf("['%s']:%s", column.Name, column.Type)
+	}
+	return " (" + strings.Join(schema, ", ") + ")"
+}
+
+// stagingColumns returns columns of staging table, which are values of TransformSpanToStringArray
+func stagingColumns() []kustoColumn {
+	columns := make([]kustoColumn, len(kustoSpanColumns))
+	for i, column := range kustoSpanColumns {
+		columns[i] = kustoColumn{Name: column.Name, Type: column.Type}
+	}
+	return columns
+}
+
+type ingestionMapping struct {
+	Column     string            `json:"column"`
+	DataType   string            `json:"datatype"`
+	Properties map[string]string `json:"Properties"`
+}
+
+// csvMapping maps values of CSV rows written by the plugin to staging table columns by ordinal
+func csvMapping() string {
+	mapping := make([]ingestionMapping, len(kustoSpanColumns))
+	for i, column := range kustoSpanColumns {
+		mapping[i] = ingestionMapping{Column: column.Name, DataType: column.Type, Properties: map[string]string{"Ordinal": fmt.Sprint(i)}}
+	}
+	data, _ := json.Marshal(mapping)
+	return string(data)
+}
+
+// jsonMapping maps properties of JSON objects written by the plugin to staging table columns by name
+func jsonMapping() string {
+	mapping := make([]ingestionMapping, len(kustoSpanColumns))
+	for i, column := range kustoSpanColumns {
+		mapping[i] = ingestionMapping{Column: column.Name, DataType: column.Type, Properties: map[string]string{"Path": "$." + column.Name}}
+	}
+	data, _ := json.Marshal(mapping)
+	return string(data)
+}
+
+// updatePolicy returns update policy of trace table, which converts spans ingested to staging table with function
+func updatePolicy(staging string, function string) string {
+	data, _ := json.Marshal([]map[string]interface{}{{
+		"IsEnabled":                    true,
+		"Source":                       staging,
+		"Query":                        function + "()",
+		"IsTransactional":              true,
+		"PropagateIngestionProperties": false,
+	}})
+	return string(data)
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBootstrapConfig(t *testing.T) *config.KustoConfig {
+	kc := &config.KustoConfig{
+		Endpoint:           "https://test.kusto.windows.net",
+		Database:           "jaeger",
+		UseManagedIdentity: true,
+		RoutingRules:       []config.RoutingRule{{Tenant: "billing", Database: "billing", TraceTableName: "BillingTraces"}},
+	}
+	require.NoError(t, kc.Validate())
+	return kc
+}
+
+// commandPrefixes returns database and the first words of every command
+func commandPrefixes(commands []bootstrapCommand) []string {
+	var prefixes []string
+	for _, command := range commands {
+		words := strings.Fields(command.stmt.String())
+		prefixes = append(prefixes, command.database+": "+strings.Join(words[:min(4, len(words))], " "))
+	}
+	return prefixes
+}
+
+func TestBootstrapCommands_TraceTables(t *testing.T) {
+	kc := newBootstrapConfig(t)
+	kc.DependenciesTableName = "Dependencies"
+
+	commands := bootstrapCommands(config.NewDefaultPluginConfig(), kc, BootstrapOptions{RetentionDays: 30, HotCacheDays: 7})
+
+	assert.Equal(t, []string{
+		"jaeger: .create-merge table OTELTraces (['TraceID']:string,",
+		"jaeger: .alter-merge table OTELTraces policy",
+		"jaeger: .alter table OTELTraces policy",
+		"billing: .create-merge table BillingTraces (['TraceID']:string,",
+		"billing: .alter-merge table BillingTraces policy",
+		"billing: .alter table BillingTraces policy",
+		"jaeger: .create-merge table Dependencies (StartTime:datetime,",
+	}, commandPrefixes(commands))
+	assert.Contains(t, commands[1].stmt.String(), "policy retention softdelete = 30d recoverability = enabled")
+	assert.Contains(t, commands[2].stmt.String(), "policy caching hot = 7d")
+	for _, column := range otelTracesColumns {
+		assert.Contains(t, commands[0].stmt.String(), "['"+column.Name+"']:"+column.Type)
+	}
+}
+
+func TestBootstrapCommands_Staging(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterIngestionMappingRef = "SpansMapping"
+	kc := newBootstrapConfig(t)
+	kc.RoutingRules = nil
+	kc.StagingTableSuffix = "Jaeger"
+
+	commands := bootstrapCommands(pc, kc, BootstrapOptions{MaterializedViews: true})
+
+	assert.Equal(t, []string{
+		"jaeger: .create-merge table OTELTraces (['TraceID']:string,",
+		"jaeger: .create-merge table OTELTracesJaeger (['TraceID']:string,",
+		"jaeger: .alter-merge table OTELTracesJaeger policy",
+		"jaeger: .create-or-alter table OTELTracesJaeger ingestion",
+		"jaeger: .create-or-alter table OTELTracesJaeger ingestion",
+		`jaeger: .create-or-alter function with (folder="jaeger",`,
+		"jaeger: .alter-merge table OTELTraces policy",
+		"jaeger: .create ifnotexists materialized-view with",
+		"jaeger: .create ifnotexists materialized-view with",
+	}, commandPrefixes(commands))
+	assert.Contains(t, commands[3].stmt.String(), `ingestion csv mapping "SpansMapping"`)
+	assert.Contains(t, commands[3].stmt.String(), `{\"column\":\"Duration\",\"datatype\":\"timespan\",\"Properties\":{\"Ordinal\":\"6\"}}`)
+	assert.Contains(t, commands[4].stmt.String(), `ingestion json mapping "SpansMapping"`)
+	assert.Contains(t, commands[4].stmt.String(), `\"Path\":\"$.ProcessTags\"`)
+	assert.Contains(t, commands[5].stmt.String(), "OTELTracesJaegerToOTELTraces() { OTELTracesJaeger | extend")
+	assert.Contains(t, commands[6].stmt.String(), `\"Source\":\"OTELTracesJaeger\"`)
+	assert.Contains(t, commands[6].stmt.String(), `\"Query\":\"OTELTracesJaegerToOTELTraces()\"`)
+	assert.Equal(t, `.show table OTELTraces policy update | mv-expand Policy = todynamic(Policy)`+
+		` | where tobool(Policy.IsEnabled) and tobool(Policy.IsTransactional) and tostring(Policy.Source) == "OTELTracesJaeger"`+
+		` and tostring(Policy.Query) == "OTELTracesJaegerToOTELTraces()"`, commands[6].unless.String())
+	assert.Nil(t, commands[5].unless)
+	assert.Contains(t, commands[7].stmt.String(), "OTELTracesServices on table OTELTraces { OTELTraces | extend")
+	assert.Contains(t, commands[8].stmt.String(), "OTELTracesOperations on table OTELTraces { OTELTraces | extend")
+}
+
+func TestRunBootstrap(t *testing.T) {
+	kc := newBootstrapConfig(t)
+	client := &fakeKustoClient{}
+	require.NoError(t, runBootstrap(context.Background(), client, config.NewDefaultPluginConfig(), kc, BootstrapOptions{}, hclog.NewNullLogger()))
+	assert.Len(t, client.statements, 2)
+
+	client = &fakeKustoClient{err: errors.New("forbidden")}
+	err := runBootstrap(context.Background(), client, config.NewDefaultPluginConfig(), kc, BootstrapOptions{}, hclog.NewNullLogger())
+	assert.ErrorContains(t, err, `failed to run ".create-merge table OTELTraces`)
+	assert.ErrorContains(t, err, "forbidden")
+	assert.Len(t, client.statements, 1)
+}
+
+func TestRunBootstrap_SkipsExistingUpdatePolicy(t *testing.T) {
+	kc := newBootstrapConfig(t)
+	kc.RoutingRules = nil
+	kc.StagingTableSuffix = "Jaeger"
+	existing, err := kusto.NewMockRows(table.Columns{{Name: "Policy", Type: types.Dynamic}})
+	require.NoError(t, err)
+	require.NoError(t, existing.Row(value.Values{value.Dynamic{Value: []byte(`{"Source":"OTELTracesJaeger"}`), Valid: true}}))
+
+	// create-merge, staging create-merge, retention, mappings, function run before existing policy is found
+	client := &fakeKustoClient{results: []*kusto.MockRows{{}, {}, {}, {}, {}, {}, existing}}
+	require.NoError(t, runBootstrap(context.Background(), client, config.NewDefaultPluginConfig(), kc, BootstrapOptions{}, hclog.NewNullLogger()))
+	require.Len(t, client.statements, 7)
+	assert.True(t, strings.HasPrefix(client.statements[6], ".show table OTELTraces policy update"))
+
+	client = &fakeKustoClient{}
+	require.NoError(t, runBootstrap(context.Background(), client, config.NewDefaultPluginConfig(), kc, BootstrapOptions{}, hclog.NewNullLogger()))
+	require.Len(t, client.statements, 8)
+	assert.True(t, strings.HasPrefix(client.statements[7], ".alter-merge table OTELTraces policy update"))
+}
+
+func TestNewKustoFactory_IngestsToStagingTable(t *testing.T) {
+	kc := newBootstrapConfig(t)
+	kc.StagingTableSuffix = "Jaeger"
+	factory := newKustoFactory(kustoClients{}, config.NewDefaultPluginConfig(), kc)
+	assert.Equal(t, "BillingTracesJaeger", factory.ingestTable(factory.Router.Tables()[1]))
+}
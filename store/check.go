@@ -0,0 +1,178 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+)
+
+// checkedTable is table used by plugin along with name of config field it's set by and its expected schema
+type checkedTable struct {
+	field   string
+	table   kustoTable
+	schema  string
+	columns []kustoColumn
+}
+
+type tableColumn struct {
+	ColumnName string `kusto:"ColumnName"`
+	ColumnType string `kusto:"ColumnType"`
+}
+
+// Check authenticates to kusto and checks that the database and every table the plugin reads or writes in its mode
+// exist and have expected columns: trace tables of OTELTraces schema, staging tables spans are ingested to and
+// dependencies table. Tables are queried with credentials of reader config, or of kusto config when plugin only
+// writes. When plugin writes, it also checks that writer identity can get ingestion resources. All problems found
+// are returned, none means kusto is ready for the plugin.
+func Check(ctx context.Context, pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) []error {
+	sc := kc
+	if pc.Mode.Reads() {
+		sc = kc.ReaderConfig()
+	}
+	client, err := newKustoClient(sc, logger)
+	if err != nil {
+		return []error{err}
+	}
+	defer client.Close()
+
+	problems := checkKusto(ctx, client, sc, checkedTables(pc, kc))
+	if pc.Mode.Writes() {
+		if err := checkWriter(ctx, kc.WriterConfig(), logger); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// checkWriter gets ingestion resources with writer credentials, which fails unless writer identity can ingest data
+func checkWriter(ctx context.Context, wc *config.KustoConfig, logger hclog.Logger) error {
+	client, err := newKustoClient(wc, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create writer client: %w", err)
+	}
+	defer client.Close()
+
+	iter, err := client.Mgmt(ctx, wc.Database, kql.New(".get ingestion resources"))
+	if err != nil {
+		return fmt.Errorf("failed to get ingestion resources at %s, check writer credentials and endpoint: %w", wc.Endpoint, err)
+	}
+	iter.Stop()
+	return nil
+}
+
+func checkKusto(ctx context.Context, client kustoReaderClient, kc *config.KustoConfig, tables []checkedTable) []error {
+	if err := checkConnection(ctx, client, kc.Database); err != nil {
+		return []error{fmt.Errorf("failed to query database %q at %s, check credentials, endpoint and database: %w", kc.Database, kc.Endpoint, err)}
+	}
+
+	var problems []error
+	for _, t := range tables {
+		if err := checkTableColumns(ctx, client, kc.Database, t); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", t.field, err))
+		}
+	}
+	return problems
+}
+
+// checkConnection runs trivial query, which fails when client can't authenticate or database doesn't exist
+func checkConnection(ctx context.Context, client kustoReaderClient, database string) error {
+	iter, err := client.Query(ctx, database, kql.New("print now()"))
+	if err != nil {
+		return err
+	}
+	defer iter.Stop()
+
+	return iter.DoOnRowOrError(func(_ *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		return nil
+	})
+}
+
+// checkedTables returns distinct tables, which are read or written by plugin in its mode
+func checkedTables(pc *config.PluginConfig, kc *config.KustoConfig) []checkedTable {
+	var tables []checkedTable
+	add := func(field string, table kustoTable, schema string, columns []kustoColumn) {
+		for _, t := range tables {
+			if t.table == table {
+				return
+			}
+		}
+		tables = append(tables, checkedTable{field: field, table: table, schema: schema, columns: columns})
+	}
+
+	add("traceTableName", kustoTable{Database: kc.Database, Table: kc.TraceTableName}, "OTELTraces", otelTracesColumns)
+	if pc.Mode.Reads() {
+		for i, t := range kc.ReadTables {
+			add(fmt.Sprintf("readTables[%d]", i), kustoTable{Cluster: t.Cluster, Database: t.Database, Table: t.Table}, "OTELTraces", otelTracesColumns)
+		}
+	}
+	for i, rule := range kc.RoutingRules {
+		add(fmt.Sprintf("routingRules[%d].traceTableName", i), kustoTable{Database: rule.Database, Table: rule.TraceTableName}, "OTELTraces", otelTracesColumns)
+	}
+	if pc.Mode.Writes() && kc.StagingTableSuffix != "" {
+		for _, table := range newTableRouter(kc).Tables() {
+			add("stagingTableSuffix", kustoTable{Database: table.Database, Table: table.Table + kc.StagingTableSuffix}, "staging", stagingColumns())
+		}
+	}
+	// dependencies aggregation creates its table on start, so the table is checked only when it's read as is
+	if kc.DependenciesTableName != "" && !(pc.Mode.Writes() && pc.DependenciesAggregationEnabled) {
+		add("dependenciesTableName", kustoTable{Database: kc.Database, Table: kc.DependenciesTableName}, "dependencies", dependenciesColumns)
+	}
+	return tables
+}
+
+// checkTableColumns returns error listing columns of table schema, which table misses or has of another type
+func checkTableColumns(ctx context.Context, client kustoReaderClient, database string, checked checkedTable) error {
+	t := checked.table
+	source := readSource{Database: database, Tables: []kustoTable{t}}
+	stmt := source.AddTo(kql.New("")).AddLiteral(" | getschema | project ColumnName, ColumnType")
+	name := t.Database + "." + t.Table
+	if t.Cluster != "" {
+		name = t.Cluster + "/" + name
+	}
+
+	iter, err := client.Query(ctx, database, stmt)
+	if err != nil {
+		return fmt.Errorf("table %s is not found or not accessible: %w", name, err)
+	}
+	defer iter.Stop()
+
+	columns := map[string]string{}
+	err = iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		var column tableColumn
+		if err := row.ToStruct(&column); err != nil {
+			return err
+		}
+		columns[column.ColumnName] = column.ColumnType
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read schema of table %s: %w", name, err)
+	}
+
+	var mismatches []string
+	for _, expected := range checked.columns {
+		actual, ok := columns[expected.Name]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("missing %s:%s", expected.Name, expected.Type))
+		case actual != expected.Type:
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s instead of %s", expected.Name, actual, expected.Type))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("table %s doesn't match %s schema: %s", name, checked.schema, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
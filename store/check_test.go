@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSchemaRows builds result of getschema with OTELTraces columns, types of columns can be overridden
+// and empty type drops the column
+func newSchemaRows(t *testing.T, overrides map[string]string) *kusto.MockRows {
+	return newColumnRows(t, otelTracesColumns, overrides)
+}
+
+// newColumnRows builds result of getschema with columns, the same way as newSchemaRows
+func newColumnRows(t *testing.T, columns []kustoColumn, overrides map[string]string) *kusto.MockRows {
+	rows, err := kusto.NewMockRows(table.Columns{
+		{Name: "ColumnName", Type: types.String},
+		{Name: "ColumnType", Type: types.String},
+	})
+	require.NoError(t, err)
+	for _, column := range columns {
+		columnType := column.Type
+		if override, ok := overrides[column.Name]; ok {
+			columnType = override
+		}
+		if columnType == "" {
+			continue
+		}
+		require.NoError(t, rows.Row(value.Values{
+			value.String{Value: column.Name, Valid: true},
+			value.String{Value: columnType, Valid: true},
+		}))
+	}
+	return rows
+}
+
+func newCheckedConfig(t *testing.T) *config.KustoConfig {
+	kc := &config.KustoConfig{
+		Endpoint:           "https://test.kusto.windows.net",
+		Database:           "jaeger",
+		UseManagedIdentity: true,
+		ReadTables: []config.TableReference{
+			{Table: "OTELTraces"},
+			{Cluster: "https://archive.kusto.windows.net", Database: "archive", Table: "OTELTraces"},
+		},
+		RoutingRules: []config.RoutingRule{{Tenant: "billing", TraceTableName: "BillingTraces"}},
+	}
+	require.NoError(t, kc.Validate())
+	return kc
+}
+
+func TestCheckKusto(t *testing.T) {
+	client := &fakeKustoClient{results: []*kusto.MockRows{
+		{},
+		newSchemaRows(t, nil),
+		newSchemaRows(t, map[string]string{"Links": "", "StartTime": "string"}),
+		newSchemaRows(t, nil),
+	}}
+
+	kc := newCheckedConfig(t)
+	problems := checkKusto(context.Background(), client, kc, checkedTables(&config.PluginConfig{Mode: config.ModeRead}, kc))
+
+	require.Len(t, problems, 1)
+	assert.EqualError(t, problems[0], "readTables[1]: table https://archive.kusto.windows.net/archive.OTELTraces doesn't match OTELTraces schema: StartTime is string instead of datetime, missing Links:dynamic")
+	assert.Equal(t, []string{
+		"print now()",
+		"OTELTraces | getschema | project ColumnName, ColumnType",
+		`union cluster("https://archive.kusto.windows.net").database("archive").OTELTraces | getschema | project ColumnName, ColumnType`,
+		"BillingTraces | getschema | project ColumnName, ColumnType",
+	}, client.statements)
+}
+
+func TestCheckKusto_ConnectionFailure(t *testing.T) {
+	client := &fakeKustoClient{err: errors.New("unauthorized")}
+
+	kc := newCheckedConfig(t)
+	problems := checkKusto(context.Background(), client, kc, checkedTables(config.NewDefaultPluginConfig(), kc))
+
+	require.Len(t, problems, 1)
+	assert.ErrorContains(t, problems[0], `failed to query database "jaeger" at https://test.kusto.windows.net`)
+	assert.ErrorContains(t, problems[0], "unauthorized")
+	assert.Len(t, client.statements, 1)
+}
+
+func TestCheckedTables(t *testing.T) {
+	kc := newCheckedConfig(t)
+	kc.StagingTableSuffix = "Staging"
+	kc.DependenciesTableName = "JaegerDependencies"
+	names := func(tables []checkedTable) []string {
+		var names []string
+		for _, t := range tables {
+			names = append(names, t.field+" "+t.table.Database+"."+t.table.Table+" "+t.schema)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{
+		"traceTableName jaeger.OTELTraces OTELTraces",
+		"readTables[1] archive.OTELTraces OTELTraces",
+		"routingRules[0].traceTableName jaeger.BillingTraces OTELTraces",
+		"dependenciesTableName jaeger.JaegerDependencies dependencies",
+	}, names(checkedTables(&config.PluginConfig{Mode: config.ModeRead}, kc)))
+
+	// writer ingests to staging tables of every written table, dependencies table is created by aggregation itself
+	assert.Equal(t, []string{
+		"traceTableName jaeger.OTELTraces OTELTraces",
+		"routingRules[0].traceTableName jaeger.BillingTraces OTELTraces",
+		"stagingTableSuffix jaeger.OTELTracesStaging staging",
+		"stagingTableSuffix jaeger.BillingTracesStaging staging",
+	}, names(checkedTables(&config.PluginConfig{Mode: config.ModeWrite, DependenciesAggregationEnabled: true}, kc)))
+}
+
+func TestCheckKusto_StagingAndDependenciesTables(t *testing.T) {
+	kc := &config.KustoConfig{
+		Endpoint:              "https://test.kusto.windows.net",
+		Database:              "jaeger",
+		UseManagedIdentity:    true,
+		StagingTableSuffix:    "Staging",
+		DependenciesTableName: "JaegerDependencies",
+	}
+	require.NoError(t, kc.Validate())
+	client := &fakeKustoClient{results: []*kusto.MockRows{
+		{},
+		newSchemaRows(t, nil),
+		newColumnRows(t, stagingColumns(), map[string]string{"Duration": "long"}),
+		newColumnRows(t, dependenciesColumns, map[string]string{"ByOperation": ""}),
+	}}
+
+	problems := checkKusto(context.Background(), client, kc, checkedTables(&config.PluginConfig{Mode: config.ModeBoth}, kc))
+
+	require.Len(t, problems, 2)
+	assert.EqualError(t, problems[0], "stagingTableSuffix: table jaeger.OTELTracesStaging doesn't match staging schema: Duration is long instead of timespan")
+	assert.EqualError(t, problems[1], "dependenciesTableName: table jaeger.JaegerDependencies doesn't match dependencies schema: missing ByOperation:bool")
+}
+
+func TestDependenciesColumns(t *testing.T) {
+	assert.Equal(t, createDependenciesTableCommand, strings.ReplaceAll(strings.ReplaceAll(tableSchema(dependenciesColumns), "['", ""), "']", ""))
+}
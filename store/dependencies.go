@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/hashicorp/go-hclog"
+)
+
+// aggregationDelay is time given to spans of a bin to be ingested before the bin is aggregated
+const aggregationDelay = 5 * time.Minute
+
+// aggregationBackfill is how far back bins missing in dependencies table are aggregated, e.g. bins skipped while
+// the plugin wasn't running or aggregation failed
+const aggregationBackfill = 24 * time.Hour
+
+// aggregationBinsPerRun limits the number of bins aggregated at once, so that backfill doesn't overload the cluster
+const aggregationBinsPerRun = 12
+
+type kustoManagementClient interface {
+	Mgmt(ctx context.Context, db string, query kusto.Statement, options ...kusto.QueryOption) (*kusto.RowIterator, error)
+}
+
+// kustoAggregationClient lists aggregated bins with queries and appends bins with management commands
+type kustoAggregationClient interface {
+	kustoReaderClient
+	kustoManagementClient
+}
+
+// dependenciesAggregator periodically appends service dependencies of completed time bins
+// to the dependencies table, so that reader doesn't have to join trace table at query time
+type dependenciesAggregator struct {
+	client      kustoAggregationClient
+	source      readSource
+	table       string
+	bin         time.Duration
+	byOperation bool
+	logger      hclog.Logger
+}
+
+func newDependenciesAggregator(client kustoAggregationClient, source readSource, table string, bin time.Duration, byOperation bool, logger hclog.Logger) *dependenciesAggregator {
+	return &dependenciesAggregator{
+		client:      client,
+		source:      source,
+		table:       table,
+		bin:         bin,
+		byOperation: byOperation,
+		logger:      logger,
+	}
+}
+
+// CreateTable creates dependencies table if it doesn't exist
+func (a *dependenciesAggregator) CreateTable(ctx context.Context) error {
+	iter, err := a.client.Mgmt(ctx, a.source.Database, a.createTableCommand())
+	if err != nil {
+		return err
+	}
+	iter.Stop()
+	return nil
+}
+
+// Run aggregates completed bins until context is cancelled
+func (a *dependenciesAggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		a.aggregate(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// aggregate appends dependencies of completed bins, which weren't aggregated yet, the latest bins go first.
+// Commands are tagged with the bin, so several plugin instances append every bin only once.
+func (a *dependenciesAggregator) aggregate(ctx context.Context, now time.Time) {
+	latest := now.Add(-aggregationDelay).Truncate(a.bin).Add(-a.bin)
+	earliest := latest.Add(-aggregationBackfill)
+
+	aggregated, err := a.aggregatedBins(ctx, earliest, latest.Add(a.bin))
+	if err != nil {
+		a.logger.Error("failed to list aggregated dependencies bins", "error", err)
+		return
+	}
+
+	count := 0
+	for binStart := latest; !binStart.Before(earliest) && count < aggregationBinsPerRun; binStart = binStart.Add(-a.bin) {
+		if aggregated[binStart] {
+			continue
+		}
+		iter, err := a.client.Mgmt(ctx, a.source.Database, a.aggregateCommand(binStart))
+		if err != nil {
+			a.logger.Error("failed to aggregate dependencies", "binStart", binStart, "error", err)
+			return
+		}
+		iter.Stop()
+		count++
+		a.logger.Debug("aggregated dependencies", "binStart", binStart)
+	}
+}
+
+// aggregatedBins returns start times of bins in the range, which are already aggregated
+func (a *dependenciesAggregator) aggregatedBins(ctx context.Context, start time.Time, end time.Time) (map[time.Time]bool, error) {
+	bins, err := queryAggregatedBins(ctx, a.client, a.source.Database, a.table, a.byOperation, start, end)
+	if err != nil {
+		return nil, err
+	}
+	aggregated := make(map[time.Time]bool, len(bins))
+	for _, bin := range bins {
+		aggregated[bin] = true
+	}
+	return aggregated, nil
+}
+
+func (a *dependenciesAggregator) createTableCommand() *kql.Builder {
+	return kql.New(".create-merge table ").AddTable(a.table).AddLiteral(createDependenciesTableCommand)
+}
+
+// aggregateCommand appends edges of the bin. Edges by service and by operation are tagged separately, so that
+// bins are aggregated again when dependenciesByOperation is changed.
+func (a *dependenciesAggregator) aggregateCommand(binStart time.Time) *kql.Builder {
+	edges := "services"
+	if a.byOperation {
+		edges = "operations"
+	}
+	tag := edges + ":" + binStart.UTC().Format(time.RFC3339)
+	stmt := kql.New(".set-or-append ").AddTable(a.table).
+		AddUnsafe(fmt.Sprintf(` with (ingestIfNotExists='["%s"]', tags='["ingest-by:%s"]') <| `, tag, tag)).
+		AddLiteral("let WindowStart = ").AddDateTime(binStart).
+		AddLiteral("; let WindowEnd = ").AddDateTime(binStart.Add(a.bin)).AddLiteral("; ")
+	return addDependencyEdges(stmt, a.source, a.byOperation).AddLiteral(aggregateDependenciesProjection).AddBool(a.byOperation)
+}
+
+// queryAggregatedBins returns sorted start times of bins in the range, which have marker row of aggregation
+func queryAggregatedBins(ctx context.Context, client kustoReaderClient, database string, dependenciesTable string, byOperation bool, start time.Time, end time.Time, options ...kusto.QueryOption) ([]time.Time, error) {
+	type aggregatedBin struct {
+		StartTime value.DateTime `kusto:"StartTime"`
+	}
+
+	kustoStmt := kql.New("").AddTable(dependenciesTable).AddLiteral(getAggregatedBinsQuery)
+	kustoParams := kql.NewParameters().AddDateTime("ParamStartTs", start).AddDateTime("ParamEndTs", end).AddBool("ParamByOperation", byOperation)
+	iter, err := client.Query(ctx, database, kustoStmt, append(options, kusto.QueryParameters(kustoParams))...)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Stop()
+
+	var bins []time.Time
+	err = iter.DoOnRowOrError(
+		func(row *table.Row, e *errors.Error) error {
+			if e != nil {
+				return e
+			}
+			rec := aggregatedBin{}
+			if err := row.ToStruct(&rec); err != nil {
+				return err
+			}
+			if rec.StartTime.Valid {
+				bins = append(bins, rec.StartTime.Value.UTC())
+			}
+			return nil
+		},
+	)
+	sort.Slice(bins, func(i, j int) bool { return bins[i].Before(bins[j]) })
+	return bins, err
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDependenciesTestSource() readSource {
+	return readSource{
+		Database:          "test-db",
+		Tables:            []kustoTable{{Database: "test-db", Table: "OTELTraces"}},
+		DependenciesTable: "TraceDependencies",
+	}
+}
+
+// newAggregatedBinsRows builds rows of aggregated bins query
+func newAggregatedBinsRows(t *testing.T, bins ...time.Time) *kusto.MockRows {
+	rows, err := kusto.NewMockRows(table.Columns{{Name: "StartTime", Type: types.DateTime}})
+	assert.NoError(t, err)
+	for _, bin := range bins {
+		assert.NoError(t, rows.Row(value.Values{value.DateTime{Value: bin, Valid: true}}))
+	}
+	return rows
+}
+
+// hourBins returns hourly bins from start, skipping bins with provided indexes
+func hourBins(start time.Time, count int, skip ...int) []time.Time {
+	var bins []time.Time
+	for i := 0; i < count; i++ {
+		if !slices.Contains(skip, i) {
+			bins = append(bins, start.Add(time.Duration(i)*time.Hour))
+		}
+	}
+	return bins
+}
+
+func TestDependenciesAggregator_Aggregate(t *testing.T) {
+	now := time.Date(2024, time.March, 13, 10, 20, 0, 0, time.UTC)
+	latest := time.Date(2024, time.March, 13, 9, 0, 0, 0, time.UTC)
+	// every bin of backfill window is aggregated except the latest one and one 2 hours before
+	aggregated := hourBins(latest.Add(-aggregationBackfill), 25, 22, 24)
+	client := &fakeKustoClient{results: []*kusto.MockRows{newAggregatedBinsRows(t, aggregated...)}}
+	aggregator := newDependenciesAggregator(client, newDependenciesTestSource(), "TraceDependencies", time.Hour, false, hclog.NewNullLogger())
+
+	aggregator.aggregate(context.Background(), now)
+
+	assert.Len(t, client.statements, 3)
+	assert.Equal(t, "TraceDependencies"+getAggregatedBinsQuery, client.statements[0])
+	assert.Contains(t, client.statements[1], `.set-or-append TraceDependencies with (ingestIfNotExists='["services:2024-03-13T09:00:00Z"]', tags='["ingest-by:services:2024-03-13T09:00:00Z"]') <| `)
+	assert.Contains(t, client.statements[1], "let WindowStart = datetime(2024-03-13T09:00:00Z); let WindowEnd = datetime(2024-03-13T10:00:00Z);")
+	assert.True(t, strings.HasSuffix(client.statements[1], `| union (print Parent="", Child="", CallCount=long(0), Source="", ErrorCount=long(0))
+	| project StartTime=WindowStart, Parent, Child, CallCount, Source, ErrorCount, ByOperation=bool(false)`))
+	assert.Contains(t, client.statements[2], "ingest-by:services:2024-03-13T07:00:00Z")
+}
+
+func TestDependenciesAggregator_TagsEdgesByOperation(t *testing.T) {
+	client := &fakeKustoClient{}
+	aggregator := newDependenciesAggregator(client, newDependenciesTestSource(), "TraceDependencies", time.Hour, true, hclog.NewNullLogger())
+
+	command := aggregator.aggregateCommand(time.Date(2024, time.March, 13, 9, 0, 0, 0, time.UTC)).String()
+	assert.Contains(t, command, `tags='["ingest-by:operations:2024-03-13T09:00:00Z"]'`)
+	assert.True(t, strings.HasSuffix(command, "ByOperation=bool(true)"))
+}
+
+func TestDependenciesAggregator_BackfillsLimitedNumberOfBins(t *testing.T) {
+	client := &fakeKustoClient{}
+	aggregator := newDependenciesAggregator(client, newDependenciesTestSource(), "TraceDependencies", time.Hour, false, hclog.NewNullLogger())
+
+	aggregator.aggregate(context.Background(), time.Date(2024, time.March, 13, 10, 20, 0, 0, time.UTC))
+
+	assert.Len(t, client.statements, 1+aggregationBinsPerRun)
+	assert.Contains(t, client.statements[1], "ingest-by:services:2024-03-13T09:00:00Z")
+	assert.Contains(t, client.statements[aggregationBinsPerRun], "ingest-by:services:2024-03-12T22:00:00Z")
+}
+
+func TestDependenciesAggregator_RunStopsOnCancel(t *testing.T) {
+	client := &fakeKustoClient{}
+	aggregator := newDependenciesAggregator(client, newDependenciesTestSource(), "TraceDependencies", time.Hour, false, hclog.NewNullLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		aggregator.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("aggregator didn't stop after context was cancelled")
+	}
+}
+
+func TestDependenciesAggregator_CreateTable(t *testing.T) {
+	client := &fakeKustoClient{}
+	aggregator := newDependenciesAggregator(client, newDependenciesTestSource(), "TraceDependencies", time.Hour, false, hclog.NewNullLogger())
+
+	assert.NoError(t, aggregator.CreateTable(context.Background()))
+	assert.Equal(t, []string{".create-merge table TraceDependencies (StartTime:datetime, Parent:string, Child:string, CallCount:long, Source:string, ErrorCount:long, ByOperation:bool)"}, client.statements)
+}
+
+// newDependencyLinkRows builds rows of dependencies queries
+func newDependencyLinkRows(t *testing.T, links ...dependencyLink) *kusto.MockRows {
+	rows, err := kusto.NewMockRows(table.Columns{
+		{Name: "Parent", Type: types.String},
+		{Name: "Child", Type: types.String},
+		{Name: "Source", Type: types.String},
+		{Name: "CallCount", Type: types.Long},
+		{Name: "ErrorCount", Type: types.Long},
+	})
+	assert.NoError(t, err)
+	for _, link := range links {
+		assert.NoError(t, rows.Row(value.Values{
+			value.String{Value: link.Parent, Valid: true},
+			value.String{Value: link.Child, Valid: true},
+			value.String{Value: link.Source, Valid: true},
+			link.CallCount,
+			value.Long{Value: 0, Valid: true},
+		}))
+	}
+	return rows
+}
+
+func TestGetDependencies_UsesAggregateWhenCovered(t *testing.T) {
+	endTs := time.Date(2024, time.March, 13, 10, 20, 0, 0, time.UTC)
+	// bins from 11:00 yesterday to 08:00, which are fully within the window
+	firstBin := time.Date(2024, time.March, 12, 11, 0, 0, 0, time.UTC)
+	link := func(calls int64) dependencyLink {
+		return dependencyLink{Parent: "frontend", Child: "cart", Source: "calls", CallCount: value.Long{Value: calls, Valid: true}}
+	}
+
+	cases := []struct {
+		name       string
+		bins       []time.Time
+		results    []*kusto.MockRows
+		statements []string
+		calls      uint64
+	}{
+		{
+			name: "covered",
+			// the latest bin isn't aggregated yet, so it's joined along with the window edges
+			bins:       hourBins(firstBin, 22, 21),
+			results:    []*kusto.MockRows{newDependencyLinkRows(t, link(40)), newDependencyLinkRows(t, link(1)), newDependencyLinkRows(t)},
+			statements: []string{"TraceDependencies | where tolong(StartTime) in (ParamBins)", "| join kind=inner (", "| join kind=inner ("},
+			calls:      41,
+		},
+		{
+			name:       "missing bins backfilled by join",
+			bins:       hourBins(firstBin, 22, 5, 6),
+			results:    []*kusto.MockRows{newDependencyLinkRows(t, link(40)), newDependencyLinkRows(t), newDependencyLinkRows(t, link(1)), newDependencyLinkRows(t, link(1))},
+			statements: []string{"TraceDependencies | where tolong(StartTime) in (ParamBins)", "| join kind=inner (", "| join kind=inner (", "| join kind=inner ("},
+			calls:      42,
+		},
+		{
+			name:       "too many gaps",
+			bins:       hourBins(firstBin, 22, 2, 4, 6, 8),
+			results:    []*kusto.MockRows{newDependencyLinkRows(t, link(41))},
+			statements: []string{"| join kind=inner ("},
+			calls:      41,
+		},
+		{
+			name:       "not aggregated",
+			results:    []*kusto.MockRows{newDependencyLinkRows(t, link(41))},
+			statements: []string{"| join kind=inner ("},
+			calls:      41,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeKustoClient{results: append([]*kusto.MockRows{newAggregatedBinsRows(t, c.bins...)}, c.results...)}
+			reader := &kustoSpanReader{
+				client:          client,
+				router:          &tableRouter{defaultRead: newDependenciesTestSource()},
+				logger:          hclog.NewNullLogger(),
+				dependenciesBin: time.Hour,
+			}
+
+			dependencies, err := reader.GetDependencies(context.Background(), endTs, 24*time.Hour)
+			assert.NoError(t, err)
+			assert.Len(t, dependencies, 1)
+			assert.Equal(t, c.calls, dependencies[0].CallCount)
+			assert.Len(t, client.statements, 1+len(c.statements))
+			assert.Equal(t, "TraceDependencies"+getAggregatedBinsQuery, client.statements[0])
+			for i, statement := range c.statements {
+				assert.Contains(t, client.statements[i+1], statement)
+			}
+		})
+	}
+}
+
+func TestUncoveredRanges(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, time.March, 13, hour, minute, 0, 0, time.UTC)
+	}
+
+	assert.Equal(t, []timeRange{{at(1, 20), at(5, 20)}}, uncoveredRanges(at(1, 20), at(5, 20), nil, time.Hour))
+	assert.Equal(t, []timeRange{{at(1, 20), at(2, 0)}, {at(3, 0), at(4, 0)}, {at(5, 0), at(5, 20)}},
+		uncoveredRanges(at(1, 20), at(5, 20), []time.Time{at(2, 0), at(4, 0)}, time.Hour))
+	assert.Empty(t, uncoveredRanges(at(2, 0), at(4, 0), []time.Time{at(2, 0), at(3, 0)}, time.Hour))
+}
+
+func TestKustoTicks(t *testing.T) {
+	assert.Equal(t, int64(637134336000000000), kustoTicks(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, int64(637134336000000015), kustoTicks(time.Date(2020, time.January, 1, 0, 0, 0, 1500, time.UTC)))
+}
+
+func TestAddDependencyEdges(t *testing.T) {
+	source := newDependenciesTestSource()
+
+	byService := addDependencyEdges(kql.New(""), source, false).String()
+	assert.True(t, strings.HasPrefix(byService, "let ParentWindowStart = WindowStart - 1h;"))
+	assert.Equal(t, 4, strings.Count(byService, "OTELTraces | where StartTime"))
+	assert.Contains(t, byService, `| where SpanKind == "SPAN_KIND_CONSUMER" and array_length(Links) > 0`)
+	assert.Contains(t, byService, `| where SpanKind == "SPAN_KIND_PRODUCER"`)
+	assert.Contains(t, byService, `ErrorCount=countif(SpanStatus == "STATUS_CODE_ERROR")`)
+	assert.True(t, strings.HasSuffix(byService, "by Parent=ParentService, Child=ProcessServiceName, Source"))
+
+	byOperation := addDependencyEdges(kql.New(""), source, true).String()
+	assert.True(t, strings.HasSuffix(byOperation, `by Parent=strcat(ParentService, "::", ParentOperation), Child=strcat(ProcessServiceName, "::", SpanName), Source`))
+}
+
+func TestAddDependencyEdges_JoinsSpansOfSameTrace(t *testing.T) {
+	// span ids are unique within trace only, joining on them alone links spans of unrelated traces
+	edges := addDependencyEdges(kql.New(""), newDependenciesTestSource(), false).String()
+	assert.Contains(t, edges, "| project TraceID, ProcessServiceName, SpanName, SpanStatus, ChildOfSpanId = ParentID")
+	assert.Contains(t, edges, "| project TraceID, ChildOfSpanId=SpanID,")
+	assert.Contains(t, edges, ") on TraceID, ChildOfSpanId")
+	assert.Contains(t, edges, "LinkedTraceId=tostring(Link.TraceID), LinkedSpanId=tostring(Link.SpanID)")
+	assert.Contains(t, edges, "| project LinkedTraceId=TraceID, LinkedSpanId=SpanID,")
+	assert.Contains(t, edges, ") on LinkedTraceId, LinkedSpanId")
+}
+
+func TestToDependencyLinks(t *testing.T) {
+	links := toDependencyLinks([]dependencyLink{
+		{Parent: "frontend", Child: "cart", Source: "calls", CallCount: value.Long{Value: 2, Valid: true}},
+		{Parent: "cart", Child: "billing", Source: "messaging", CallCount: value.Long{Value: 3, Valid: true}},
+		{Parent: "frontend", Child: "cart", Source: "messaging", CallCount: value.Long{Value: 1, Valid: true}},
+	})
+
+	assert.Equal(t, []model.DependencyLink{
+		{Parent: "frontend", Child: "cart", CallCount: 3, Source: model.JaegerDependencyLinkSource},
+		{Parent: "cart", Child: "billing", CallCount: 3, Source: model.JaegerDependencyLinkSource},
+	}, links)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// disabledReader is served instead of span and dependencies readers, when plugin doesn't read in its mode.
+// Every call fails with Unimplemented status, which is returned to Jaeger as is.
+type disabledReader struct {
+	mode config.Mode
+}
+
+func (r disabledReader) err() error {
+	return status.Errorf(codes.Unimplemented, "reading is disabled, plugin runs in %s mode", r.mode)
+}
+
+func (r disabledReader) GetTrace(context.Context, model.TraceID) (*model.Trace, error) {
+	return nil, r.err()
+}
+
+func (r disabledReader) GetServices(context.Context) ([]string, error) {
+	return nil, r.err()
+}
+
+func (r disabledReader) GetOperations(context.Context, spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, r.err()
+}
+
+func (r disabledReader) FindTraces(context.Context, *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, r.err()
+}
+
+func (r disabledReader) FindTraceIDs(context.Context, *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, r.err()
+}
+
+func (r disabledReader) GetDependencies(context.Context, time.Time, time.Duration) ([]model.DependencyLink, error) {
+	return nil, r.err()
+}
+
+// disabledWriter is served instead of span writer, when plugin doesn't write in its mode
+type disabledWriter struct {
+	mode config.Mode
+}
+
+func (w disabledWriter) WriteSpan(context.Context, *model.Span) error {
+	return status.Errorf(codes.Unimplemented, "writing is disabled, plugin runs in %s mode", w.mode)
+}
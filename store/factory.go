@@ -1,31 +1,197 @@
 package store
 
 import (
+	"sync"
+
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/ingest"
 	"github.com/dodopizza/jaeger-kusto/config"
 )
 
+// kustoClients are kusto clients of the store by role, roles with the same cluster and identity share the client
+type kustoClients struct {
+	// main runs management commands
+	main *kusto.Client
+	// reader runs span and dependencies queries
+	reader *kusto.Client
+	// writer ingests spans
+	writer *kusto.Client
+}
+
+// sharedKustoClients returns clients with the same client in every role
+func sharedKustoClients(client *kusto.Client) kustoClients {
+	return kustoClients{main: client, reader: client, writer: client}
+}
+
+// unique returns distinct clients of all roles
+func (c kustoClients) unique() []*kusto.Client {
+	var clients []*kusto.Client
+	for _, client := range []*kusto.Client{c.main, c.reader, c.writer} {
+		if client != nil && !containsClient(clients, client) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// contains returns true when client is used in any role
+func (c kustoClients) contains(client *kusto.Client) bool {
+	return containsClient(c.unique(), client)
+}
+
+func containsClient(clients []*kusto.Client, client *kusto.Client) bool {
+	for _, existing := range clients {
+		if existing == client {
+			return true
+		}
+	}
+	return false
+}
+
 type kustoFactory struct {
 	PluginConfig *config.PluginConfig
 	Database     string
 	Table        string
-	client       *kusto.Client
+	Router       *tableRouter
+	client       *reloadableClient
+	reader       *reloadableClient
+	writer       *reloadableClient
+	// stagingSuffix is appended to names of tables spans are ingested to
+	stagingSuffix string
+	ingestsLock   sync.Mutex
+	ingests       []*reloadableIngest
 }
 
-func newKustoFactory(client *kusto.Client, pc *config.PluginConfig, database string, table string) *kustoFactory {
-	return &kustoFactory{
-		client:       client,
-		Database:     database,
-		Table:        table,
-		PluginConfig: pc,
+func newKustoFactory(clients kustoClients, pc *config.PluginConfig, kc *config.KustoConfig) *kustoFactory {
+	f := &kustoFactory{
+		client:        &reloadableClient{},
+		reader:        &reloadableClient{},
+		writer:        &reloadableClient{},
+		Database:      kc.Database,
+		Table:         kc.TraceTableName,
+		Router:        newTableRouter(kc),
+		PluginConfig:  pc,
+		stagingSuffix: kc.StagingTableSuffix,
 	}
+	f.storeClients(clients, kc.ClientRequestOptions, &clientCalls{})
+	return f
 }
 
 func (f *kustoFactory) Reader() kustoReaderClient {
+	return f.reader
+}
+
+func (f *kustoFactory) Management() kustoManagementClient {
 	return f.client
 }
 
-func (f *kustoFactory) Ingest() (kustoIngest, error) {
-	return ingest.New(f.client, f.Database, f.Table)
+func (f *kustoFactory) Aggregation() kustoAggregationClient {
+	return f.client
+}
+
+func (f *kustoFactory) Ingest(table kustoTable) (kustoIngest, error) {
+	f.ingestsLock.Lock()
+	defer f.ingestsLock.Unlock()
+
+	writer := f.writer.current.Load()
+	in, err := ingest.New(writer.client, table.Database, f.ingestTable(table))
+	if err != nil {
+		return nil, err
+	}
+	reloadable := &reloadableIngest{table: table}
+	reloadable.current.Store(&kustoIngestState{ingest: in, calls: writer.calls})
+	f.ingests = append(f.ingests, reloadable)
+	return reloadable, nil
+}
+
+// ingestTable returns name of the table spans routed to trace table are ingested to
+func (f *kustoFactory) ingestTable(table kustoTable) string {
+	return table.Table + f.stagingSuffix
+}
+
+// Clients returns current kusto clients of every role
+func (f *kustoFactory) Clients() kustoClients {
+	return kustoClients{main: f.client.Client(), reader: f.reader.Client(), writer: f.writer.Client()}
+}
+
+// storeClients makes clients current, calls made on them are counted by calls
+func (f *kustoFactory) storeClients(clients kustoClients, options []kusto.QueryOption, calls *clientCalls) {
+	f.client.current.Store(&kustoClientState{client: clients.main, options: options, calls: calls})
+	f.reader.current.Store(&kustoClientState{client: clients.reader, options: options, calls: calls})
+	f.writer.current.Store(&kustoClientState{client: clients.writer, calls: calls})
+}
+
+// SetClients replaces kusto clients and query options used by every component of the store. When writer client is
+// replaced, ingestions of all tables are rebuilt on top of it. Previous clients, which aren't used anymore, and
+// previous ingestions are closed once calls started on them complete.
+func (f *kustoFactory) SetClients(clients kustoClients, options []kusto.QueryOption) error {
+	f.ingestsLock.Lock()
+	defer f.ingestsLock.Unlock()
+
+	previous := f.Clients()
+	ingests := make([]*ingest.Ingestion, len(f.ingests))
+	for i, reloadable := range f.ingests {
+		if previous.writer == clients.writer {
+			ingests[i] = reloadable.current.Load().ingest
+			continue
+		}
+		in, err := ingest.New(clients.writer, reloadable.table.Database, f.ingestTable(reloadable.table))
+		if err != nil {
+			for _, created := range ingests[:i] {
+				_ = created.Close()
+			}
+			return err
+		}
+		ingests[i] = in
+	}
+
+	previousCalls := f.client.current.Load().calls
+	calls := &clientCalls{}
+	f.storeClients(clients, options, calls)
+	var previousIngests []*ingest.Ingestion
+	for i, reloadable := range f.ingests {
+		if replaced := reloadable.current.Swap(&kustoIngestState{ingest: ingests[i], calls: calls}).ingest; replaced != ingests[i] {
+			previousIngests = append(previousIngests, replaced)
+		}
+	}
+	previousCalls.retire(f.closeUnused(previous, clients, previousIngests))
+	return nil
+}
+
+// closeUnused returns function closing ingestions and previous clients, which aren't used by current ones
+func (f *kustoFactory) closeUnused(previous kustoClients, current kustoClients, ingests []*ingest.Ingestion) func() {
+	var unused []*kusto.Client
+	for _, client := range previous.unique() {
+		if !current.contains(client) {
+			unused = append(unused, client)
+		}
+	}
+	if len(unused) == 0 && len(ingests) == 0 {
+		return nil
+	}
+
+	return func() {
+		for _, in := range ingests {
+			_ = in.Close()
+		}
+		for _, client := range unused {
+			_ = client.Close()
+		}
+	}
+}
+
+// Close closes ingestions of all tables and, when closeClients is set, current kusto clients of every role.
+// It's called once the writer is flushed, so no calls are expected on them anymore.
+func (f *kustoFactory) Close(closeClients bool) {
+	f.ingestsLock.Lock()
+	defer f.ingestsLock.Unlock()
+
+	for _, reloadable := range f.ingests {
+		_ = reloadable.current.Load().ingest.Close()
+	}
+	if closeClients {
+		for _, client := range f.Clients().unique() {
+			_ = client.Close()
+		}
+	}
 }
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKustoClient records statements and replays queued rows for each of them,
+// it implements reader and management clients, so that store can be tested without a cluster
+type fakeKustoClient struct {
+	statements []string
+	results    []*kusto.MockRows
+	// err is returned instead of rows when set
+	err error
+}
+
+func (f *fakeKustoClient) Query(_ context.Context, _ string, query kusto.Statement, _ ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	return f.next(query)
+}
+
+func (f *fakeKustoClient) Mgmt(_ context.Context, _ string, query kusto.Statement, _ ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	return f.next(query)
+}
+
+func (f *fakeKustoClient) next(query kusto.Statement) (*kusto.RowIterator, error) {
+	f.statements = append(f.statements, query.String())
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	rows := &kusto.MockRows{}
+	if len(f.results) > 0 {
+		rows, f.results = f.results[0], f.results[1:]
+	}
+	iter := &kusto.RowIterator{}
+	if err := iter.Mock(rows); err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// fakeIngest collects ingested batches in memory
+type fakeIngest struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]byte
+}
+
+func (f *fakeIngest) FromReader(_ context.Context, reader io.Reader, _ ...ingest.FileOption) (*ingest.Result, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, data)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &ingest.Result{}, nil
+}
+
+// count returns the number of received batches
+func (f *fakeIngest) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.batches)
+}
+
+// newSpanRows builds rows shaped as results of trace queries, which are decoded into kustoSpan
+func newSpanRows(t *testing.T, spans ...kustoSpan) *kusto.MockRows {
+	rows, err := kusto.NewMockRows(table.Columns{
+		{Name: "TraceID", Type: types.String},
+		{Name: "SpanID", Type: types.String},
+		{Name: "SpanName", Type: types.String},
+		{Name: "References", Type: types.Dynamic},
+		{Name: "Flags", Type: types.Int},
+		{Name: "StartTime", Type: types.DateTime},
+		{Name: "Duration", Type: types.Long},
+		{Name: "Tags", Type: types.Dynamic},
+		{Name: "Logs", Type: types.Dynamic},
+		{Name: "Links", Type: types.Dynamic},
+		{Name: "ProcessServiceName", Type: types.String},
+		{Name: "ProcessTags", Type: types.Dynamic},
+		{Name: "ProcessID", Type: types.String},
+		{Name: "SpanKind", Type: types.String},
+		{Name: "SpanStatus", Type: types.String},
+		{Name: "TraceSpans", Type: types.Long},
+	})
+	assert.NoError(t, err)
+
+	for _, span := range spans {
+		links, err := json.Marshal(span.Links)
+		assert.NoError(t, err)
+		assert.NoError(t, rows.Row(value.Values{
+			value.String{Value: span.TraceID, Valid: true},
+			value.String{Value: span.SpanID, Valid: true},
+			value.String{Value: span.SpanName, Valid: true},
+			dynamicOrDefault(span.References, "[]"),
+			value.Int{Value: span.Flags, Valid: true},
+			value.DateTime{Value: span.StartTime, Valid: true},
+			value.Long{Value: span.Duration, Valid: true},
+			dynamicOrDefault(span.Tags, "{}"),
+			dynamicOrDefault(span.Logs, "[]"),
+			value.Dynamic{Value: links, Valid: true},
+			value.String{Value: span.ProcessServiceName, Valid: true},
+			dynamicOrDefault(span.ProcessTags, "{}"),
+			value.String{Value: span.ProcessID, Valid: true},
+			value.String{Value: span.SpanKind, Valid: true},
+			value.String{Value: span.SpanStatus, Valid: true},
+			value.Long{Value: span.TraceSpans, Valid: true},
+		}))
+	}
+	return rows
+}
+
+func dynamicOrDefault(v value.Dynamic, defaultJSON string) value.Dynamic {
+	if v.Valid {
+		return v
+	}
+	return value.Dynamic{Value: []byte(defaultJSON), Valid: true}
+}
+
+func newDynamic(json string) value.Dynamic {
+	return value.Dynamic{Value: []byte(json), Valid: true}
+}
+
+// newTestKustoSpan returns span row of testService, as it's stored in kusto
+func newTestKustoSpan(traceID string, spanID string, parentID string) kustoSpan {
+	span := kustoSpan{
+		TraceID:            traceID,
+		SpanID:             spanID,
+		SpanName:           "testOperation",
+		StartTime:          time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Duration:           1000,
+		ProcessServiceName: "testService",
+		ProcessTags:        newDynamic(`{"service.name":"testService","host.name":"test-host"}`),
+		SpanKind:           "SPAN_KIND_INTERNAL",
+		SpanStatus:         "STATUS_CODE_UNSET",
+	}
+	if parentID != "" {
+		span.References = newDynamic(`[{"refType":"CHILD_OF","traceID":"` + traceID + `","spanID":"` + parentID + `"}]`)
+	}
+	return span
+}
+
+func newTestSpan(id uint64) *model.Span {
+	return &model.Span{
+		TraceID:       model.NewTraceID(0, id),
+		SpanID:        model.NewSpanID(id),
+		OperationName: "testOperation",
+		Process: &model.Process{
+			ServiceName: "testService",
+		},
+		StartTime: time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Duration:  time.Millisecond,
+	}
+}
+
+func newTestRouter() *tableRouter {
+	return newTableRouter(&config.KustoConfig{Database: "test-db", TraceTableName: "OTELTraces"})
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -30,6 +31,8 @@ type kustoSpan struct {
 	ProcessID          string        `kusto:"ProcessID"`
 	SpanKind           string        `kusto:"SpanKind"`
 	SpanStatus         string        `kusto:"SpanStatus"`
+	// TraceSpans is set by searches with row limit only
+	TraceSpans int64 `kusto:"TraceSpans"`
 }
 
 type link struct {
@@ -46,9 +49,36 @@ type event struct {
 	EventAttributes map[string]interface{} `kusto:"EventAttributes"`
 }
 
+// kustoSpanColumn describes a value produced by TransformSpanToStringArray
+type kustoSpanColumn struct {
+	Name string
+	// Type is kusto type of column in staging table, which spans are ingested to
+	Type string
+	// Raw is set for values that are already JSON encoded
+	Raw bool
+}
+
+// kustoSpanColumns lists values of TransformSpanToStringArray in the same order
+var kustoSpanColumns = []kustoSpanColumn{
+	{Name: "TraceID", Type: "string"},
+	{Name: "SpanID", Type: "string"},
+	{Name: "OperationName", Type: "string"},
+	{Name: "References", Type: "dynamic", Raw: true},
+	{Name: "Flags", Type: "int", Raw: true},
+	{Name: "StartTime", Type: "datetime"},
+	{Name: "Duration", Type: "timespan"},
+	{Name: "Tags", Type: "dynamic", Raw: true},
+	{Name: "Logs", Type: "dynamic", Raw: true},
+	{Name: "ProcessServiceName", Type: "string"},
+	{Name: "ProcessTags", Type: "dynamic", Raw: true},
+	{Name: "ProcessID", Type: "string"},
+}
+
 const (
 	// TagDotReplacementCharacter state which character should replace the dot in dynamic column
 	TagDotReplacementCharacter = "_"
+
+	serviceNameAttribute = "service.name"
 )
 
 func transformKustoSpanToModelSpan(kustoSpan *kustoSpan, logger hclog.Logger) (*model.Span, error) {
@@ -62,7 +92,7 @@ func transformKustoSpanToModelSpan(kustoSpan *kustoSpan, logger hclog.Logger) (*
 	}
 
 	var tags map[string]interface{}
-	err = json.Unmarshal(kustoSpan.Tags.Value, &tags)
+	err = unmarshalAttributes(kustoSpan.Tags.Value, &tags)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error in Unmarshal tags %s. TraceId: %s  SpanId: %s ", kustoSpan.Tags.String(), kustoSpan.TraceID, kustoSpan.SpanID), err)
 		return nil, err
@@ -77,28 +107,12 @@ func transformKustoSpanToModelSpan(kustoSpan *kustoSpan, logger hclog.Logger) (*
 	}
 
 	// https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/#status
-	switch kustoSpan.SpanStatus {
-	case "STATUS_CODE_ERROR":
-		tags["otel.status_code"] = "ERROR"
+	if kustoSpan.SpanStatus == "STATUS_CODE_ERROR" {
 		tags["error"] = true
-	case "STATUS_CODE_OK":
-		tags["otel.status_code"] = "OK"
-	default:
-		break
 	}
 
-	// https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/#spankind
-	switch kustoSpan.SpanKind {
-	case "SPAN_KIND_SERVER":
-		tags["span.kind"] = "server"
-	case "SPAN_KIND_CLIENT":
-		tags["span.kind"] = "client"
-	case "SPAN_KIND_CONSUMER":
-		tags["span.kind"] = "consumer"
-	case "SPAN_KIND_PRODUCER":
-		tags["span.kind"] = "producer"
-	default:
-		break
+	if kind := spanKindTag(kustoSpan.SpanKind); kind != "" {
+		tags["span.kind"] = kind
 	}
 
 	logs, err := transformEventsToLogs(kustoSpan, logger)
@@ -117,12 +131,14 @@ func transformKustoSpanToModelSpan(kustoSpan *kustoSpan, logger hclog.Logger) (*
 	// Replace the special chars(including start and end []) for correct JSON parsing
 	replacer := strings.NewReplacer(":[", ":\"[", "],", "]\",", "\\", "")
 	processTag := []byte(replacer.Replace(string(kustoSpan.ProcessTags.Value)))
-	err = json.Unmarshal(processTag, &process.Tag)
+	err = unmarshalAttributes(processTag, &process.Tag)
 	// See if this parsing yielded an error ?
 	if err != nil {
 		logger.Error(fmt.Sprintf("ERROR in Unmarshal processTags %s. TraceId: %s SpanId: %s ", string(kustoSpan.ProcessTags.Value), kustoSpan.TraceID, kustoSpan.SpanID), err)
 		return nil, err
 	}
+	// service name is a resource attribute in OTEL, but jaeger keeps it in process only
+	delete(process.Tag, serviceNameAttribute)
 
 	jsonSpan := &dbmodel.Span{
 		TraceID:         dbmodel.TraceID(kustoSpan.TraceID),
@@ -156,9 +172,48 @@ func transformKustoSpanToModelSpan(kustoSpan *kustoSpan, logger hclog.Logger) (*
 		Logs:          convertedSpan.Logs,
 		Process:       convertedSpan.Process,
 	}
+	// status tag is added after conversion, which would replace underscore in its name with a dot
+	switch kustoSpan.SpanStatus {
+	case "STATUS_CODE_ERROR":
+		span.Tags = append(span.Tags, model.String("otel.status_code", "ERROR"))
+	case "STATUS_CODE_OK":
+		span.Tags = append(span.Tags, model.String("otel.status_code", "OK"))
+	}
 	return span, err
 }
 
+// spanKindTag converts OTEL span kind to value of jaeger span.kind tag, returns empty string for unspecified and internal kinds
+// https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/#spankind
+func spanKindTag(spanKind string) string {
+	switch spanKind {
+	case "SPAN_KIND_SERVER":
+		return "server"
+	case "SPAN_KIND_CLIENT":
+		return "client"
+	case "SPAN_KIND_CONSUMER":
+		return "consumer"
+	case "SPAN_KIND_PRODUCER":
+		return "producer"
+	default:
+		return ""
+	}
+}
+
+// otelSpanKind converts value of jaeger span.kind tag to OTEL span kind stored in SpanKind column
+func otelSpanKind(kind string) string {
+	return "SPAN_KIND_" + strings.ToUpper(kind)
+}
+
+// operationSpanKind converts OTEL span kind to span kind of jaeger operations, which is lower case kind name
+// as trace.SpanKind prints it, e.g. "server" or "unspecified"
+func operationSpanKind(spanKind string) string {
+	kind := strings.ToLower(strings.TrimPrefix(spanKind, "SPAN_KIND_"))
+	if kind == "" {
+		return "unspecified"
+	}
+	return kind
+}
+
 func transformReferencesToLinks(kustoSpan *kustoSpan, logger hclog.Logger) ([]dbmodel.Reference, error) {
 	// There are 2 parts in the links. The first one is the CHILD_OF hierarchy and the second one is the FOLLOWS_FROM hierarchy
 	// Ref : https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/#links
@@ -195,7 +250,7 @@ func transformReferencesToLinks(kustoSpan *kustoSpan, logger hclog.Logger) ([]db
 // Ref : https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/#events
 func transformEventsToLogs(kustoSpan *kustoSpan, logger hclog.Logger) ([]dbmodel.Log, error) {
 	var events []event
-	err := json.Unmarshal(kustoSpan.Logs.Value, &events)
+	err := unmarshalAttributes(kustoSpan.Logs.Value, &events)
 	if err != nil {
 		return nil, err
 	}
@@ -215,18 +270,23 @@ func transformEventsToLogs(kustoSpan *kustoSpan, logger hclog.Logger) ([]dbmodel
 				log.Timestamp = uint64(t.UnixMicro())
 			}
 		}
-		// EventName should be added as log's field.
-		kvs = append(kvs, dbmodel.KeyValue{
-			Key:   "event",
-			Value: evt.EventName,
-			Type:  dbmodel.StringType,
-		})
+		// EventName should be added as log's field, logs written by jaeger without event field have no name
+		if evt.EventName != "" {
+			kvs = append(kvs, dbmodel.KeyValue{
+				Key:   "event",
+				Value: evt.EventName,
+				Type:  dbmodel.StringType,
+			})
+		}
 		for ek, ev := range evt.EventAttributes {
 			kv := dbmodel.KeyValue{
 				Key:   ek,
 				Value: fmt.Sprint(ev),
 				Type:  dbmodel.ValueType(strings.ToLower(reflect.TypeOf(ev).String())),
 			}
+			if number, ok := ev.(json.Number); ok {
+				kv.Type = numberValueType(number)
+			}
 			kvs = append(kvs, kv)
 		}
 		log.Fields = kvs
@@ -235,6 +295,22 @@ func transformEventsToLogs(kustoSpan *kustoSpan, logger hclog.Logger) ([]dbmodel
 	return logs, nil
 }
 
+// unmarshalAttributes decodes dynamic column keeping numbers as json.Number, so integer attributes are converted
+// back to int64 tags instead of float64 ones, the same way jaeger does for elasticsearch
+func unmarshalAttributes(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numberValueType returns type of log field holding the number
+func numberValueType(number json.Number) dbmodel.ValueType {
+	if _, err := number.Int64(); err == nil {
+		return dbmodel.Int64Type
+	}
+	return dbmodel.Float64Type
+}
+
 // escapeProcessTags replaces the double quotes with single quotes in the process tags list
 func escapeProcessTags(processTagsString []byte) {
 	var insideSquareBrackets bool
@@ -257,10 +333,28 @@ func getTagsValues(tags []model.KeyValue) []string {
 	return values
 }
 
+// mergeKeyValues adds tags kept as key values by converter to tags map, replacing dots in their names
+// the same way converter does
+func mergeKeyValues(tags map[string]interface{}, kvs []dbmodel.KeyValue) map[string]interface{} {
+	if len(kvs) > 0 && tags == nil {
+		tags = make(map[string]interface{}, len(kvs))
+	}
+	for _, kv := range kvs {
+		tags[strings.ReplaceAll(kv.Key, ".", TagDotReplacementCharacter)] = kv.Value
+	}
+	return tags
+}
+
 // TransformSpanToStringArray converts span to string ready for Kusto ingestion
 func TransformSpanToStringArray(span *model.Span) ([]string, error) {
 	spanConverter := dbmodel.NewFromDomain(true, getTagsValues(span.Tags), TagDotReplacementCharacter)
 	jsonSpan := spanConverter.FromDomainEmbedProcess(span)
+	// converter keeps binary tags apart from tags map, they are stored as hex strings instead of being dropped
+	jsonSpan.Tag = mergeKeyValues(jsonSpan.Tag, jsonSpan.Tags)
+	jsonSpan.Process.Tag = mergeKeyValues(jsonSpan.Process.Tag, jsonSpan.Process.Tags)
+	for i := range jsonSpan.References {
+		jsonSpan.References[i].TraceID = dbmodel.TraceID(normalizeTraceID(string(jsonSpan.References[i].TraceID)))
+	}
 	references, err := json.Marshal(jsonSpan.References)
 	if err != nil {
 		return nil, err
@@ -279,13 +373,13 @@ func TransformSpanToStringArray(span *model.Span) ([]string, error) {
 	}
 
 	kustoStringSpan := []string{
-		span.TraceID.String(),
+		formatTraceID(span.TraceID),
 		span.SpanID.String(),
 		span.OperationName,
 		string(references),
 		strconv.FormatUint(uint64(span.Flags), 10),
 		span.StartTime.Format(time.RFC3339Nano),
-		value.Timespan{Value: span.Duration, Valid: true}.Marshal(),
+		formatTimespan(span.Duration),
 		string(tags),
 		string(logs),
 		span.Process.ServiceName,
@@ -295,3 +389,23 @@ func TransformSpanToStringArray(span *model.Span) ([]string, error) {
 
 	return kustoStringSpan, err
 }
+
+// formatTimespan formats duration as kusto timespan literal [d.]hh:mm:ss[.fffffff]. value.Timespan of the sdk drops
+// leading zeros of ticks, e.g. writes 5us as 00:00:00.0005, which kusto reads as 500us.
+func formatTimespan(d time.Duration) string {
+	const day = 24 * time.Hour
+	var sb strings.Builder
+	if d < 0 {
+		sb.WriteString("-")
+		d = -d
+	}
+	if days := d / day; days > 0 {
+		fmt.Fprintf(&sb, "%d.", days)
+		d -= days * day
+	}
+	fmt.Fprintf(&sb, "%02d:%02d:%02d", d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+	if ticks := d % time.Second / 100; ticks > 0 {
+		fmt.Fprintf(&sb, ".%07d", ticks)
+	}
+	return sb.String()
+}
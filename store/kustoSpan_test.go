@@ -5,8 +5,13 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTransformReferencesToLinks(t *testing.T) {
@@ -42,3 +47,140 @@ func TestTransformReferencesToLinks(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatTimespan(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{0, "00:00:00"},
+		{5 * time.Microsecond, "00:00:00.0000050"},
+		{time.Millisecond + 50*time.Microsecond, "00:00:00.0010500"},
+		{90*time.Minute + time.Millisecond, "01:30:00.0010000"},
+		{25*time.Hour + time.Second, "1.01:00:01"},
+		{-time.Second, "-00:00:01"},
+	}
+	for _, test := range tests {
+		actual := formatTimespan(test.duration)
+		assert.Equal(t, test.expected, actual)
+
+		parsed := value.Timespan{}
+		assert.NoError(t, parsed.Unmarshal(actual))
+		assert.Equal(t, test.duration, parsed.Value)
+	}
+}
+
+func TestTransformKustoSpanToModelSpan_DecodesNumbers(t *testing.T) {
+	span, err := transformKustoSpanToModelSpan(&kustoSpan{
+		TraceID:     "00000000000000000000000000000001",
+		SpanID:      "0000000000000001",
+		References:  value.Dynamic{Value: []byte(`[]`), Valid: true},
+		StartTime:   time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Tags:        value.Dynamic{Value: []byte(`{"message_id":9007199254740993,"ratio":0.5}`), Valid: true},
+		Logs:        value.Dynamic{Value: []byte(`[{"EventName":"retry","Timestamp":"2024-03-13T07:33:01Z","EventAttributes":{"attempt":2}}]`), Valid: true},
+		ProcessTags: value.Dynamic{Value: []byte(`{}`), Valid: true},
+	}, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	// integers beyond float64 precision keep their value
+	id, _ := findTag(span.Tags, "message.id")
+	assert.Equal(t, model.Int64("message.id", 9007199254740993), id)
+	ratio, _ := findTag(span.Tags, "ratio")
+	assert.Equal(t, model.Float64("ratio", 0.5), ratio)
+	require.Len(t, span.Logs, 1)
+	attempt, _ := findTag(span.Logs[0].Fields, "attempt")
+	assert.Equal(t, model.Int64("attempt", 2), attempt)
+}
+
+func TestTransformKustoSpanToModelSpan_ProcessTags(t *testing.T) {
+	span, err := transformKustoSpanToModelSpan(&kustoSpan{
+		TraceID:            "00000000000000000000000000000001",
+		SpanID:             "0000000000000001",
+		References:         value.Dynamic{Value: []byte(`[]`), Valid: true},
+		StartTime:          time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Tags:               value.Dynamic{Value: []byte(`{}`), Valid: true},
+		Logs:               value.Dynamic{Value: []byte(`[]`), Valid: true},
+		ProcessServiceName: "testService",
+		ProcessTags:        value.Dynamic{Value: []byte(`{"service.name":"testService","host.name":"test-host"}`), Valid: true},
+	}, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	// service name is returned as process service name only, not duplicated in process tags
+	assert.Equal(t, "testService", span.Process.ServiceName)
+	assert.Equal(t, []model.KeyValue{model.String("host.name", "test-host")}, span.Process.Tags)
+}
+
+func TestOperationSpanKind(t *testing.T) {
+	// jaeger query compares operation span kinds with trace.SpanKind names, e.g. ?spanKind=server
+	for spanKind, expected := range map[string]string{
+		"SPAN_KIND_SERVER":      "server",
+		"SPAN_KIND_CLIENT":      "client",
+		"SPAN_KIND_PRODUCER":    "producer",
+		"SPAN_KIND_CONSUMER":    "consumer",
+		"SPAN_KIND_INTERNAL":    "internal",
+		"SPAN_KIND_UNSPECIFIED": "unspecified",
+		"":                      "unspecified",
+	} {
+		assert.Equal(t, expected, operationSpanKind(spanKind), spanKind)
+	}
+}
+
+func TestTransformKustoSpanToModelSpan_StatusTag(t *testing.T) {
+	tests := []struct {
+		status   string
+		expected string
+	}{
+		{"STATUS_CODE_ERROR", "ERROR"},
+		{"STATUS_CODE_OK", "OK"},
+		{"STATUS_CODE_UNSET", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			span, err := transformKustoSpanToModelSpan(&kustoSpan{
+				TraceID:     "00000000000000000000000000000001",
+				SpanID:      "0000000000000001",
+				References:  value.Dynamic{Value: []byte(`[]`), Valid: true},
+				StartTime:   time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+				Tags:        value.Dynamic{Value: []byte(`{"otel_scope_name":"test"}`), Valid: true},
+				Logs:        value.Dynamic{Value: []byte(`[]`), Valid: true},
+				ProcessTags: value.Dynamic{Value: []byte(`{}`), Valid: true},
+				SpanStatus:  test.status,
+			}, hclog.NewNullLogger())
+			require.NoError(t, err)
+
+			// the status tag keeps underscore in its name, unlike attributes converted from kusto columns
+			status, ok := findTag(span.Tags, "otel.status_code")
+			assert.Equal(t, test.expected != "", ok)
+			assert.Equal(t, test.expected, status.VStr)
+			_, converted := findTag(span.Tags, "otel.status.code")
+			assert.False(t, converted)
+			scope, _ := findTag(span.Tags, "otel.scope.name")
+			assert.Equal(t, "test", scope.VStr)
+		})
+	}
+}
+
+func TestTransformSpanToStringArray_Duration(t *testing.T) {
+	span := newTestSpan(1)
+	span.Duration = 5 * time.Microsecond
+
+	row, err := TransformSpanToStringArray(span)
+	assert.NoError(t, err)
+	assert.Equal(t, "Duration", kustoSpanColumns[6].Name)
+	assert.Equal(t, "00:00:00.0000050", row[6])
+}
+
+func TestTransformSpanToStringArray_KeepsBinaryTags(t *testing.T) {
+	span := &model.Span{
+		TraceID:   model.NewTraceID(0, 1),
+		SpanID:    model.NewSpanID(1),
+		StartTime: time.Date(2024, time.March, 13, 7, 33, 1, 0, time.UTC),
+		Tags:      []model.KeyValue{model.Binary("payload.id", []byte{0x30, 0x39}), model.String("http.method", "GET")},
+		Process:   &model.Process{ServiceName: "testService", Tags: []model.KeyValue{model.Binary("host.id", []byte{0xff})}},
+	}
+
+	row, err := TransformSpanToStringArray(span)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"payload_id":"3039","http_method":"GET"}`, row[7])
+	assert.JSONEq(t, `{"host_id":"ff"}`, row[10])
+}
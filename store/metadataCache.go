@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// metadataCache keeps services and operations seen within lookback window in memory.
+// Entries are loaded on first request for a read source and refreshed in background afterwards.
+type metadataCache struct {
+	client      kustoReaderClient
+	readOptions []kusto.QueryOption
+	lookback    time.Duration
+	refresh     time.Duration
+	logger      hclog.Logger
+
+	lock    sync.RWMutex
+	entries map[string]*metadataEntry
+}
+
+type metadataEntry struct {
+	source     readSource
+	services   []string
+	operations []cachedOperation
+}
+
+type cachedOperation struct {
+	ServiceName   string `kusto:"ProcessServiceName"`
+	OperationName string `kusto:"OperationName"`
+	SpanKind      string `kusto:"SpanKind"`
+}
+
+func newMetadataCache(client kustoReaderClient, readOptions []kusto.QueryOption, lookback time.Duration, refresh time.Duration, logger hclog.Logger) *metadataCache {
+	return &metadataCache{
+		client:      client,
+		readOptions: readOptions,
+		lookback:    lookback,
+		refresh:     refresh,
+		logger:      logger,
+		entries:     make(map[string]*metadataEntry),
+	}
+}
+
+// Services returns services of read source sorted by name
+func (c *metadataCache) Services(ctx context.Context, source readSource) ([]string, error) {
+	entry, err := c.entry(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	return entry.services, nil
+}
+
+// Operations returns operations of read source matching query, most frequent first
+func (c *metadataCache) Operations(ctx context.Context, source readSource, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	entry, err := c.entry(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []spanstore.Operation{}
+	seen := make(map[spanstore.Operation]bool)
+	for _, op := range entry.operations {
+		if query.ServiceName != "" && op.ServiceName != query.ServiceName {
+			continue
+		}
+		if query.SpanKind != "" && operationSpanKind(op.SpanKind) != query.SpanKind {
+			continue
+		}
+		operation := spanstore.Operation{Name: op.OperationName, SpanKind: operationSpanKind(op.SpanKind)}
+		if !seen[operation] {
+			seen[operation] = true
+			operations = append(operations, operation)
+		}
+	}
+	return operations, nil
+}
+
+// Run refreshes loaded entries until context is cancelled
+func (c *metadataCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refreshAll(ctx)
+		}
+	}
+}
+
+func (c *metadataCache) refreshAll(ctx context.Context) {
+	c.lock.RLock()
+	sources := make([]readSource, 0, len(c.entries))
+	for _, entry := range c.entries {
+		sources = append(sources, entry.source)
+	}
+	c.lock.RUnlock()
+
+	for _, source := range sources {
+		// keep serving stale entry when refresh fails
+		if _, err := c.load(ctx, source); err != nil {
+			c.logger.Error("failed to refresh services and operations", "database", source.Database, "error", err)
+		}
+	}
+}
+
+func (c *metadataCache) entry(ctx context.Context, source readSource) (*metadataEntry, error) {
+	c.lock.RLock()
+	entry, ok := c.entries[source.key()]
+	c.lock.RUnlock()
+	if ok {
+		return entry, nil
+	}
+	return c.load(ctx, source)
+}
+
+func (c *metadataCache) load(ctx context.Context, source readSource) (*metadataEntry, error) {
+	kustoStmt := source.AddTo(kql.New("")).AddLiteral(getOpsLookBackFilter).AddLiteral(getRecentOperationsQuery)
+	kustoParams := kql.NewParameters().AddTimespan("ParamLookBack", c.lookback)
+	clientRequestId := GetClientId()
+	iter, err := c.client.Query(ctx, source.Database, kustoStmt, append(c.readOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParams))...)
+	if err != nil {
+		c.logger.Error("Failed running services and operations query. ClientRequestId : %s", clientRequestId)
+		return nil, err
+	}
+	defer iter.Stop()
+
+	entry := &metadataEntry{source: source}
+	services := make(map[string]bool)
+	err = iter.DoOnRowOrError(
+		func(row *table.Row, e *errors.Error) error {
+			if e != nil {
+				return e
+			}
+			operation := cachedOperation{}
+			if err := row.ToStruct(&operation); err != nil {
+				return err
+			}
+			entry.operations = append(entry.operations, operation)
+			if !services[operation.ServiceName] {
+				services[operation.ServiceName] = true
+				entry.services = append(entry.services, operation.ServiceName)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(entry.services)
+
+	c.lock.Lock()
+	c.entries[source.key()] = entry
+	c.lock.Unlock()
+	return entry, nil
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOperationsRows(t *testing.T, operations ...cachedOperation) *kusto.MockRows {
+	rows, err := kusto.NewMockRows(table.Columns{
+		{Name: "ProcessServiceName", Type: types.String},
+		{Name: "OperationName", Type: types.String},
+		{Name: "SpanKind", Type: types.String},
+	})
+	assert.NoError(t, err)
+	for _, op := range operations {
+		assert.NoError(t, rows.Row(value.Values{
+			value.String{Value: op.ServiceName, Valid: true},
+			value.String{Value: op.OperationName, Valid: true},
+			value.String{Value: op.SpanKind, Valid: true},
+		}))
+	}
+	return rows
+}
+
+func TestMetadataCache_LoadsOnce(t *testing.T) {
+	client := &fakeKustoClient{results: []*kusto.MockRows{newOperationsRows(t,
+		cachedOperation{"frontend", "GET /", "SPAN_KIND_SERVER"},
+		cachedOperation{"backend", "query", "SPAN_KIND_CLIENT"},
+		cachedOperation{"frontend", "render", "SPAN_KIND_INTERNAL"},
+	)}}
+	cache := newMetadataCache(client, nil, time.Hour, time.Minute, hclog.NewNullLogger())
+	source := newDependenciesTestSource()
+
+	services, err := cache.Services(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backend", "frontend"}, services)
+
+	operations, err := cache.Operations(context.Background(), source, spanstore.OperationQueryParameters{ServiceName: "frontend"})
+	assert.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "GET /", SpanKind: "server"}, {Name: "render", SpanKind: "internal"}}, operations)
+
+	operations, err = cache.Operations(context.Background(), source, spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "server"})
+	assert.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "GET /", SpanKind: "server"}}, operations)
+
+	operations, err = cache.Operations(context.Background(), source, spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "internal"})
+	assert.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "render", SpanKind: "internal"}}, operations)
+
+	assert.Len(t, client.statements, 1)
+	assert.Contains(t, client.statements[0], "| where StartTime > ago(ParamLookBack) | extend ProcessServiceName")
+}
+
+func TestMetadataCache_Refresh(t *testing.T) {
+	client := &fakeKustoClient{results: []*kusto.MockRows{
+		newOperationsRows(t, cachedOperation{"frontend", "GET /", "SPAN_KIND_SERVER"}),
+		newOperationsRows(t, cachedOperation{"frontend", "GET /", "SPAN_KIND_SERVER"}, cachedOperation{"backend", "query", "SPAN_KIND_CLIENT"}),
+	}}
+	cache := newMetadataCache(client, nil, time.Hour, time.Minute, hclog.NewNullLogger())
+	source := newDependenciesTestSource()
+
+	services, err := cache.Services(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"frontend"}, services)
+
+	cache.refreshAll(context.Background())
+
+	services, err = cache.Services(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backend", "frontend"}, services)
+	assert.Len(t, client.statements, 2)
+}
+
+func TestGetOperations_Filters(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    spanstore.OperationQueryParameters
+		expected string
+	}{
+		{"no params", spanstore.OperationQueryParameters{}, "OTELTraces | where StartTime > ago(ParamLookBack) | summarize count()"},
+		{"service", spanstore.OperationQueryParameters{ServiceName: "frontend"}, "| where StartTime > ago(ParamLookBack) | where tostring(ResourceAttributes.['service.name']) == ParamProcessServiceName | summarize count()"},
+		{"service and kind", spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "server"}, "== ParamProcessServiceName | where SpanKind == ParamSpanKind | summarize count()"},
+		{"kind", spanstore.OperationQueryParameters{SpanKind: "server"}, "| where StartTime > ago(ParamLookBack) | where SpanKind == ParamSpanKind | summarize count()"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeKustoClient{}
+			reader := &kustoSpanReader{
+				client:           client,
+				router:           &tableRouter{defaultRead: newDependenciesTestSource()},
+				logger:           hclog.NewNullLogger(),
+				metadataLookback: time.Hour,
+			}
+
+			operations, err := reader.GetOperations(context.Background(), c.query)
+			assert.NoError(t, err)
+			assert.Empty(t, operations)
+			assert.Len(t, client.statements, 1)
+			assert.Contains(t, client.statements[0], c.expected)
+		})
+	}
+}
@@ -2,7 +2,11 @@ package store
 
 import (
 	"errors"
+	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 )
 
@@ -22,45 +26,213 @@ var (
 
 	// ErrStartAndEndTimeNotSet occurs when start time and end time are not set
 	ErrStartAndEndTimeNotSet = errors.New("start and End Time must be set")
+
+	// ErrInvalidTagExpression occurs when tag expression can't be parsed
+	ErrInvalidTagExpression = errors.New("invalid tag expression")
 )
 
 const (
 	queryResultsCacheAge = `set query_results_cache_max_age = time(5m);`
 
-	getTraceQuery = ` | where TraceID == ParamTraceID | extend Duration=datetime_diff('microsecond',EndTime,StartTime) , ProcessServiceName=tostring(ResourceAttributes.['service.name']) | project-rename Tags=TraceAttributes,Logs=Events,ProcessTags=ResourceAttributes| extend References=iff(isempty(ParentID),todynamic("[]"),pack_array(bag_pack("refType","CHILD_OF","traceID",TraceID,"spanID",ParentID)))`
+	getTraceQuery = ` | where TraceID in~ (ParamTraceIDs) | extend Duration=datetime_diff('microsecond',EndTime,StartTime) , ProcessServiceName=tostring(ResourceAttributes.['service.name']) | project-rename Tags=TraceAttributes,Logs=Events,ProcessTags=ResourceAttributes| extend References=iff(isempty(ParentID),todynamic("[]"),pack_array(bag_pack("refType","CHILD_OF","traceID",TraceID,"spanID",ParentID)))`
 
-	getServices      = `getServices`
-	getServicesQuery = `| extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
+	// services and operations are listed from spans started within lookback only, so that queries don't scan the whole retention
+	getServicesQuery = ` | where StartTime > ago(ParamLookBack)
+	| extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
 	| where ProcessServiceName!="" 
 	| summarize by ProcessServiceName 
 	| sort by ProcessServiceName asc`
 
-	getOpsWithNoParams      = `getOpsWithNoParams`
-	getOpsWithNoParamsQuery = `
-	| summarize count() by SpanName , SpanKind
+	getOpsLookBackFilter    = ` | where StartTime > ago(ParamLookBack)`
+	getOpsServiceNameFilter = ` | where tostring(ResourceAttributes.['service.name']) == ParamProcessServiceName`
+	getOpsSpanKindFilter    = ` | where SpanKind == ParamSpanKind`
+	getOpsSummarizeQuery    = ` | summarize count() by SpanName , SpanKind
 	| sort by count_
 	| project OperationName=SpanName,SpanKind`
 
-	getOpsWithParamsQuery = ` | extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
-	| where ProcessServiceName == ParamProcessServiceName
-	| summarize count() by SpanName , SpanKind
+	getRecentOperationsQuery = ` | extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
+	| where ProcessServiceName != ""
+	| summarize count() by ProcessServiceName, SpanName, SpanKind
 	| sort by count_
-	| project OperationName=SpanName,SpanKind`
+	| project ProcessServiceName, OperationName=SpanName, SpanKind`
+
+	// limits are queried with one extra row, which tells whether result was truncated
+	getTraceSpansLimitQuery  = ` | top ParamMaxSpansPerTrace by StartTime asc`
+	getTracesSpansLimitQuery = ` | sort by TraceID asc, StartTime asc | extend SpanIndex=row_number(1, prev(TraceID) != TraceID) | where SpanIndex <= ParamMaxSpansPerTrace | project-away SpanIndex`
+
+	// TraceSpans is the number of spans of the trace before the search limit, which tells whether trace was cut off
+	getTracesSearchLimitQuery = ` | as Spans | join kind=inner (Spans | summarize TraceSpans=count() by TraceID) on TraceID | project-away TraceID1
+	| top ParamMaxSearchRows by StartTime asc`
+
+	// dependency edges are built from spans started within [WindowStart, WindowEnd), which must be declared before.
+	// Spans are joined on trace and span ids, as span ids are unique within trace only.
+	getDependencyCallsQuery = `let ParentWindowStart = WindowStart - 1h;
+	let Calls = `
+	getDependencyCallsJoinQuery = ` | where StartTime >= WindowStart and StartTime < WindowEnd
+	| extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
+	| project TraceID, ProcessServiceName, SpanName, SpanStatus, ChildOfSpanId = ParentID
+	| join kind=inner (`
+	getDependencyCallsParentQuery = ` | where StartTime >= ParentWindowStart and StartTime < WindowEnd
+	| project TraceID, ChildOfSpanId=SpanID, ParentService=tostring(ResourceAttributes.['service.name']), ParentOperation=SpanName) on TraceID, ChildOfSpanId
+	| where ProcessServiceName != ParentService
+	| extend Source="calls";
+	let Messages = `
+	getDependencyMessagesJoinQuery = ` | where StartTime >= WindowStart and StartTime < WindowEnd
+	| where SpanKind == "SPAN_KIND_CONSUMER" and array_length(Links) > 0
+	| extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
+	| mv-expand Link=Links
+	| project ProcessServiceName, SpanName, SpanStatus, LinkedTraceId=tostring(Link.TraceID), LinkedSpanId=tostring(Link.SpanID)
+	| join kind=inner (`
+	getDependencyMessagesProducerQuery = ` | where StartTime >= ParentWindowStart and StartTime < WindowEnd
+	| where SpanKind == "SPAN_KIND_PRODUCER"
+	| project LinkedTraceId=TraceID, LinkedSpanId=SpanID, ParentService=tostring(ResourceAttributes.['service.name']), ParentOperation=SpanName) on LinkedTraceId, LinkedSpanId
+	| extend Source="messaging";
+	union Calls, Messages
+	| summarize CallCount=count(), ErrorCount=countif(SpanStatus == "STATUS_CODE_ERROR") by `
+	dependenciesByService   = `Parent=ParentService, Child=ProcessServiceName, Source`
+	dependenciesByOperation = `Parent=strcat(ParentService, "::", ParentOperation), Child=strcat(ProcessServiceName, "::", SpanName), Source`
+
+	getDependenciesWindow = `let WindowEnd = ParamEndTs; let WindowStart = ParamEndTs - ParamLookBack; `
+
+	// every aggregated bin has a row without calls, so that bins without dependencies are known to be aggregated
+	getAggregatedBinsQuery = ` | where StartTime >= ParamStartTs and StartTime < ParamEndTs and CallCount == 0 and ByOperation == ParamByOperation
+	| distinct StartTime`
+
+	getAggregatedDependenciesQuery = ` | where tolong(StartTime) in (ParamBins) and CallCount > 0 and ByOperation == ParamByOperation
+	| summarize CallCount=sum(CallCount), ErrorCount=sum(ErrorCount) by Parent, Child, Source`
+
+	// ByOperation tells whether nodes of the edge are operations, rows of both kinds can be kept in the same table
+	createDependenciesTableCommand = ` (StartTime:datetime, Parent:string, Child:string, CallCount:long, Source:string, ErrorCount:long, ByOperation:bool)`
 
-	getDependenciesQuery = ` | extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
-	| where StartTime < ParamEndTs and StartTime > (ParamEndTs-ParamLookBack)
-	| project ProcessServiceName, SpanID, ChildOfSpanId = ParentID | join (`
-	getDependenciesJoinQuery = ` | extend ProcessServiceName=tostring(ResourceAttributes.['service.name'])
-	| project ChildOfSpanId=SpanID, ParentService=ProcessServiceName) on ChildOfSpanId | where ProcessServiceName != ParentService
-	| extend Call=pack('Parent', ParentService, 'Child', ProcessServiceName) | summarize CallCount=count() by tostring(Call) | extend Call=parse_json(Call)
-	| evaluate bag_unpack(Call)`
+	aggregateDependenciesProjection = ` | union (print Parent="", Child="", CallCount=long(0), Source="", ErrorCount=long(0))
+	| project StartTime=WindowStart, Parent, Child, CallCount, Source, ErrorCount, ByOperation=`
 
 	getTraceIdBaseQuery = ` | extend Duration=datetime_diff('microsecond',EndTime,StartTime) , ProcessServiceName=tostring(ResourceAttributes.['service.name'])`
 
 	getTracesBase      = `getTracesBase`
 	getTracesBaseQuery = ` | extend ProcessServiceName=tostring(ResourceAttributes.['service.name']),Duration=datetime_diff('microsecond',EndTime,StartTime)`
+
+	// convertStagingSpansQuery converts spans written by the plugin to OTELTraces rows, it's the query of update policy.
+	// The first CHILD_OF reference becomes the parent, other references become links.
+	convertStagingSpansQuery = ` | extend References=iff(isnull(References), dynamic([]), References), Tags=iff(isnull(Tags), dynamic({}), Tags),
+		Logs=iff(isnull(Logs), dynamic([]), Logs), ProcessTags=iff(isnull(ProcessTags), dynamic({}), ProcessTags)
+	| extend HasParent=tostring(References[0].refType) == "CHILD_OF"
+	| extend ParentID=iff(HasParent, tostring(References[0].spanID), ""), Links=iff(HasParent, array_slice(References, 1, -1), References)
+	| extend SpanKind=iff(isempty(tostring(Tags.span_kind)), "SPAN_KIND_UNSPECIFIED", strcat("SPAN_KIND_", toupper(tostring(Tags.span_kind)))),
+		SpanStatus=case(tostring(Tags.error) == "true", "STATUS_CODE_ERROR",
+			isnotempty(tostring(Tags.otel_status_code)), strcat("STATUS_CODE_", toupper(tostring(Tags.otel_status_code))),
+			"STATUS_CODE_UNSET")
+	| mv-apply Log=Logs on (
+		extend Timestamp=unixtime_microseconds_todatetime(tolong(Log.timestamp))
+		| mv-apply Field=Log.fields on (
+			summarize EventName=take_anyif(tostring(Field.value), tostring(Field.key) == "event"),
+				EventAttributes=make_bag_if(bag_pack(tostring(Field.key), iff(tostring(Field.type) == "string", Field.value, todynamic(tostring(Field.value)))), tostring(Field.key) != "event"))
+		| summarize Events=make_list(bag_pack("EventName", EventName, "Timestamp", Timestamp, "EventAttributes", EventAttributes)))
+	| project TraceID, SpanID, ParentID, SpanName=OperationName, SpanStatus, SpanKind, StartTime, EndTime=StartTime + Duration,
+		ResourceAttributes=bag_merge(ProcessTags, bag_pack("service.name", ProcessServiceName)),
+		TraceAttributes=bag_remove_keys(Tags, dynamic(["span_kind", "otel_status_code", "error"])), Events, Links`
+
+	servicesViewQuery = ` | extend ServiceName=tostring(ResourceAttributes.['service.name'])
+	| summarize LastSeen=max(StartTime) by ServiceName`
+
+	operationsViewQuery = ` | extend ServiceName=tostring(ResourceAttributes.['service.name'])
+	| summarize LastSeen=max(StartTime), Spans=count() by ServiceName, SpanName, SpanKind`
 )
 
+// addDependencyEdges appends query summarizing dependency edges of source tables, which are either
+// service to service or operation to operation edges
+func addDependencyEdges(stmt *kql.Builder, source readSource, byOperation bool) *kql.Builder {
+	stmt = source.AddTo(stmt.AddLiteral(getDependencyCallsQuery)).AddLiteral(getDependencyCallsJoinQuery)
+	stmt = source.AddTo(stmt).AddLiteral(getDependencyCallsParentQuery)
+	stmt = source.AddTo(stmt).AddLiteral(getDependencyMessagesJoinQuery)
+	stmt = source.AddTo(stmt).AddLiteral(getDependencyMessagesProducerQuery)
+	if byOperation {
+		return stmt.AddLiteral(dependenciesByOperation)
+	}
+	return stmt.AddLiteral(dependenciesByService)
+}
+
+// maxDependenciesJoinRanges limits the number of time ranges not covered by dependencies aggregate, which are joined
+// from trace table separately. When there are more gaps, the whole window is joined at once.
+const maxDependenciesJoinRanges = 4
+
+// dependencyLink is an edge of dependencies graph as it's returned by dependencies queries, error counts of edges
+// are kept only in dependencies table, as jaeger dependency links have no field for them
+type dependencyLink struct {
+	Parent    string     `kusto:"Parent"`
+	Child     string     `kusto:"Child"`
+	Source    string     `kusto:"Source"`
+	CallCount value.Long `kusto:"CallCount"`
+}
+
+// toDependencyLinks converts edges to jaeger dependency links. Jaeger dependency links have no fields for kind of the
+// edge and error counts, and their source names the system links come from, which clients compare with "jaeger".
+// So calls and messaging edges between the same nodes are merged into a single link and ErrorCount computed by
+// dependencies queries is only kept in dependencies table, see Dependencies section of README.
+func toDependencyLinks(links []dependencyLink) []model.DependencyLink {
+	type edge struct{ parent, child string }
+	index := map[edge]int{}
+	var dependencyLinks []model.DependencyLink
+	for _, link := range links {
+		key := edge{link.Parent, link.Child}
+		if i, ok := index[key]; ok {
+			dependencyLinks[i].CallCount += uint64(link.CallCount.Value)
+			continue
+		}
+		index[key] = len(dependencyLinks)
+		dependencyLinks = append(dependencyLinks, model.DependencyLink{
+			Parent:    link.Parent,
+			Child:     link.Child,
+			CallCount: uint64(link.CallCount.Value),
+			Source:    model.JaegerDependencyLinkSource,
+		})
+	}
+	return dependencyLinks
+}
+
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// uncoveredRanges returns parts of the window, which aren't covered by sorted bins
+func uncoveredRanges(start time.Time, end time.Time, bins []time.Time, bin time.Duration) []timeRange {
+	var ranges []timeRange
+	cursor := start
+	for _, binStart := range bins {
+		if binStart.After(cursor) {
+			ranges = append(ranges, timeRange{start: cursor, end: binStart})
+		}
+		if binEnd := binStart.Add(bin); binEnd.After(cursor) {
+			cursor = binEnd
+		}
+	}
+	if cursor.Before(end) {
+		ranges = append(ranges, timeRange{start: cursor, end: end})
+	}
+	return ranges
+}
+
+// unixEpochTicks is the number of 100ns ticks from 0001-01-01 to unix epoch
+const unixEpochTicks = 621355968000000000
+
+// kustoTicks converts time to the number of 100ns ticks since 0001-01-01, which tolong() returns for datetime
+func kustoTicks(t time.Time) int64 {
+	return unixEpochTicks + t.Unix()*10_000_000 + int64(t.Nanosecond()/100)
+}
+
+// durationMinMicros converts lower duration bound of a query to microseconds, which is precision of Duration column.
+// Bounds are inclusive as in jaeger memory and elasticsearch stores, so it's rounded up, e.g. spans of 5us match
+// 4500ns minimum.
+func durationMinMicros(d time.Duration) int64 {
+	return int64((d + time.Microsecond - 1) / time.Microsecond)
+}
+
+// durationMaxMicros converts upper duration bound of a query to microseconds rounding it down
+func durationMaxMicros(d time.Duration) int64 {
+	return int64(d / time.Microsecond)
+}
+
 // taken from https://github.com/logzio/jaeger-logzio/blob/master/store/queryUtils.go
 func validateQuery(p *spanstore.TraceQueryParameters) error {
 	if p == nil {
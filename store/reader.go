@@ -3,10 +3,8 @@ package store
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
-	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-hclog"
 
@@ -20,29 +18,74 @@ import (
 
 type kustoSpanReader struct {
 	client             kustoReaderClient
-	database           string
-	tableName          string
+	router             *tableRouter
 	logger             hclog.Logger
 	defaultReadOptions []kusto.QueryOption
+	dependenciesBin    time.Duration
+	dependenciesByOp   bool
+	metadataLookback   time.Duration
+	metadataCache      *metadataCache
+	// stopMetadataCache stops background refresh of metadata cache, which is done when metadataCacheDone is closed.
+	// It's nil when cache is disabled.
+	stopMetadataCache context.CancelFunc
+	metadataCacheDone chan struct{}
+	maxSpansPerTrace  int
+	maxSearchRows     int
+	tagExpressions    bool
 }
 
 type kustoReaderClient interface {
 	Query(ctx context.Context, db string, query kusto.Statement, options ...kusto.QueryOption) (*kusto.RowIterator, error)
 }
 
-
 func newKustoSpanReader(factory *kustoFactory, logger hclog.Logger, defaultReadOptions []kusto.QueryOption) (*kustoSpanReader, error) {
-	return &kustoSpanReader{
+	pc := factory.PluginConfig
+	reader := &kustoSpanReader{
 		factory.Reader(),
-		factory.Database,
-		factory.Table,
+		factory.Router,
 		logger,
 		defaultReadOptions,
-	}, nil
+		time.Duration(pc.DependenciesAggregationBinMinutes) * time.Minute,
+		pc.DependenciesByOperation,
+		time.Duration(pc.ReadMetadataLookbackHours) * time.Hour,
+		nil,
+		nil,
+		nil,
+		pc.ReadMaxSpansPerTrace,
+		pc.ReadMaxSearchRows,
+		pc.ReadTagExpressionsEnabled,
+	}
+
+	if pc.ReadMetadataCacheRefreshSeconds > 0 {
+		reader.metadataCache = newMetadataCache(reader.client, defaultReadOptions,
+			reader.metadataLookback,
+			time.Duration(pc.ReadMetadataCacheRefreshSeconds)*time.Second,
+			logger)
+		ctx, cancel := context.WithCancel(context.Background())
+		reader.stopMetadataCache = cancel
+		reader.metadataCacheDone = make(chan struct{})
+		go func() {
+			defer close(reader.metadataCacheDone)
+			reader.metadataCache.Run(ctx)
+		}()
+	}
+
+	return reader, nil
+}
+
+// Close stops background refresh of services and operations cache and waits for it to return
+func (r *kustoSpanReader) Close() {
+	if r.stopMetadataCache != nil {
+		r.stopMetadataCache()
+		<-r.metadataCacheDone
+	}
 }
 
 const defaultNumTraces = 20
 
+// traceTimeMargin widens time range of search, when spans of found traces are read, the same as jaeger does for elasticsearch
+const traceTimeMargin = time.Hour
+
 func GetClientId() string {
 	// get a UUID and concatenante with the service name
 	return fmt.Sprintf("azure-kusto-jaeger-%s", uuid.New().String())
@@ -50,12 +93,20 @@ func GetClientId() string {
 
 // GetTrace finds trace by TraceID
 func (r *kustoSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	kustoStmt := kql.New("").AddTable(r.tableName).AddLiteral(getTraceQuery)
-	kustoStmtParams := kql.NewParameters().AddString("ParamTraceID", traceID.String())
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kustoStmt := source.AddTo(kql.New("")).AddLiteral(getTraceQuery)
+	kustoStmtParams := kql.NewParameters().AddDynamic("ParamTraceIDs", traceIDVariants(traceID))
+	if r.maxSpansPerTrace > 0 {
+		kustoStmt.AddLiteral(getTraceSpansLimitQuery)
+		kustoStmtParams.AddLong("ParamMaxSpansPerTrace", int64(r.maxSpansPerTrace)+1)
+	}
 
 	clientRequestId := GetClientId()
 	// Append a client request id as well to the request
-	iter, err := r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions,
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions,
 		kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoStmtParams))...)
 	if err != nil {
 		r.logger.Error("Failed running GetTrace query. TraceID: %s. ClientRequestId : %s", traceID.String(), clientRequestId)
@@ -83,16 +134,36 @@ func (r *kustoSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (
 			return nil
 		},
 	)
+	if err != nil {
+		return nil, err
+	}
+	if len(spans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+	spans, truncated := truncateSpans(spans, r.maxSpansPerTrace)
+	if truncated {
+		r.logger.Warn("trace exceeds span limit, returning first spans", "traceID", traceID.String(), "limit", r.maxSpansPerTrace)
+		markTruncated(spans, spansPerTraceWarning(r.maxSpansPerTrace))
+	}
 	trace := model.Trace{Spans: spans}
-	return &trace, err
+	return &trace, nil
 }
 
 // GetServices finds all possible services that spanstore contains
 func (r *kustoSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.metadataCache != nil {
+		return r.metadataCache.Services(ctx, source)
+	}
+
 	clientRequestId := GetClientId()
-	kustoStmt := kql.New(queryResultsCacheAge).AddTable(r.tableName).AddLiteral(getServicesQuery)
+	kustoStmt := source.AddTo(kql.New(queryResultsCacheAge)).AddLiteral(getServicesQuery)
+	kustoStmtParams := kql.NewParameters().AddTimespan("ParamLookBack", r.metadataLookback)
 	r.logger.Debug("GetServicesQuery : %s ", kustoStmt.String())
-	iter, err := r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId))...)
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoStmtParams))...)
 
 	if err != nil {
 		r.logger.Error("Failed running GetServices query. ClientRequestId : %s", clientRequestId)
@@ -127,25 +198,33 @@ func (r *kustoSpanReader) GetServices(ctx context.Context) ([]string, error) {
 
 // GetOperations finds all operations by provided Service and SpanKind
 func (r *kustoSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.metadataCache != nil {
+		return r.metadataCache.Operations(ctx, source, query)
+	}
+
 	type Operation struct {
 		OperationName string `kusto:"OperationName"`
 		SpanKind      string `kusto:"SpanKind"`
 	}
-	clientRequestId := GetClientId()
-	var iter *kusto.RowIterator
-	var err error
-	if query.ServiceName == "" && query.SpanKind == "" {
-		kustoStmt := kql.New(queryResultsCacheAge).AddTable(r.tableName).AddLiteral(getOpsWithNoParamsQuery)
-		iter, err = r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId))...)
+	// Jaeger doesn't pass time range with operations query, so operations are listed within configured lookback
+	kustoStmt := source.AddTo(kql.New(queryResultsCacheAge)).AddLiteral(getOpsLookBackFilter)
+	kustoStmtParams := kql.NewParameters().AddTimespan("ParamLookBack", r.metadataLookback)
+	if query.ServiceName != "" {
+		kustoStmt.AddLiteral(getOpsServiceNameFilter)
+		kustoStmtParams.AddString("ParamProcessServiceName", query.ServiceName)
 	}
-
-	if query.ServiceName != "" && query.SpanKind == "" {
-		kustoStmt := kql.New(queryResultsCacheAge).AddTable(r.tableName).AddLiteral(getOpsWithParamsQuery)
-		kustoStmtParams := kql.NewParameters().AddString("ParamProcessServiceName", query.ServiceName)
-
-		iter, err = r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoStmtParams))...)
+	if query.SpanKind != "" {
+		kustoStmt.AddLiteral(getOpsSpanKindFilter)
+		kustoStmtParams.AddString("ParamSpanKind", otelSpanKind(query.SpanKind))
 	}
+	kustoStmt.AddLiteral(getOpsSummarizeQuery)
 
+	clientRequestId := GetClientId()
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoStmtParams))...)
 	if err != nil {
 		r.logger.Error("Failed running GetOperations query. ClientRequestId : %s", clientRequestId)
 		return nil, err
@@ -164,7 +243,7 @@ func (r *kustoSpanReader) GetOperations(ctx context.Context, query spanstore.Ope
 			}
 			operations = append(operations, spanstore.Operation{
 				Name:     operation.OperationName,
-				SpanKind: operation.SpanKind,
+				SpanKind: operationSpanKind(operation.SpanKind),
 			})
 			return nil
 		},
@@ -179,6 +258,10 @@ func (r *kustoSpanReader) GetOperations(ctx context.Context, query spanstore.Ope
 
 // FindTraceIDs finds TraceIDs by provided query
 func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if err := validateQuery(query); err != nil {
 		return nil, err
 	}
@@ -187,7 +270,7 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 		TraceID string `kusto:"TraceID"`
 	}
 
-	kustoStmt := kql.New("").AddTable(r.tableName).AddLiteral(getTraceIdBaseQuery)
+	kustoStmt := source.AddTo(kql.New("")).AddLiteral(getTraceIdBaseQuery)
 	kustoParameters := kql.NewParameters()
 
 	if query.ServiceName != "" {
@@ -201,14 +284,6 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 		kustoParameters = kustoParameters.AddString("ParamOperationName", query.OperationName)
 	}
 
-	if query.Tags != nil {
-		for k, v := range query.Tags {
-			replacedTag := strings.ReplaceAll(k, ".", TagDotReplacementCharacter)
-			tagFilter := fmt.Sprintf(" | where TraceAttributes['%s'] == '%s' or ResourceAttributes['%s'] == '%s'", replacedTag, v, replacedTag, v)
-			kustoStmt = kustoStmt.AddUnsafe(tagFilter)
-		}
-	}
-
 	kustoStmt = kustoStmt.AddLiteral(` | where StartTime > ParamStartTimeMin`)
 	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMin", query.StartTimeMin)
 
@@ -216,13 +291,19 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMax", query.StartTimeMax)
 
 	if query.DurationMin != 0 {
-		kustoStmt = kustoStmt.AddLiteral(` | where Duration > ParamDurationMin`)
-		kustoParameters = kustoParameters.AddLong("ParamDurationMin", query.DurationMin.Microseconds())
+		kustoStmt = kustoStmt.AddLiteral(` | where Duration >= ParamDurationMin`)
+		kustoParameters = kustoParameters.AddLong("ParamDurationMin", durationMinMicros(query.DurationMin))
 	}
 
 	if query.DurationMax != 0 {
-		kustoStmt = kustoStmt.AddLiteral(` | where Duration < ParamDurationMax`)
-		kustoParameters = kustoParameters.AddLong("ParamDurationMax", query.DurationMax.Microseconds())
+		kustoStmt = kustoStmt.AddLiteral(` | where Duration <= ParamDurationMax`)
+		kustoParameters = kustoParameters.AddLong("ParamDurationMax", durationMaxMicros(query.DurationMax))
+	}
+
+	// tag filters go after time range filters, which kusto is able to apply on extents level
+	kustoStmt, kustoParameters, err = addTagFilters(kustoStmt, kustoParameters, query.Tags, r.tagExpressions)
+	if err != nil {
+		return nil, err
 	}
 
 	kustoStmt = kustoStmt.AddLiteral("| summarize by TraceID")
@@ -234,7 +315,7 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 
 	r.logger.Debug("FindTraceIDs query: %s", kustoStmt.String())
 	clientRequestId := GetClientId()
-	iter, err := r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParameters))...)
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParameters))...)
 	if err != nil {
 		return nil, err
 	}
@@ -264,6 +345,10 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 
 // FindTraces finds and returns full traces with spans
 func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if err := validateQuery(query); err != nil {
 		return nil, err
 	}
@@ -272,7 +357,7 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 		query.NumTraces = defaultNumTraces
 	}
 
-	kustoStmt := kql.New("let TraceIDs = (").AddTable(r.tableName).AddLiteral(getTracesBaseQuery)
+	kustoStmt := source.AddTo(kql.New("let TraceIDs = (")).AddLiteral(getTracesBaseQuery)
 	kustoParameters := kql.NewParameters()
 
 	if query.ServiceName != "" {
@@ -285,13 +370,6 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 		kustoParameters = kustoParameters.AddString("ParamOperationName", query.OperationName)
 	}
 
-	if query.Tags != nil {
-		for k, v := range query.Tags {
-			tagFilter := fmt.Sprintf(" | where TraceAttributes['%s'] == '%s' or ResourceAttributes['%s'] == '%s'", k, v, k, v)
-			kustoStmt = kustoStmt.AddUnsafe(tagFilter)
-		}
-	}
-
 	kustoStmt = kustoStmt.AddLiteral(` | where StartTime > ParamStartTimeMin`)
 	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMin", query.StartTimeMin)
 
@@ -299,13 +377,19 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMax", query.StartTimeMax)
 
 	if query.DurationMin != 0 {
-		kustoStmt = kustoStmt.AddLiteral(` | where Duration > ParamDurationMin`)
-		kustoParameters = kustoParameters.AddLong("ParamDurationMin", query.DurationMin.Microseconds())
+		kustoStmt = kustoStmt.AddLiteral(` | where Duration >= ParamDurationMin`)
+		kustoParameters = kustoParameters.AddLong("ParamDurationMin", durationMinMicros(query.DurationMin))
 	}
 
 	if query.DurationMax != 0 {
-		kustoStmt = kustoStmt.AddLiteral(` | where Duration < ParamDurationMax`)
-		kustoParameters = kustoParameters.AddLong("ParamDurationMax", query.DurationMax.Microseconds())
+		kustoStmt = kustoStmt.AddLiteral(` | where Duration <= ParamDurationMax`)
+		kustoParameters = kustoParameters.AddLong("ParamDurationMax", durationMaxMicros(query.DurationMax))
+	}
+
+	// tag filters go after time range filters, which kusto is able to apply on extents level
+	kustoStmt, kustoParameters, err = addTagFilters(kustoStmt, kustoParameters, query.Tags, r.tagExpressions)
+	if err != nil {
+		return nil, err
 	}
 
 	kustoStmt = kustoStmt.AddLiteral(" | summarize by TraceID")
@@ -313,25 +397,38 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 	kustoStmt = kustoStmt.AddLiteral(` | sample ParamNumTraces`)
 	kustoParameters = kustoParameters.AddInt("ParamNumTraces", int32(query.NumTraces))
 
-	kustoStmt = kustoStmt.AddLiteral(`); `).AddTable(r.tableName).AddLiteral(getTracesBaseQuery)
+	kustoStmt = source.AddTo(kustoStmt.AddLiteral(`); `)).AddLiteral(getTracesBaseQuery)
 
-	kustoStmt = kustoStmt.AddLiteral(` | where StartTime > ParamStartTimeMin`)
-	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMin", query.StartTimeMin)
+	// spans of found traces may start before or after the searched range, e.g. when trace is found by its last span
+	kustoStmt = kustoStmt.AddLiteral(` | where StartTime > ParamTraceStartTimeMin`)
+	kustoParameters = kustoParameters.AddDateTime("ParamTraceStartTimeMin", query.StartTimeMin.Add(-traceTimeMargin))
 
-	kustoStmt = kustoStmt.AddLiteral(` | where StartTime < ParamStartTimeMax`)
-	kustoParameters = kustoParameters.AddDateTime("ParamStartTimeMax", query.StartTimeMax)
+	kustoStmt = kustoStmt.AddLiteral(` | where StartTime < ParamTraceStartTimeMax`)
+	kustoParameters = kustoParameters.AddDateTime("ParamTraceStartTimeMax", query.StartTimeMax.Add(traceTimeMargin))
 
 	kustoStmt = kustoStmt.AddLiteral(` | where TraceID in (TraceIDs) | project-rename Tags=TraceAttributes,Logs=Events,ProcessTags=ResourceAttributes|extend References=iff(isempty(ParentID),todynamic("[]"),pack_array(bag_pack("refType","CHILD_OF","traceID",TraceID,"spanID",ParentID)))`)
 
+	if r.maxSpansPerTrace > 0 {
+		kustoStmt = kustoStmt.AddLiteral(getTracesSpansLimitQuery)
+		kustoParameters = kustoParameters.AddLong("ParamMaxSpansPerTrace", int64(r.maxSpansPerTrace)+1)
+	}
+	if r.maxSearchRows > 0 {
+		kustoStmt = kustoStmt.AddLiteral(getTracesSearchLimitQuery)
+		kustoParameters = kustoParameters.AddLong("ParamMaxSearchRows", int64(r.maxSearchRows)+1)
+	}
+
 	r.logger.Debug("FindTraces query: %s", kustoStmt.String())
 	clientRequestId := GetClientId()
-	iter, err := r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParameters))...)
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParameters))...)
 	if err != nil {
 		return nil, err
 	}
 	defer iter.Stop()
 
 	m := make(map[model.TraceID][]*model.Span)
+	traceSpans := make(map[model.TraceID]int64)
+	rows := 0
+	searchTruncated := false
 
 	err = iter.DoOnRowOrError(
 		func(row *table.Row, e *errors.Error) error {
@@ -349,14 +446,34 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 			if err != nil {
 				return err
 			}
+			// rows are ordered by start time when search limit is set, so the extra row is the latest one
+			rows++
+			if r.maxSearchRows > 0 && rows > r.maxSearchRows {
+				searchTruncated = true
+				return nil
+			}
 			m[span.TraceID] = append(m[span.TraceID], span)
+			traceSpans[span.TraceID] = rec.TraceSpans
 			return nil
 		},
 	)
 
+	if searchTruncated {
+		r.logger.Warn("search exceeds row limit, returning first spans", "limit", r.maxSearchRows)
+	}
+
 	var traces []*model.Trace
 
-	for _, spanArray := range m {
+	for traceID, spanArray := range m {
+		// only traces, which have spans after the last returned row, are cut off by search limit
+		searchCutOff := searchTruncated && int64(len(spanArray)) < traceSpans[traceID]
+		spanArray, truncated := truncateSpans(spanArray, r.maxSpansPerTrace)
+		if truncated {
+			markTruncated(spanArray, spansPerTraceWarning(r.maxSpansPerTrace))
+		}
+		if searchCutOff {
+			markTruncated(spanArray, searchRowsWarning(r.maxSearchRows))
+		}
 		trace := model.Trace{Spans: spanArray}
 		//r.logger.Debug("Trace ==> " + trace.String())
 		traces = append(traces, &trace)
@@ -366,37 +483,99 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 
 // GetDependencies returns DependencyLinks of services
 func (r *kustoSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	type kustoDependencyLink struct {
-		Parent    string     `kusto:"Parent"`
-		Child     string     `kusto:"Child"`
-		CallCount value.Long `kusto:"CallCount"`
+	source, err := r.router.ReadSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	startTs := endTs.Add(-lookback)
+	if source.DependenciesTable == "" {
+		return r.joinDependencies(ctx, source, startTs, endTs)
+	}
+
+	bins, err := r.aggregatedBins(ctx, source, startTs, endTs)
+	if err != nil {
+		return nil, err
+	}
+	ranges := uncoveredRanges(startTs, endTs, bins, r.dependenciesBin)
+	if len(bins) == 0 || len(ranges) > maxDependenciesJoinRanges {
+		r.logger.Debug("dependencies aggregate doesn't cover requested window, joining trace table", "endTs", endTs, "lookback", lookback)
+		return r.joinDependencies(ctx, source, startTs, endTs)
 	}
 
-	kustoStmt := kql.New(queryResultsCacheAge).AddTable(r.tableName).AddLiteral(getDependenciesQuery).AddTable(r.tableName).AddLiteral(getDependenciesJoinQuery)
-	kustoParams := kql.NewParameters().AddDateTime("ParamEndTs", endTs).AddTimespan("ParamLookBack", lookback)
+	// aggregated bins are read from dependencies table, the rest of the window is joined from trace table, links of
+	// the same edges are merged
+	ticks := make([]int64, len(bins))
+	for i, bin := range bins {
+		ticks[i] = kustoTicks(bin)
+	}
+	kustoStmt := kql.New(queryResultsCacheAge).AddTable(source.DependenciesTable).AddLiteral(getAggregatedDependenciesQuery)
+	kustoParams := kql.NewParameters().AddDynamic("ParamBins", ticks).AddBool("ParamByOperation", r.dependenciesByOp)
+	links, err := r.queryDependencies(ctx, source, kustoStmt, kustoParams)
+	if err != nil {
+		return nil, err
+	}
+	for _, window := range ranges {
+		joined, err := r.queryJoinedDependencies(ctx, source, window.start, window.end)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, joined...)
+	}
+	return toDependencyLinks(links), nil
+}
+
+// aggregatedBins returns sorted start times of aggregated bins, which are within the window
+func (r *kustoSpanReader) aggregatedBins(ctx context.Context, source readSource, startTs time.Time, endTs time.Time) ([]time.Time, error) {
+	clientRequestId := GetClientId()
+	bins, err := queryAggregatedBins(ctx, r.client, source.Database, source.DependenciesTable, r.dependenciesByOp, startTs, endTs, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId))...)
+	if err != nil {
+		r.logger.Error("Failed running aggregated dependencies bins query. ClientRequestId : %s", clientRequestId)
+		return nil, err
+	}
+
+	var within []time.Time
+	for _, bin := range bins {
+		if !bin.Add(r.dependenciesBin).After(endTs) {
+			within = append(within, bin)
+		}
+	}
+	return within, nil
+}
+
+// joinDependencies computes dependencies of the window joining spans of trace table
+func (r *kustoSpanReader) joinDependencies(ctx context.Context, source readSource, startTs time.Time, endTs time.Time) ([]model.DependencyLink, error) {
+	links, err := r.queryJoinedDependencies(ctx, source, startTs, endTs)
+	if err != nil {
+		return nil, err
+	}
+	return toDependencyLinks(links), nil
+}
+
+func (r *kustoSpanReader) queryJoinedDependencies(ctx context.Context, source readSource, startTs time.Time, endTs time.Time) ([]dependencyLink, error) {
+	kustoStmt := addDependencyEdges(kql.New(queryResultsCacheAge).AddLiteral(getDependenciesWindow), source, r.dependenciesByOp)
+	kustoParams := kql.NewParameters().AddDateTime("ParamEndTs", endTs).AddTimespan("ParamLookBack", endTs.Sub(startTs))
+	return r.queryDependencies(ctx, source, kustoStmt, kustoParams)
+}
+
+func (r *kustoSpanReader) queryDependencies(ctx context.Context, source readSource, kustoStmt *kql.Builder, kustoParams *kql.Parameters) ([]dependencyLink, error) {
 	clientRequestId := GetClientId()
-	iter, err := r.client.Query(ctx, r.database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParams))...)
+	iter, err := r.client.Query(ctx, source.Database, kustoStmt, append(r.defaultReadOptions, kusto.ClientRequestID(clientRequestId), kusto.QueryParameters(kustoParams))...)
 	if err != nil {
 		return nil, err
 	}
 	defer iter.Stop()
 
-	var dependencyLinks []model.DependencyLink
+	var dependencyLinks []dependencyLink
 	err = iter.DoOnRowOrError(
 		func(row *table.Row, e *errors.Error) error {
 			if e != nil {
 				return e
 			}
-			rec := kustoDependencyLink{}
+			rec := dependencyLink{}
 			if err := row.ToStruct(&rec); err != nil {
 				return err
 			}
-
-			dependencyLinks = append(dependencyLinks, model.DependencyLink{
-				Parent:    rec.Parent,
-				Child:     rec.Child,
-				CallCount: uint64(rec.CallCount.Value),
-			})
+			dependencyLinks = append(dependencyLinks, rec)
 			return nil
 		},
 	)
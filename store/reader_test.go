@@ -0,0 +1,264 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceID = "3f6d8f4c5008352055c14804949d1e57"
+
+func newTestReader(client *fakeKustoClient) *kustoSpanReader {
+	return &kustoSpanReader{
+		client:           client,
+		router:           &tableRouter{defaultRead: newDependenciesTestSource()},
+		logger:           hclog.NewNullLogger(),
+		metadataLookback: time.Hour,
+	}
+}
+
+func newTestTraceQuery() *spanstore.TraceQueryParameters {
+	return &spanstore.TraceQueryParameters{
+		ServiceName:  "testService",
+		StartTimeMin: time.Date(2024, time.March, 13, 7, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2024, time.March, 13, 8, 0, 0, 0, time.UTC),
+	}
+}
+
+func findTag(tags []model.KeyValue, key string) (model.KeyValue, bool) {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag, true
+		}
+	}
+	return model.KeyValue{}, false
+}
+
+func TestGetTrace_DecodesSpans(t *testing.T) {
+	root := newTestKustoSpan(testTraceID, "55c14804949d1e57", "")
+	root.SpanKind = "SPAN_KIND_SERVER"
+	root.SpanStatus = "STATUS_CODE_ERROR"
+	root.Tags = newDynamic(`{"http_method":"GET","http.status":500,"retries":[1,2]}`)
+	root.Logs = newDynamic(`[{"EventName":"exception","Timestamp":"2024-03-13T07:33:01.5Z","EventAttributes":{"exception.type":"timeout"}}]`)
+
+	child := newTestKustoSpan(testTraceID, "0000000000000002", "55c14804949d1e57")
+	child.SpanStatus = "STATUS_CODE_OK"
+	child.Links = []link{{TraceID: "0000000000000000000000000000000a", SpanID: "000000000000000b"}}
+	child.Logs = newDynamic(`[{"EventName":"","Timestamp":"2024-03-13T07:33:01.5Z","EventAttributes":{"attempt":3}}]`)
+
+	client := &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t, root, child)}}
+	traceID, _ := model.TraceIDFromString(testTraceID)
+
+	trace, err := newTestReader(client).GetTrace(context.Background(), traceID)
+	assert.NoError(t, err)
+	assert.Len(t, trace.Spans, 2)
+	assert.Contains(t, client.statements[0], "OTELTraces | where TraceID in~ (ParamTraceIDs)")
+
+	span := trace.Spans[0]
+	assert.Equal(t, traceID, span.TraceID)
+	assert.Equal(t, "testOperation", span.OperationName)
+	assert.Equal(t, time.Millisecond, span.Duration)
+	assert.Equal(t, "testService", span.Process.ServiceName)
+	assert.Empty(t, span.References)
+
+	method, ok := findTag(span.Tags, "http.method")
+	assert.True(t, ok)
+	assert.Equal(t, "GET", method.VStr)
+	code, _ := findTag(span.Tags, "http.status")
+	assert.Equal(t, model.Int64Type, code.VType)
+	assert.Equal(t, int64(500), code.Int64())
+	retries, _ := findTag(span.Tags, "retries")
+	assert.Equal(t, "[1 2]", retries.VStr)
+	kind, _ := findTag(span.Tags, "span.kind")
+	assert.Equal(t, "server", kind.VStr)
+	failed, _ := findTag(span.Tags, "error")
+	assert.True(t, failed.Bool())
+	status, _ := findTag(span.Tags, "otel.status_code")
+	assert.Equal(t, "ERROR", status.VStr)
+
+	assert.Len(t, span.Logs, 1)
+	assert.Equal(t, time.Date(2024, time.March, 13, 7, 33, 1, 500000000, time.UTC), span.Logs[0].Timestamp.UTC())
+	event, _ := findTag(span.Logs[0].Fields, "event")
+	assert.Equal(t, "exception", event.VStr)
+
+	host, ok := findTag(span.Process.Tags, "host.name")
+	assert.True(t, ok)
+	assert.Equal(t, "test-host", host.VStr)
+	_, hasServiceName := findTag(span.Process.Tags, "service.name")
+	assert.False(t, hasServiceName)
+
+	child2 := trace.Spans[1]
+	assert.Equal(t, model.NewSpanID(0x55c14804949d1e57), child2.ParentSpanID())
+	assert.Len(t, child2.References, 2)
+	assert.Equal(t, model.FollowsFrom, child2.References[1].RefType)
+	assert.Equal(t, model.NewSpanID(0xb), child2.References[1].SpanID)
+	_, hasKind := findTag(child2.Tags, "span.kind")
+	assert.False(t, hasKind)
+	_, hasError := findTag(child2.Tags, "error")
+	assert.False(t, hasError)
+	status, _ = findTag(child2.Tags, "otel.status_code")
+	assert.Equal(t, "OK", status.VStr)
+
+	// unnamed events have no event field
+	assert.Len(t, child2.Logs, 1)
+	assert.Equal(t, []model.KeyValue{model.Int64("attempt", 3)}, child2.Logs[0].Fields)
+}
+
+func TestGetTrace_Errors(t *testing.T) {
+	traceID, _ := model.TraceIDFromString(testTraceID)
+
+	client := &fakeKustoClient{err: errors.New("unauthorized")}
+	_, err := newTestReader(client).GetTrace(context.Background(), traceID)
+	assert.EqualError(t, err, "unauthorized")
+
+	broken := newTestKustoSpan(testTraceID, "0000000000000001", "")
+	broken.Tags = newDynamic(`not json`)
+	client = &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t, broken)}}
+	_, err = newTestReader(client).GetTrace(context.Background(), traceID)
+	assert.Error(t, err)
+
+	rows := newSpanRows(t)
+	assert.NoError(t, rows.Error(errors.New("partial failure")))
+	client = &fakeKustoClient{results: []*kusto.MockRows{rows}}
+	_, err = newTestReader(client).GetTrace(context.Background(), traceID)
+	assert.Error(t, err)
+}
+
+func TestGetTrace_NotFound(t *testing.T) {
+	traceID, _ := model.TraceIDFromString(testTraceID)
+
+	client := &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t)}}
+	trace, err := newTestReader(client).GetTrace(context.Background(), traceID)
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+	assert.Nil(t, trace)
+}
+
+func TestGetServices(t *testing.T) {
+	rows, err := kusto.NewMockRows(table.Columns{{Name: "ProcessServiceName", Type: types.String}})
+	assert.NoError(t, err)
+	for _, service := range []string{"backend", "frontend"} {
+		assert.NoError(t, rows.Row(value.Values{value.String{Value: service, Valid: true}}))
+	}
+	client := &fakeKustoClient{results: []*kusto.MockRows{rows}}
+
+	services, err := newTestReader(client).GetServices(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backend", "frontend"}, services)
+	assert.Contains(t, client.statements[0], "OTELTraces | where StartTime > ago(ParamLookBack)")
+
+	_, err = newTestReader(&fakeKustoClient{err: errors.New("unauthorized")}).GetServices(context.Background())
+	assert.Error(t, err)
+}
+
+func TestGetOperations(t *testing.T) {
+	rows, err := kusto.NewMockRows(table.Columns{
+		{Name: "OperationName", Type: types.String},
+		{Name: "SpanKind", Type: types.String},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, rows.Row(value.Values{value.String{Value: "GET /", Valid: true}, value.String{Value: "SPAN_KIND_SERVER", Valid: true}}))
+	client := &fakeKustoClient{results: []*kusto.MockRows{rows}}
+
+	operations, err := newTestReader(client).GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "testService"})
+	assert.NoError(t, err)
+	// span kinds are returned as jaeger query compares them with span kind filter, e.g. ?spanKind=server
+	assert.Equal(t, []spanstore.Operation{{Name: "GET /", SpanKind: "server"}}, operations)
+
+	operations, err = newTestReader(&fakeKustoClient{}).GetOperations(context.Background(), spanstore.OperationQueryParameters{})
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+}
+
+func TestFindTraceIDs(t *testing.T) {
+	rows, err := kusto.NewMockRows(table.Columns{{Name: "TraceID", Type: types.String}})
+	assert.NoError(t, err)
+	assert.NoError(t, rows.Row(value.Values{value.String{Value: testTraceID, Valid: true}}))
+	client := &fakeKustoClient{results: []*kusto.MockRows{rows}}
+
+	query := newTestTraceQuery()
+	query.OperationName = "testOperation"
+	query.DurationMin = time.Millisecond
+	query.NumTraces = 10
+	traceIDs, err := newTestReader(client).FindTraceIDs(context.Background(), query)
+	assert.NoError(t, err)
+
+	expected, _ := model.TraceIDFromString(testTraceID)
+	assert.Equal(t, []model.TraceID{expected}, traceIDs)
+	assert.Contains(t, client.statements[0], "| where SpanName == ParamOperationName")
+	assert.Contains(t, client.statements[0], "| where Duration >= ParamDurationMin")
+	assert.Contains(t, client.statements[0], "| sample ParamNumTraces")
+
+	_, err = newTestReader(client).FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{})
+	assert.ErrorIs(t, err, ErrStartAndEndTimeNotSet)
+}
+
+func TestDurationBoundsMicros(t *testing.T) {
+	// bounds stay inclusive when they are converted to precision of Duration column
+	assert.Equal(t, int64(5), durationMinMicros(4500*time.Nanosecond))
+	assert.Equal(t, int64(5), durationMinMicros(5*time.Microsecond))
+	assert.Equal(t, int64(5), durationMaxMicros(5500*time.Nanosecond))
+	assert.Equal(t, int64(5), durationMaxMicros(5*time.Microsecond))
+}
+
+func TestFindTraces_GroupsSpansByTrace(t *testing.T) {
+	other := "00000000000000000000000000000002"
+	client := &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t,
+		newTestKustoSpan(testTraceID, "0000000000000001", ""),
+		newTestKustoSpan(other, "0000000000000003", ""),
+		newTestKustoSpan(testTraceID, "0000000000000002", "0000000000000001"),
+	)}}
+
+	traces, err := newTestReader(client).FindTraces(context.Background(), newTestTraceQuery())
+	assert.NoError(t, err)
+	assert.Len(t, traces, 2)
+
+	spansByTrace := map[string]int{}
+	for _, trace := range traces {
+		spansByTrace[trace.Spans[0].TraceID.String()] = len(trace.Spans)
+	}
+	assert.Equal(t, map[string]int{testTraceID: 2, "0000000000000002": 1}, spansByTrace)
+	assert.Contains(t, client.statements[0], "let TraceIDs = (OTELTraces")
+	// spans of found traces are read from wider range than searched one
+	assert.Contains(t, client.statements[0], "| where StartTime > ParamTraceStartTimeMin")
+}
+
+func TestFindTraces_LimitsRows(t *testing.T) {
+	other := "00000000000000000000000000000002"
+	span := func(traceID string, spanID string, parentID string, traceSpans int64) kustoSpan {
+		s := newTestKustoSpan(traceID, spanID, parentID)
+		s.TraceSpans = traceSpans
+		return s
+	}
+	// the last row is the extra one, which tells that the limit is exceeded
+	client := &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t,
+		span(testTraceID, "0000000000000001", "", 2),
+		span(testTraceID, "0000000000000002", "0000000000000001", 2),
+		span(other, "0000000000000003", "", 2),
+		span(other, "0000000000000004", "0000000000000003", 2),
+	)}}
+	reader := newTestReader(client)
+	reader.maxSearchRows = 3
+
+	traces, err := reader.FindTraces(context.Background(), newTestTraceQuery())
+	assert.NoError(t, err)
+	assert.Len(t, traces, 2)
+	warnings := map[string][]string{}
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			warnings[trace.Spans[0].TraceID.String()] = append(warnings[trace.Spans[0].TraceID.String()], span.Warnings...)
+		}
+	}
+	// only the trace, which lost its span, is marked
+	assert.Equal(t, map[string][]string{testTraceID: nil, "0000000000000002": {searchRowsWarning(3)}}, warnings)
+	assert.Contains(t, client.statements[0], getTracesSearchLimitQuery)
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
+)
+
+// clientCalls counts calls in flight on kusto clients and ingestions stored together, so that the ones replaced
+// on config reload are closed as soon as calls started on them complete
+type clientCalls struct {
+	lock    sync.Mutex
+	count   int
+	retired bool
+	closed  bool
+	close   func()
+}
+
+// start registers a call, it returns false when clients are closed already and current ones must be used instead
+func (c *clientCalls) start() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// done completes a call, the last call completed on retired clients closes them
+func (c *clientCalls) done() {
+	c.lock.Lock()
+	c.count--
+	closeClients := c.closeIfIdle()
+	c.lock.Unlock()
+	closeClients()
+}
+
+// retire marks clients replaced, close runs once there are no calls in flight on them, it may be nil
+func (c *clientCalls) retire(close func()) {
+	c.lock.Lock()
+	c.retired, c.close = true, close
+	closeClients := c.closeIfIdle()
+	c.lock.Unlock()
+	closeClients()
+}
+
+// closeIfIdle returns function closing retired clients without calls in flight, it must be called with lock held
+func (c *clientCalls) closeIfIdle() func() {
+	if !c.retired || c.closed || c.count > 0 {
+		return func() {}
+	}
+	c.closed = true
+	if c.close == nil {
+		return func() {}
+	}
+	return c.close
+}
+
+// kustoClientState is kusto client along with query options applied to every query
+type kustoClientState struct {
+	client  *kusto.Client
+	options []kusto.QueryOption
+	calls   *clientCalls
+}
+
+// reloadableClient forwards calls to the current kusto client, which is replaced atomically on config reload.
+// Calls in flight keep using the client they were started with.
+type reloadableClient struct {
+	current atomic.Pointer[kustoClientState]
+}
+
+// Client returns current kusto client
+func (c *reloadableClient) Client() *kusto.Client {
+	return c.current.Load().client
+}
+
+// start returns current client state with a call registered on it
+func (c *reloadableClient) start() *kustoClientState {
+	for {
+		state := c.current.Load()
+		if state.calls.start() {
+			return state
+		}
+	}
+}
+
+// Query runs query on the current client. Closing the client only drops its idle connections, so the call completes
+// when the query returns and rows are streamed independently of reloads.
+func (c *reloadableClient) Query(ctx context.Context, db string, query kusto.Statement, options ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	state := c.start()
+	defer state.calls.done()
+	return state.client.Query(ctx, db, query, append(append([]kusto.QueryOption{}, state.options...), options...)...)
+}
+
+func (c *reloadableClient) Mgmt(ctx context.Context, db string, query kusto.Statement, options ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	state := c.start()
+	defer state.calls.done()
+	return state.client.Mgmt(ctx, db, query, options...)
+}
+
+// kustoIngestState is ingestion of a table created by the client of calls
+type kustoIngestState struct {
+	ingest *ingest.Ingestion
+	calls  *clientCalls
+}
+
+// reloadableIngest forwards batches to the current ingestion of the table, which is rebuilt when kusto client changes
+type reloadableIngest struct {
+	table   kustoTable
+	current atomic.Pointer[kustoIngestState]
+}
+
+func (i *reloadableIngest) FromReader(ctx context.Context, reader io.Reader, options ...ingest.FileOption) (*ingest.Result, error) {
+	for {
+		state := i.current.Load()
+		if state.calls.start() {
+			defer state.calls.done()
+			return state.ingest.FromReader(ctx, reader, options...)
+		}
+	}
+}
+
+// Reload applies query options, batch settings and credentials of changed configs.
+// Kusto clients are rebuilt when credentials or endpoint of their role change, unless store was created with client
+// provided by host.
+// Other settings, e.g. tables or workers count, require restart and their changes are logged and ignored.
+func (store *store) Reload(pc *config.PluginConfig, kc *config.KustoConfig) error {
+	store.reloadLock.Lock()
+	defer store.reloadLock.Unlock()
+
+	// custom token credential is set by host and can't come from config files, reloaded config keeps it
+	if kc.TokenCredential == nil && store.kustoConfig.TokenCredential != nil {
+		withCredential := *kc
+		withCredential.TokenCredential = store.kustoConfig.TokenCredential
+		kc = &withCredential
+	}
+
+	clients := store.factory.Clients()
+	if store.newClient != nil {
+		rebuilt, err := buildKustoClients(store.mode, kc, store.kustoConfig, clients, store.newClient, store.logger)
+		if err != nil {
+			return err
+		}
+		clients = rebuilt
+	}
+
+	if err := store.factory.SetClients(clients, kc.ClientRequestOptions); err != nil {
+		current := store.factory.Clients()
+		for _, client := range clients.unique() {
+			if !current.contains(client) {
+				_ = client.Close()
+			}
+		}
+		return err
+	}
+
+	if store.spanWriter != nil {
+		store.spanWriter.SetBatchSettings(pc)
+	}
+
+	if !reflect.DeepEqual(restartSettings(store.pluginConfig), restartSettings(pc)) ||
+		!reflect.DeepEqual(kustoRestartSettings(store.kustoConfig), kustoRestartSettings(kc)) {
+		store.logger.Warn("configuration changes other than log level, query options, batch settings and credentials require restart")
+	}
+	store.pluginConfig, store.kustoConfig = pc, kc
+	return nil
+}
+
+// credentialsChanged returns true when kusto client must be rebuilt to apply kusto config
+func credentialsChanged(previous *config.KustoConfig, kc *config.KustoConfig) bool {
+	return previous.EngineEndpoint() != kc.EngineEndpoint() ||
+		previous.ClientID != kc.ClientID ||
+		previous.ClientSecret != kc.ClientSecret ||
+		previous.TenantID != kc.TenantID ||
+		previous.UseManagedIdentity != kc.UseManagedIdentity ||
+		previous.UseWorkloadIdentity != kc.UseWorkloadIdentity ||
+		previous.ClientCertificatePath != kc.ClientCertificatePath ||
+		previous.ClientCertificatePassword != kc.ClientCertificatePassword ||
+		previous.SendCertificateChain != kc.SendCertificateChain ||
+		previous.UseAzureCLI != kc.UseAzureCLI ||
+		previous.FederatedTokenFilePath != kc.FederatedTokenFilePath ||
+		previous.TokenCredential != kc.TokenCredential
+}
+
+// restartSettings returns copy of plugin config without settings applied on reload
+func restartSettings(pc *config.PluginConfig) config.PluginConfig {
+	settings := *pc
+	settings.LogLevel = ""
+	settings.ReadNoTruncation = false
+	settings.ReadNoTimeout = false
+	settings.WriterBatchMaxBytes = 0
+	settings.WriterBatchTimeoutSeconds = 0
+	return settings
+}
+
+// kustoRestartSettings returns copy of kusto config without settings applied on reload
+func kustoRestartSettings(kc *config.KustoConfig) config.KustoConfig {
+	settings := *kc
+	settings.Endpoint = ""
+	settings.ClientID = ""
+	settings.ClientSecret = ""
+	settings.TenantID = ""
+	settings.UseManagedIdentity = false
+	settings.UseWorkloadIdentity = false
+	settings.ClientCertificatePath = ""
+	settings.ClientCertificatePassword = ""
+	settings.SendCertificateChain = false
+	settings.UseAzureCLI = false
+	settings.FederatedTokenFilePath = ""
+	settings.TokenCredential = nil
+	settings.Reader = nil
+	settings.Writer = nil
+	settings.ClientRequestOptions = nil
+	return settings
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/test/emulator"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEmulatorClient(t *testing.T, em *emulator.Emulator) *kusto.Client {
+	client, err := kusto.New(kusto.NewConnectionStringBuilder(emulator.Endpoint), kusto.WithHttpClient(em.Client()))
+	require.NoError(t, err)
+	return client
+}
+
+func TestReload(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", ClientID: "id", ClientSecret: "old", TenantID: "tenant"}
+	require.NoError(t, kc.Validate())
+	s, err := newStore(sharedKustoClients(newEmulatorClient(t, em)), pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+	built := 0
+	s.newClient = func(_ *config.KustoConfig, _ hclog.Logger) (*kusto.Client, error) {
+		built++
+		return newEmulatorClient(t, em), nil
+	}
+	initial := s.factory.client.Client()
+
+	// query options and batch settings are applied without rebuilding client
+	reloadedPC := *pc
+	reloadedPC.WriterBatchMaxBytes = 1
+	reloadedKC := *kc
+	reloadedKC.ClientRequestOptions = []kusto.QueryOption{kusto.NoTruncation()}
+	require.NoError(t, s.Reload(&reloadedPC, &reloadedKC))
+	assert.Equal(t, 0, built)
+	assert.Same(t, initial, s.factory.client.Client())
+	assert.Len(t, s.factory.client.current.Load().options, 1)
+	assert.Equal(t, int64(1), s.spanWriter.batchMaxBytes.Load())
+
+	// changed secret rebuilds client and ingestions on top of it
+	rotatedKC := reloadedKC
+	rotatedKC.ClientSecret = "new"
+	require.NoError(t, s.Reload(&reloadedPC, &rotatedKC))
+	assert.Equal(t, 1, built)
+	assert.NotSame(t, initial, s.factory.client.Client())
+
+	require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1)))
+	require.NoError(t, s.spanWriter.Close())
+	assert.Len(t, em.Spans(), 1)
+
+	span := newTestSpan(1)
+	trace, err := s.SpanReader().GetTrace(context.Background(), span.TraceID)
+	require.NoError(t, err)
+	assert.Len(t, trace.Spans, 1)
+}
+
+// hostCredential is a custom token credential set by host embedding the plugin
+type hostCredential struct{}
+
+func (hostCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestReload_KeepsHostTokenCredential(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", TokenCredential: hostCredential{}}
+	require.NoError(t, kc.Validate())
+	s, err := newStore(sharedKustoClients(newEmulatorClient(t, em)), pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+	built := 0
+	s.newClient = func(_ *config.KustoConfig, _ hclog.Logger) (*kusto.Client, error) {
+		built++
+		return newEmulatorClient(t, em), nil
+	}
+
+	// config files can't set token credential, so reloaded config has none
+	reloadedKC := *kc
+	reloadedKC.TokenCredential = nil
+	reloadedKC.ClientRequestOptions = []kusto.QueryOption{kusto.NoTruncation()}
+	require.NoError(t, s.Reload(pc, &reloadedKC))
+	assert.Equal(t, 0, built)
+	assert.Equal(t, hostCredential{}, s.kustoConfig.TokenCredential)
+	assert.Nil(t, reloadedKC.TokenCredential)
+}
+
+func TestClientCalls(t *testing.T) {
+	closed := 0
+	calls := &clientCalls{}
+	require.True(t, calls.start())
+	require.True(t, calls.start())
+
+	// retired clients are closed after the last call in flight completes
+	calls.retire(func() { closed++ })
+	calls.done()
+	assert.Equal(t, 0, closed)
+	calls.done()
+	assert.Equal(t, 1, closed)
+	assert.False(t, calls.start())
+
+	idle := &clientCalls{}
+	idle.retire(func() { closed++ })
+	assert.Equal(t, 2, closed)
+	assert.False(t, idle.start())
+
+	unused := &clientCalls{}
+	unused.retire(nil)
+	assert.False(t, unused.start())
+}
+
+func TestReloadableClient_StartsCallsOnCurrentClient(t *testing.T) {
+	previous, current := &clientCalls{}, &clientCalls{}
+	c := &reloadableClient{}
+	c.current.Store(&kustoClientState{calls: previous})
+
+	inFlight := c.start()
+	assert.Same(t, previous, inFlight.calls)
+
+	// calls loading retired state before it was closed fall through to the current one
+	c.current.Store(&kustoClientState{calls: current})
+	closed := false
+	previous.retire(func() { closed = true })
+	assert.False(t, closed)
+	inFlight.calls.done()
+	assert.True(t, closed)
+	assert.Same(t, current, c.start().calls)
+}
+
+func TestBuildKustoClients(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	var endpoints []string
+	newClient := func(kc *config.KustoConfig, _ hclog.Logger) (*kusto.Client, error) {
+		endpoints = append(endpoints, kc.Endpoint)
+		return newEmulatorClient(t, em), nil
+	}
+
+	kc := &config.KustoConfig{Endpoint: "https://jaeger.kusto.windows.net", Database: "jaeger", UseManagedIdentity: true}
+	clients, err := buildKustoClients(config.ModeBoth, kc, nil, kustoClients{}, newClient, hclog.NewNullLogger())
+	require.NoError(t, err)
+	assert.Len(t, clients.unique(), 1)
+
+	separate := *kc
+	separate.Reader = &config.ClusterConfig{Endpoint: "https://follower.kusto.windows.net"}
+	separate.Writer = &config.ClusterConfig{ClientID: "writer", ClientSecret: "secret", TenantID: "tenant"}
+	rebuilt, err := buildKustoClients(config.ModeBoth, &separate, kc, clients, newClient, hclog.NewNullLogger())
+	require.NoError(t, err)
+	assert.Same(t, clients.main, rebuilt.main)
+	assert.Len(t, rebuilt.unique(), 3)
+	assert.Equal(t, []string{"https://jaeger.kusto.windows.net", "https://follower.kusto.windows.net", "https://jaeger.kusto.windows.net"}, endpoints)
+
+	rotated := separate
+	rotated.Writer = &config.ClusterConfig{ClientID: "writer", ClientSecret: "rotated", TenantID: "tenant"}
+	reloaded, err := buildKustoClients(config.ModeBoth, &rotated, &separate, rebuilt, newClient, hclog.NewNullLogger())
+	require.NoError(t, err)
+	assert.Same(t, rebuilt.reader, reloaded.reader)
+	assert.NotSame(t, rebuilt.writer, reloaded.writer)
+	assert.Len(t, endpoints, 4)
+}
+
+func TestNewStore_SeparateReaderAndWriter(t *testing.T) {
+	reader := emulator.New()
+	t.Cleanup(reader.Close)
+	writer := emulator.New()
+	t.Cleanup(writer.Close)
+
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	readerClient := newEmulatorClient(t, reader)
+	clients := kustoClients{main: readerClient, reader: readerClient, writer: newEmulatorClient(t, writer)}
+	s, err := newStore(clients, config.NewDefaultPluginConfig(), kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1)))
+	require.NoError(t, s.spanWriter.Close())
+	assert.Len(t, writer.Spans(), 1)
+	assert.Empty(t, reader.Spans())
+
+	_, err = s.SpanReader().GetServices(context.Background())
+	require.NoError(t, err)
+	assert.NotEmpty(t, reader.Queries())
+}
+
+func TestCredentialsChanged(t *testing.T) {
+	kc := &config.KustoConfig{Endpoint: "https://test.kusto.windows.net", UseManagedIdentity: true}
+	same := *kc
+	same.ReadTables = []config.TableReference{{Table: "OTELTraces"}}
+	assert.False(t, credentialsChanged(kc, &same))
+
+	workload := *kc
+	workload.UseManagedIdentity, workload.UseWorkloadIdentity = false, true
+	assert.True(t, credentialsChanged(kc, &workload))
+
+	certificate := *kc
+	certificate.UseManagedIdentity, certificate.ClientCertificatePath = false, "/etc/kusto/client.pfx"
+	rotated := certificate
+	rotated.ClientCertificatePassword = "rotated"
+	assert.True(t, credentialsChanged(&certificate, &rotated))
+
+	tokenFile := *kc
+	tokenFile.UseManagedIdentity, tokenFile.FederatedTokenFilePath = false, "/var/run/secrets/token"
+	assert.True(t, credentialsChanged(kc, &tokenFile))
+}
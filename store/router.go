@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/tenancy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// kustoTable identifies trace table in a database, cluster is set only for tables queried from another cluster
+type kustoTable struct {
+	Cluster  string
+	Database string
+	Table    string
+}
+
+// readSource is a set of trace tables queried together, Database is the database queries are sent to.
+// DependenciesTable is set when dependencies of these tables are pre-aggregated.
+type readSource struct {
+	Database          string
+	Tables            []kustoTable
+	DependenciesTable string
+}
+
+// AddTo appends reference to the table, or union of all tables, to statement
+func (s readSource) AddTo(stmt *kql.Builder) *kql.Builder {
+	if len(s.Tables) == 1 && s.isLocal(s.Tables[0]) {
+		return stmt.AddTable(s.Tables[0].Table)
+	}
+
+	stmt = stmt.AddLiteral("union ")
+	for i, t := range s.Tables {
+		if i > 0 {
+			stmt = stmt.AddLiteral(", ")
+		}
+		if t.Cluster != "" {
+			stmt = stmt.AddUnsafe(fmt.Sprintf("cluster(%s).", kql.QuoteString(t.Cluster, false)))
+		}
+		if !s.isLocal(t) {
+			stmt = stmt.AddDatabase(t.Database).AddLiteral(".")
+		}
+		stmt = stmt.AddTable(t.Table)
+	}
+	return stmt
+}
+
+// key identifies read source in caches
+func (s readSource) key() string {
+	return s.Database + ";" + s.AddTo(kql.New("")).String()
+}
+
+func (s readSource) isLocal(t kustoTable) bool {
+	return t.Cluster == "" && t.Database == s.Database
+}
+
+// tableRouter resolves trace tables for spans and queries according to routing rules
+type tableRouter struct {
+	defaultTable kustoTable
+	defaultRead  readSource
+	tenantHeader string
+	rules        []config.RoutingRule
+	tables       []kustoTable
+	ruleTables   []int
+	// tenantReads are tables queried for tenants having own routing rules
+	tenantReads map[string]readSource
+}
+
+func newTableRouter(kc *config.KustoConfig) *tableRouter {
+	r := &tableRouter{
+		defaultTable: kustoTable{Database: kc.Database, Table: kc.TraceTableName},
+		tenantHeader: kc.TenantHeader,
+		rules:        kc.RoutingRules,
+	}
+
+	r.tables = []kustoTable{r.defaultTable}
+	for _, rule := range r.rules {
+		r.ruleTables = append(r.ruleTables, r.addTable(kustoTable{Database: rule.Database, Table: rule.TraceTableName}))
+	}
+
+	// requests without tenant read tables of rules without tenant and readTables in place of trace table
+	defaultTables := []kustoTable{r.defaultTable}
+	if len(kc.ReadTables) > 0 {
+		defaultTables = nil
+		for _, t := range kc.ReadTables {
+			defaultTables = append(defaultTables, kustoTable{Cluster: t.Cluster, Database: t.Database, Table: t.Table})
+		}
+	}
+	r.defaultRead = readSource{
+		Database:          kc.Database,
+		Tables:            r.routedTables("", defaultTables),
+		DependenciesTable: kc.DependenciesTableName,
+	}
+
+	r.tenantReads = map[string]readSource{}
+	for _, rule := range r.rules {
+		if _, ok := r.tenantReads[rule.Tenant]; rule.Tenant != "" && !ok {
+			r.tenantReads[rule.Tenant] = r.tenantSource(rule.Tenant)
+		}
+	}
+
+	return r
+}
+
+// tenantSource returns read source of all tables spans of the tenant can be written to
+func (r *tableRouter) tenantSource(tenant string) readSource {
+	return r.sourceOf(r.routedTables(tenant, []kustoTable{r.defaultTable}))
+}
+
+// routedTables returns tables of rules of the tenant and of rules without tenant up to the first rule matching
+// every span of the tenant, followed by fallback tables when there is no such rule. Spans of requests without tenant
+// match only rules without tenant.
+func (r *tableRouter) routedTables(tenant string, fallback []kustoTable) []kustoTable {
+	var tables []kustoTable
+	add := func(table kustoTable) {
+		for _, t := range tables {
+			if t == table {
+				return
+			}
+		}
+		tables = append(tables, table)
+	}
+
+	for i, rule := range r.rules {
+		if rule.Tenant != "" && rule.Tenant != tenant {
+			continue
+		}
+		add(r.tables[r.ruleTables[i]])
+		if rule.ServiceName == "" && rule.ResourceAttribute == "" {
+			return tables
+		}
+	}
+	for _, table := range fallback {
+		add(table)
+	}
+	return tables
+}
+
+// sourceOf returns read source of tables, single table is queried in its own database
+func (r *tableRouter) sourceOf(tables []kustoTable) readSource {
+	if len(tables) == 1 {
+		return readSource{Database: tables[0].Database, Tables: tables}
+	}
+	return readSource{Database: r.defaultTable.Database, Tables: tables}
+}
+
+func (r *tableRouter) addTable(table kustoTable) int {
+	for i, t := range r.tables {
+		if t == table {
+			return i
+		}
+	}
+	r.tables = append(r.tables, table)
+	return len(r.tables) - 1
+}
+
+// Tables returns all distinct tables spans can be routed to, default table goes first
+func (r *tableRouter) Tables() []kustoTable {
+	return r.tables
+}
+
+// WriteTable returns index in Tables of the table span should be written to
+func (r *tableRouter) WriteTable(ctx context.Context, span *model.Span) int {
+	tenant := r.tenant(ctx)
+	for i, rule := range r.rules {
+		if matchesSpan(&rule, tenant, span) {
+			return r.ruleTables[i]
+		}
+	}
+	return 0
+}
+
+// DefaultSource returns tables queried for requests without tenant
+func (r *tableRouter) DefaultSource() readSource {
+	return r.defaultRead
+}
+
+// ReadSource returns tables which should be queried for the tenant of request, which are all tables spans of the
+// tenant can be routed to, as rules matching service or resource attributes are resolved per span. When routing rules
+// are set for tenants, requests of other tenants are rejected, as their spans share tables with spans of requests
+// without tenant.
+func (r *tableRouter) ReadSource(ctx context.Context) (readSource, error) {
+	tenant := r.tenant(ctx)
+	if tenant == "" || len(r.tenantReads) == 0 {
+		return r.defaultRead, nil
+	}
+	if source, ok := r.tenantReads[tenant]; ok {
+		return source, nil
+	}
+	return readSource{}, status.Errorf(codes.PermissionDenied, "no routing rules are set for tenant %q", tenant)
+}
+
+// tenant returns tenant set by jaeger tenancy interceptors or passed in request metadata
+func (r *tableRouter) tenant(ctx context.Context) string {
+	if tenant := tenancy.GetTenant(ctx); tenant != "" {
+		return tenant
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(r.tenantHeader); len(values) == 1 {
+		return values[0]
+	}
+	return ""
+}
+
+func matchesSpan(rule *config.RoutingRule, tenant string, span *model.Span) bool {
+	if rule.Tenant != "" && rule.Tenant != tenant {
+		return false
+	}
+	if rule.ServiceName == "" && rule.ResourceAttribute == "" {
+		return true
+	}
+	if span.Process == nil {
+		return false
+	}
+	if rule.ServiceName != "" && rule.ServiceName != span.Process.ServiceName {
+		return false
+	}
+	if rule.ResourceAttribute != "" {
+		kv, ok := model.KeyValues(span.Process.Tags).FindByKey(rule.ResourceAttribute)
+		if !ok {
+			return false
+		}
+		if rule.ResourceAttributeValue != "" && rule.ResourceAttributeValue != kv.AsString() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/test/emulator"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/tenancy"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newRoutingTestConfig() *config.KustoConfig {
+	kc := &config.KustoConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		TenantID:     "tenant",
+		Endpoint:     "https://test.kusto.windows.net",
+		Database:     "shared",
+		RoutingRules: []config.RoutingRule{
+			{Tenant: "team-a", TraceTableName: "TeamATraces"},
+			{ServiceName: "billing", Database: "billing", TraceTableName: "BillingTraces"},
+			{ResourceAttribute: "k8s.namespace.name", ResourceAttributeValue: "payments", TraceTableName: "PaymentsTraces"},
+			{Tenant: "team-b", ResourceAttribute: "team.b", TraceTableName: "TeamBTraces"},
+		},
+	}
+	if err := kc.Validate(); err != nil {
+		panic(err)
+	}
+	return kc
+}
+
+func TestTableRouter_Tables(t *testing.T) {
+	router := newTableRouter(newRoutingTestConfig())
+
+	assert.Equal(t, []kustoTable{
+		{Database: "shared", Table: "OTELTraces"},
+		{Database: "shared", Table: "TeamATraces"},
+		{Database: "billing", Table: "BillingTraces"},
+		{Database: "shared", Table: "PaymentsTraces"},
+		{Database: "shared", Table: "TeamBTraces"},
+	}, router.Tables())
+}
+
+func TestTableRouter_WriteTable(t *testing.T) {
+	router := newTableRouter(newRoutingTestConfig())
+	span := func(service string, tags ...model.KeyValue) *model.Span {
+		return &model.Span{Process: &model.Process{ServiceName: service, Tags: tags}}
+	}
+	teamA := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "team-a"))
+	teamB := tenancy.WithTenant(context.Background(), "team-b")
+
+	assert.Equal(t, 0, router.WriteTable(context.Background(), span("frontend")))
+	assert.Equal(t, 1, router.WriteTable(teamA, span("billing")))
+	assert.Equal(t, 2, router.WriteTable(context.Background(), span("billing")))
+	assert.Equal(t, 3, router.WriteTable(context.Background(), span("cart", model.String("k8s.namespace.name", "payments"))))
+	assert.Equal(t, 0, router.WriteTable(context.Background(), span("cart", model.String("k8s.namespace.name", "cart"))))
+	assert.Equal(t, 0, router.WriteTable(teamB, span("cart")))
+	assert.Equal(t, 4, router.WriteTable(teamB, span("cart", model.Bool("team.b", true))))
+}
+
+func TestTableRouter_ReadSource(t *testing.T) {
+	router := newTableRouter(newRoutingTestConfig())
+	teamA := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "team-a"))
+	teamB := tenancy.WithTenant(context.Background(), "team-b")
+	unknown := tenancy.WithTenant(context.Background(), "unknown")
+
+	// spans without tenant are routed by rules without tenant or written to trace table
+	source, err := router.ReadSource(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", source.Database)
+	assert.Equal(t, `union database("billing").BillingTraces, PaymentsTraces, OTELTraces`, source.AddTo(kql.New("")).String())
+
+	source, err = router.ReadSource(teamA)
+	assert.NoError(t, err)
+	assert.Equal(t, "TeamATraces", source.AddTo(kql.New("")).String())
+
+	// spans of team-b not matching its rule are routed by rules without tenant or written to trace table
+	source, err = router.ReadSource(teamB)
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", source.Database)
+	assert.Equal(t, `union database("billing").BillingTraces, PaymentsTraces, TeamBTraces, OTELTraces`, source.AddTo(kql.New("")).String())
+
+	_, err = router.ReadSource(unknown)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestTableRouter_ReadSourceIsolatesTenants(t *testing.T) {
+	kc := newRoutingTestConfig()
+	router := newTableRouter(kc)
+
+	for _, reader := range []string{"team-a", "team-b"} {
+		source, err := router.ReadSource(tenancy.WithTenant(context.Background(), reader))
+		assert.NoError(t, err)
+		for i, rule := range kc.RoutingRules {
+			if rule.Tenant != "" && rule.Tenant != reader {
+				assert.NotContains(t, source.Tables, router.Tables()[router.ruleTables[i]], "%s reads table of %s", reader, rule.Tenant)
+			}
+		}
+	}
+}
+
+func TestTableRouter_ReadTables(t *testing.T) {
+	kc := newRoutingTestConfig()
+	kc.ReadTables = []config.TableReference{
+		{Table: "OTELTraces"},
+		{Database: "prod-eu", Table: "OTELTraces"},
+		{Cluster: "https://us.kusto.windows.net", Database: "prod-us", Table: "Traces-US"},
+	}
+	assert.NoError(t, kc.Validate())
+	router := newTableRouter(kc)
+	teamA := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "team-a"))
+
+	source, err := router.ReadSource(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", source.Database)
+	assert.Equal(t,
+		`union database("billing").BillingTraces, PaymentsTraces, OTELTraces, database("prod-eu").OTELTraces, `+
+			`cluster("https://us.kusto.windows.net").database("prod-us").["Traces-US"] | summarize`,
+		source.AddTo(kql.New("")).AddLiteral(" | summarize").String())
+	// tenants keep reading from their own table
+	source, err = router.ReadSource(teamA)
+	assert.NoError(t, err)
+	assert.Equal(t, "TeamATraces", source.AddTo(kql.New("")).String())
+}
+
+func TestKustoSpanWriter_RoutesSpans(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 1
+	pc.WriterCompressionEnabled = false
+
+	router := newTableRouter(newRoutingTestConfig())
+	ingests := make([]kustoIngest, len(router.Tables()))
+	fakes := make([]*fakeIngest, len(router.Tables()))
+	for i := range ingests {
+		fakes[i] = &fakeIngest{}
+		ingests[i] = fakes[i]
+	}
+
+	writer, err := startKustoSpanWriter(ingests, router, hclog.NewNullLogger(), pc)
+	assert.NoError(t, err)
+
+	billing := newTestSpan(1)
+	billing.Process.ServiceName = "billing"
+	assert.NoError(t, writer.WriteSpan(context.Background(), billing))
+	assert.NoError(t, writer.WriteSpan(context.Background(), newTestSpan(2)))
+	assert.NoError(t, writer.Close())
+
+	assert.Len(t, fakes[0].batches, 1)
+	assert.Empty(t, fakes[1].batches)
+	assert.Len(t, fakes[2].batches, 1)
+	assert.Contains(t, string(fakes[2].batches[0]), "billing")
+}
+
+func TestStore_ReadsSpansRoutedByServiceRule(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	kc := newRoutingTestConfig()
+	kc.Endpoint = emulator.Endpoint
+	s, err := newStore(sharedKustoClients(newEmulatorClient(t, em)), config.NewDefaultPluginConfig(), kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	billing := newTestSpan(1)
+	billing.Process.ServiceName = "billing"
+	require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), billing))
+	require.NoError(t, s.spanWriter.Close())
+	require.Len(t, em.Spans(), 1)
+	assert.Equal(t, "BillingTraces", em.Spans()[0].Table)
+
+	trace, err := s.SpanReader().GetTrace(context.Background(), billing.TraceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 1)
+	assert.Equal(t, "billing", trace.Spans[0].Process.ServiceName)
+
+	traces, err := s.SpanReader().FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "billing",
+		StartTimeMin: billing.StartTime.Add(-time.Minute),
+		StartTimeMax: billing.StartTime.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Len(t, traces, 1)
+}
@@ -0,0 +1,35 @@
+package store
+
+// kustoColumn is name and type of a table column
+type kustoColumn struct {
+	Name string
+	Type string
+}
+
+// otelTracesColumns lists columns of OTELTraces table read by the plugin, as it is created by Azure Data Explorer
+// exporter of OpenTelemetry collector
+var otelTracesColumns = []kustoColumn{
+	{Name: "TraceID", Type: "string"},
+	{Name: "SpanID", Type: "string"},
+	{Name: "ParentID", Type: "string"},
+	{Name: "SpanName", Type: "string"},
+	{Name: "SpanStatus", Type: "string"},
+	{Name: "SpanKind", Type: "string"},
+	{Name: "StartTime", Type: "datetime"},
+	{Name: "EndTime", Type: "datetime"},
+	{Name: "ResourceAttributes", Type: "dynamic"},
+	{Name: "TraceAttributes", Type: "dynamic"},
+	{Name: "Events", Type: "dynamic"},
+	{Name: "Links", Type: "dynamic"},
+}
+
+// dependenciesColumns lists columns of dependencies table, which aggregation creates with createDependenciesTableCommand
+var dependenciesColumns = []kustoColumn{
+	{Name: "StartTime", Type: "datetime"},
+	{Name: "Parent", Type: "string"},
+	{Name: "Child", Type: "string"},
+	{Name: "CallCount", Type: "long"},
+	{Name: "Source", Type: "string"},
+	{Name: "ErrorCount", Type: "long"},
+	{Name: "ByOperation", Type: "bool"},
+}
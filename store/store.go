@@ -1,7 +1,11 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/dodopizza/jaeger-kusto/config"
@@ -15,59 +19,227 @@ type store struct {
 	dependencyStoreReader dependencystore.Reader
 	reader                spanstore.Reader
 	writer                spanstore.Writer
+
+	factory *kustoFactory
+	// spanReader is nil when plugin doesn't read in its mode
+	spanReader *kustoSpanReader
+	// spanWriter is nil when plugin doesn't write in its mode
+	spanWriter *kustoSpanWriter
+	// mode is the mode store was created in, it isn't changed on reload
+	mode         config.Mode
+	pluginConfig *config.PluginConfig
+	kustoConfig  *config.KustoConfig
+	logger       hclog.Logger
+	// newClient rebuilds kusto client on reload, it's nil when client is provided by host
+	newClient  kustoClientBuilder
+	reloadLock sync.Mutex
+	// stopAggregation stops dependencies aggregation, which is done when aggregationDone is closed
+	stopAggregation context.CancelFunc
+	aggregationDone chan struct{}
 }
 
 // NewStore creates new Kusto store for Jaeger span storage
 func NewStore(pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) (shared.StoragePlugin, error) {
-	var kcsb *kusto.ConnectionStringBuilder
-	if kc.UseManagedIdentity {
+	clients, err := buildKustoClients(pc.Mode, kc, nil, kustoClients{}, newKustoClient, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newStore(clients, pc, kc, logger)
+	if err != nil {
+		for _, client := range clients.unique() {
+			_ = client.Close()
+		}
+		return nil, err
+	}
+	s.newClient = newKustoClient
+	return s, nil
+}
+
+// kustoClientBuilder creates kusto client authenticated with credentials of kusto config
+type kustoClientBuilder func(kc *config.KustoConfig, logger hclog.Logger) (*kusto.Client, error)
+
+// buildKustoClients creates clients of main, reader and writer configs of kusto config, which are used in the mode.
+// Roles with the same endpoint and credentials share the client. When previous config is set, current clients
+// of roles with unchanged endpoint and credentials are kept.
+func buildKustoClients(mode config.Mode, kc *config.KustoConfig, previous *config.KustoConfig, current kustoClients, newClient kustoClientBuilder, logger hclog.Logger) (kustoClients, error) {
+	type builtClient struct {
+		kc     *config.KustoConfig
+		client *kusto.Client
+	}
+	var built []builtClient
+
+	clientOf := func(role string, roleConfig *config.KustoConfig, previousConfig *config.KustoConfig, currentClient *kusto.Client) (*kusto.Client, error) {
+		if previousConfig != nil && !credentialsChanged(previousConfig, roleConfig) {
+			return currentClient, nil
+		}
+		for _, b := range built {
+			if !credentialsChanged(b.kc, roleConfig) {
+				return b.client, nil
+			}
+		}
+		logger.Info("creating kusto client", "role", role, "endpoint", roleConfig.Endpoint)
+		client, err := newClient(roleConfig, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s kusto client: %w", role, err)
+		}
+		built = append(built, builtClient{kc: roleConfig, client: client})
+		return client, nil
+	}
+
+	var previousMain, previousReader, previousWriter *config.KustoConfig
+	if previous != nil {
+		previousMain, previousReader, previousWriter = previous, previous.ReaderConfig(), previous.WriterConfig()
+	}
+
+	// main client runs management commands of dependencies aggregation, which are written along with spans
+	var clients kustoClients
+	var err error
+	if mode.Writes() {
+		clients.main, err = clientOf("main", kc, previousMain, current.main)
+	}
+	if err == nil && mode.Reads() {
+		clients.reader, err = clientOf("reader", kc.ReaderConfig(), previousReader, current.reader)
+	}
+	if err == nil && mode.Writes() {
+		clients.writer, err = clientOf("writer", kc.WriterConfig(), previousWriter, current.writer)
+	}
+	if err != nil {
+		for _, b := range built {
+			_ = b.client.Close()
+		}
+		return kustoClients{}, err
+	}
+	return clients, nil
+}
+
+// newKustoClient creates kusto client authenticated with credentials of kusto config
+func newKustoClient(kc *config.KustoConfig, logger hclog.Logger) (*kusto.Client, error) {
+	kcsb := kusto.NewConnectionStringBuilder(kc.EngineEndpoint())
+	switch {
+	case kc.UseManagedIdentity:
 		if kc.ClientID == "" {
 			logger.Info("Using system managed identity")
-			kcsb = kusto.NewConnectionStringBuilder(kc.Endpoint).WithSystemManagedIdentity()
+			kcsb = kcsb.WithSystemManagedIdentity()
 		} else {
 			logger.Info("Using user managed identity")
-			kcsb = kusto.NewConnectionStringBuilder(kc.Endpoint).WithUserManagedIdentity(kc.ClientID)
+			kcsb = kcsb.WithUserManagedIdentity(kc.ClientID)
 		}
-	} else {
-		if kc.UseWorkloadIdentity {
-			logger.Info("Using workload identity for authentication")
-			kcsb = kusto.NewConnectionStringBuilder(kc.Endpoint).WithDefaultAzureCredential()
-		} else {
-			if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
-				return nil, errors.New("missing client configuration (ClientId, ClientSecret, TenantId) for kusto")
-			}
-			logger.Info("Authenticating using AppId [%s] / Secret / TenantId [%s]", kc.ClientID, kc.TenantID)
-			kcsb = kusto.NewConnectionStringBuilder(kc.Endpoint).WithAadAppKey(kc.ClientID, kc.ClientSecret, kc.TenantID)
+	case kc.UseWorkloadIdentity:
+		logger.Info("Using workload identity for authentication")
+		kcsb = kcsb.WithDefaultAzureCredential()
+	case kc.UseAzureCLI:
+		logger.Info("Using Azure CLI for authentication")
+		kcsb = kcsb.WithAzCli()
+	case kc.ClientCertificatePath != "":
+		logger.Info("Authenticating using AppId / certificate / TenantId", "clientId", kc.ClientID, "tenantId", kc.TenantID, "certificate", kc.ClientCertificatePath)
+		kcsb = kcsb.WithAppCertificatePath(kc.ClientID, kc.ClientCertificatePath, []byte(kc.ClientCertificatePassword), kc.SendCertificateChain, kc.TenantID)
+	case kc.FederatedTokenFilePath != "":
+		logger.Info("Authenticating using AppId / federated token file / TenantId", "clientId", kc.ClientID, "tenantId", kc.TenantID, "tokenFile", kc.FederatedTokenFilePath)
+		kcsb = kcsb.WithKubernetesWorkloadIdentity(kc.ClientID, kc.FederatedTokenFilePath, kc.TenantID)
+	case kc.TokenCredential != nil:
+		logger.Info("Using custom token credential for authentication")
+		kcsb = kcsb.WithTokenCredential(kc.TokenCredential)
+	default:
+		if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
+			return nil, errors.New("missing client configuration (ClientId, ClientSecret, TenantId) for kusto")
 		}
+		logger.Info("Authenticating using AppId / Secret / TenantId", "clientId", kc.ClientID, "tenantId", kc.TenantID)
+		kcsb = kcsb.WithAadAppKey(kc.ClientID, kc.ClientSecret, kc.TenantID)
 	}
 	kcsb.SetConnectorDetails("Kusto Jaeger", "0.0.1", "plugin", "", false, "")
-	client, err := kusto.New(kcsb)
-	if err != nil {
-		return nil, err
-	}
+	return kusto.New(kcsb)
+}
+
+// NewStoreWithClient creates new Kusto store on top of already configured kusto client, authentication
+// settings of kusto config are ignored. It's meant for hosts embedding the plugin and for tests.
+func NewStoreWithClient(client *kusto.Client, pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) (shared.StoragePlugin, error) {
+	return newStore(sharedKustoClients(client), pc, kc, logger)
+}
 
+func newStore(clients kustoClients, pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) (*store, error) {
 	// create factory for trace table opertations
-	factory := newKustoFactory(client, pc, kc.Database, kc.TraceTableName)
+	factory := newKustoFactory(clients, pc, kc)
 
-	reader, err := newKustoSpanReader(factory, logger, kc.ClientRequestOptions)
-	if err != nil {
-		return nil, err
+	store := &store{
+		dependencyStoreReader: disabledReader{mode: pc.Mode},
+		reader:                disabledReader{mode: pc.Mode},
+		writer:                disabledWriter{mode: pc.Mode},
+		factory:               factory,
+		mode:                  pc.Mode,
+		pluginConfig:          pc,
+		kustoConfig:           kc,
+		logger:                logger,
+	}
+
+	if pc.Mode.Reads() {
+		// query options of kusto config are applied by factory clients, so that they can be changed on reload
+		reader, err := newKustoSpanReader(factory, logger, nil)
+		if err != nil {
+			return nil, err
+		}
+		store.reader = reader
+		store.spanReader = reader
+		store.dependencyStoreReader = reader
+	}
+
+	if !pc.Mode.Writes() {
+		logger.Info("span writer and dependencies aggregation are disabled", "mode", pc.Mode)
+		return store, nil
 	}
 
 	writer, err := newKustoSpanWriter(factory, logger, pc)
 	if err != nil {
+		_ = store.Close()
 		return nil, err
 	}
+	store.writer = writer
+	store.spanWriter = writer
 
-	store := &store{
-		dependencyStoreReader: reader,
-		reader:                reader,
-		writer:                writer,
+	if pc.DependenciesAggregationEnabled {
+		if kc.DependenciesTableName == "" {
+			_ = store.Close()
+			return nil, errors.New("dependencies aggregation enabled, but dependenciesTableName is missing in kusto configuration")
+		}
+		bin := time.Duration(pc.DependenciesAggregationBinMinutes) * time.Minute
+		aggregator := newDependenciesAggregator(factory.Aggregation(), factory.Router.DefaultSource(), kc.DependenciesTableName, bin, pc.DependenciesByOperation, logger)
+		if err := aggregator.CreateTable(context.Background()); err != nil {
+			_ = store.Close()
+			return nil, err
+		}
+		logger.Info("starting dependencies aggregation", "table", kc.DependenciesTableName, "bin", bin)
+		ctx, cancel := context.WithCancel(context.Background())
+		store.stopAggregation = cancel
+		store.aggregationDone = make(chan struct{})
+		go func() {
+			defer close(store.aggregationDone)
+			aggregator.Run(ctx)
+		}()
 	}
 
 	return store, nil
 }
 
+// Close stops dependencies aggregation and metadata cache refresh, closes span writer, flushing spans not yet written,
+// and then closes ingestions and kusto clients. Client provided by host isn't closed.
+func (store *store) Close() error {
+	if store.spanReader != nil {
+		store.spanReader.Close()
+	}
+	if store.stopAggregation != nil {
+		store.stopAggregation()
+		<-store.aggregationDone
+	}
+	var err error
+	if store.spanWriter != nil {
+		err = store.spanWriter.Close()
+	}
+	store.reloadLock.Lock()
+	defer store.reloadLock.Unlock()
+	store.factory.Close(store.newClient != nil)
+	return err
+}
+
 // DependencyReader returns implementation of dependencystore.Reader interface
 func (store *store) DependencyReader() dependencystore.Reader {
 	return store.dependencyStoreReader
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/test/emulator"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewStore_ReadMode(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	pc.Mode = config.ModeRead
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	s, err := newStore(kustoClients{reader: newEmulatorClient(t, em)}, pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	assert.Nil(t, s.spanWriter)
+	err = s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1))
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	assert.ErrorContains(t, err, "writing is disabled, plugin runs in read mode")
+
+	_, err = s.SpanReader().GetServices(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestNewStore_WriteMode(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	pc.Mode = config.ModeWrite
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	client := newEmulatorClient(t, em)
+	s, err := newStore(kustoClients{main: client, writer: client}, pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	_, err = s.SpanReader().GetServices(context.Background())
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	assert.ErrorContains(t, err, "reading is disabled, plugin runs in write mode")
+	_, err = s.DependencyReader().GetDependencies(context.Background(), newTestSpan(1).StartTime, 0)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1)))
+	require.NoError(t, s.spanWriter.Close())
+	assert.Len(t, em.Spans(), 1)
+}
+
+func TestNewStore_WriterCompression(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		em := emulator.New()
+		t.Cleanup(em.Close)
+
+		pc := config.NewDefaultPluginConfig()
+		pc.Mode = config.ModeWrite
+		pc.WriterCompressionEnabled = compress
+		kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+		require.NoError(t, kc.Validate())
+		client := newEmulatorClient(t, em)
+		s, err := newStore(kustoClients{main: client, writer: client}, pc, kc, hclog.NewNullLogger())
+		require.NoError(t, err)
+
+		require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1)))
+		require.NoError(t, s.spanWriter.Close())
+		assert.Len(t, em.Spans(), 1)
+		assert.Equal(t, []bool{compress}, em.CompressedBlobs(), "compression enabled: %v", compress)
+	}
+}
+
+func TestStore_CloseStopsDependenciesAggregation(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	pc.DependenciesAggregationEnabled = true
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true, DependenciesTableName: "TraceDependencies"}
+	require.NoError(t, kc.Validate())
+	client := newEmulatorClient(t, em)
+	s, err := newStore(sharedKustoClients(client), pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	require.NoError(t, s.Close())
+	select {
+	case <-s.aggregationDone:
+	default:
+		t.Fatal("dependencies aggregation is running after store is closed")
+	}
+}
+
+func TestStore_CloseStopsMetadataCacheRefresh(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	pc := config.NewDefaultPluginConfig()
+	pc.ReadMetadataCacheRefreshSeconds = 60
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	s, err := newStore(sharedKustoClients(newEmulatorClient(t, em)), pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.NotNil(t, s.spanReader.metadataCacheDone)
+
+	require.NoError(t, s.Close())
+	select {
+	case <-s.spanReader.metadataCacheDone:
+	default:
+		t.Fatal("metadata cache refresh is running after store is closed")
+	}
+}
+
+// idleClosingTransport counts calls of CloseIdleConnections, which is what closing kusto client does
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed atomic.Int32
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed.Add(1)
+}
+
+func TestStore_CloseClosesOwnClients(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	newStoreWithTransport := func(owned bool) *idleClosingTransport {
+		transport := &idleClosingTransport{RoundTripper: em.Client().Transport}
+		client, err := kusto.New(kusto.NewConnectionStringBuilder(emulator.Endpoint), kusto.WithHttpClient(&http.Client{Transport: transport}))
+		require.NoError(t, err)
+		s, err := newStore(sharedKustoClients(client), config.NewDefaultPluginConfig(), kc, hclog.NewNullLogger())
+		require.NoError(t, err)
+		if owned {
+			s.newClient = newKustoClient
+		}
+		require.NoError(t, s.SpanWriter().WriteSpan(context.Background(), newTestSpan(1)))
+		require.NoError(t, s.Close())
+		return transport
+	}
+
+	assert.Positive(t, newStoreWithTransport(true).closed.Load())
+	// client provided by host is closed by host
+	assert.Zero(t, newStoreWithTransport(false).closed.Load())
+}
+
+func TestBuildKustoClients_Mode(t *testing.T) {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	var endpoints []string
+	newClient := func(kc *config.KustoConfig, _ hclog.Logger) (*kusto.Client, error) {
+		endpoints = append(endpoints, kc.Endpoint)
+		return newEmulatorClient(t, em), nil
+	}
+	kc := &config.KustoConfig{
+		Endpoint:           "https://jaeger.kusto.windows.net",
+		Database:           "jaeger",
+		UseManagedIdentity: true,
+		Writer:             &config.ClusterConfig{ClientID: "writer", ClientSecret: "secret", TenantID: "tenant"},
+	}
+
+	clients, err := buildKustoClients(config.ModeRead, kc, nil, kustoClients{}, newClient, hclog.NewNullLogger())
+	require.NoError(t, err)
+	assert.NotNil(t, clients.reader)
+	assert.Nil(t, clients.main)
+	assert.Nil(t, clients.writer)
+	assert.Equal(t, []string{"https://jaeger.kusto.windows.net"}, endpoints)
+
+	endpoints = nil
+	clients, err = buildKustoClients(config.ModeWrite, kc, nil, kustoClients{}, newClient, hclog.NewNullLogger())
+	require.NoError(t, err)
+	assert.Nil(t, clients.reader)
+	assert.Equal(t, []string{"https://jaeger.kusto.windows.net", "https://jaeger.kusto.windows.net"}, endpoints)
+}
+
+func TestNewKustoClient_IngestionEndpoint(t *testing.T) {
+	kc := &config.KustoConfig{Endpoint: "https://ingest-jaeger.kusto.windows.net", Database: "jaeger", UseManagedIdentity: true}
+	client, err := newKustoClient(kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	assert.Equal(t, "https://jaeger.kusto.windows.net", client.Endpoint())
+}
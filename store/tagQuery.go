@@ -0,0 +1,230 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+)
+
+type tagOperator int
+
+const (
+	tagEquals tagOperator = iota
+	tagExists
+	tagMatches
+	tagGreater
+	tagGreaterOrEqual
+	tagLess
+	tagLessOrEqual
+)
+
+// synthesizedTags are tags reader adds to spans from SpanStatus and SpanKind columns, mapped to KQL expressions
+// evaluating to the same tag values, so that any tag expression works on them
+var synthesizedTags = map[string]string{
+	"error":            `iff(SpanStatus == "STATUS_CODE_ERROR", dynamic(true), dynamic(null))`,
+	"otel.status_code": `case(SpanStatus == "STATUS_CODE_ERROR", dynamic("ERROR"), SpanStatus == "STATUS_CODE_OK", dynamic("OK"), dynamic(null))`,
+	"span.kind":        `case(SpanKind == "SPAN_KIND_SERVER", dynamic("server"), SpanKind == "SPAN_KIND_CLIENT", dynamic("client"), SpanKind == "SPAN_KIND_PRODUCER", dynamic("producer"), SpanKind == "SPAN_KIND_CONSUMER", dynamic("consumer"), dynamic(null))`,
+}
+
+// tagFilter is a single parsed tag expression. Jaeger UI sends tags as logfmt parsed into key-value pairs,
+// so operators are recognized by the last character of the key and by the first characters of the value:
+//
+//	key=value   equals            key!=value   not equals
+//	key=~regex  matches regex     key!=~regex  doesn't match regex
+//	key=*       exists            key!=*       doesn't exist
+//	key>=10     greater or equal  key<=10      less or equal
+//	key=>10     greater           key=<10      less
+//
+// Value starting with a backslash is compared as is, e.g. key=\* matches literal asterisk. Values, which aren't
+// valid regular expressions or numbers of their operators, are compared as is too, e.g. key=<html>.
+type tagFilter struct {
+	Key      string
+	Operator tagOperator
+	Negate   bool
+	Value    string
+	Number   float64
+}
+
+// parseTagFilter parses tag expression from key and value passed by Jaeger, without expressions every tag is
+// compared for equality as is
+func parseTagFilter(key string, value string, expressions bool) (tagFilter, error) {
+	filter := tagFilter{Key: key, Operator: tagEquals, Value: value}
+	if !expressions {
+		return filter, nil
+	}
+
+	switch {
+	case strings.HasSuffix(key, "!"):
+		filter.Key, filter.Negate = strings.TrimSuffix(key, "!"), true
+	case strings.HasSuffix(key, ">"):
+		filter.Key, filter.Operator = strings.TrimSuffix(key, ">"), tagGreaterOrEqual
+	case strings.HasSuffix(key, "<"):
+		filter.Key, filter.Operator = strings.TrimSuffix(key, "<"), tagLessOrEqual
+	}
+	if filter.Key == "" {
+		return filter, fmt.Errorf("%w %q: missing tag name", ErrInvalidTagExpression, key+"="+value)
+	}
+
+	if filter.Operator == tagEquals {
+		switch {
+		case value == "*":
+			filter.Operator = tagExists
+		case strings.HasPrefix(value, "~"):
+			filter.Operator, filter.Value = tagMatches, value[1:]
+		case strings.HasPrefix(value, ">"):
+			filter.Operator, filter.Value = tagGreater, value[1:]
+		case strings.HasPrefix(value, "<"):
+			filter.Operator, filter.Value = tagLess, value[1:]
+		case strings.HasPrefix(value, `\`):
+			filter.Value = value[1:]
+		}
+	}
+
+	switch filter.Operator {
+	case tagMatches:
+		if _, err := regexp.Compile(filter.Value); err != nil {
+			return tagFilter{Key: filter.Key, Operator: tagEquals, Negate: filter.Negate, Value: value}, nil
+		}
+	case tagGreater, tagLess:
+		number, err := strconv.ParseFloat(strings.TrimSpace(filter.Value), 64)
+		if err != nil {
+			return tagFilter{Key: filter.Key, Operator: tagEquals, Negate: filter.Negate, Value: value}, nil
+		}
+		filter.Number = number
+	case tagGreaterOrEqual, tagLessOrEqual:
+		number, err := strconv.ParseFloat(strings.TrimSpace(filter.Value), 64)
+		if err != nil {
+			return filter, fmt.Errorf("%w %q: value must be a number", ErrInvalidTagExpression, key+"="+value)
+		}
+		filter.Number = number
+	}
+	return filter, nil
+}
+
+// predicate returns KQL condition of the operator (without negation) applied to attribute expression
+func (f tagFilter) predicate(attribute string, valueParam string) string {
+	switch f.Operator {
+	case tagExists:
+		return fmt.Sprintf("isnotnull(%s)", attribute)
+	case tagMatches:
+		return fmt.Sprintf("tostring(%s) matches regex %s", attribute, valueParam)
+	case tagGreater:
+		return fmt.Sprintf("todouble(%s) > %s", attribute, valueParam)
+	case tagGreaterOrEqual:
+		return fmt.Sprintf("todouble(%s) >= %s", attribute, valueParam)
+	case tagLess:
+		return fmt.Sprintf("todouble(%s) < %s", attribute, valueParam)
+	case tagLessOrEqual:
+		return fmt.Sprintf("todouble(%s) <= %s", attribute, valueParam)
+	default:
+		return fmt.Sprintf("tostring(%s) == %s", attribute, valueParam)
+	}
+}
+
+// addValueParam adds value of the expression to query parameters, existence check has no value
+func (f tagFilter) addValueParam(params *kql.Parameters, valueParam string) *kql.Parameters {
+	switch f.Operator {
+	case tagExists:
+		return params
+	case tagGreater, tagGreaterOrEqual, tagLess, tagLessOrEqual:
+		return params.AddReal(valueParam, f.Number)
+	default:
+		return params.AddString(valueParam, f.Value)
+	}
+}
+
+// addTagFilters appends filters of tag expressions to the statement. A tag matches when span, resource or any
+// of span events has the attribute, negated expressions match when none of them has it.
+// Tag names and values are always passed as query parameters, generated KQL contains only parameter names.
+func addTagFilters(stmt *kql.Builder, params *kql.Parameters, tags map[string]string, expressions bool) (*kql.Builder, *kql.Parameters, error) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		filter, err := parseTagFilter(key, tags[key], expressions)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if expression, ok := synthesizedTags[filter.Key]; ok {
+			stmt, params = addSynthesizedTagFilter(stmt, params, filter, expression, i)
+			continue
+		}
+
+		// spans written by this plugin have dots in attribute names replaced, spans of OTEL exporter keep them
+		keyParams := []string{fmt.Sprintf("ParamTagKey%d", i)}
+		params = params.AddString(keyParams[0], filter.Key)
+		if replaced := strings.ReplaceAll(filter.Key, ".", TagDotReplacementCharacter); replaced != filter.Key {
+			keyParams = append(keyParams, fmt.Sprintf("ParamTagKey%dReplaced", i))
+			params = params.AddString(keyParams[1], replaced)
+		}
+
+		valueParam := fmt.Sprintf("ParamTagValue%d", i)
+		params = filter.addValueParam(params, valueParam)
+
+		var conditions, eventConditions []string
+		for _, keyParam := range keyParams {
+			conditions = append(conditions,
+				filter.predicate(fmt.Sprintf("TraceAttributes[%s]", keyParam), valueParam),
+				filter.predicate(fmt.Sprintf("ResourceAttributes[%s]", keyParam), valueParam),
+			)
+			eventConditions = append(eventConditions, filter.predicate(fmt.Sprintf("Event.EventAttributes[%s]", keyParam), valueParam))
+		}
+
+		eventMatch := fmt.Sprintf("TagEventMatch%d", i)
+		conditions = append(conditions, eventMatch+" > 0")
+		stmt = stmt.AddUnsafe(fmt.Sprintf(" | mv-apply Event=Events to typeof(dynamic) on (summarize %s=countif(%s))", eventMatch, strings.Join(eventConditions, " or ")))
+
+		condition := strings.Join(conditions, " or ")
+		if filter.Negate {
+			stmt = stmt.AddUnsafe(fmt.Sprintf(" | where not(%s)", condition))
+		} else {
+			stmt = stmt.AddUnsafe(fmt.Sprintf(" | where %s", condition))
+		}
+	}
+	return stmt, params, nil
+}
+
+// addSynthesizedTagFilter appends filter of a tag synthesized from span columns. Equality is checked on the column
+// itself, so that kusto can use column index, other expressions are evaluated on the synthesized value.
+// Spans keeping the tag as attribute, e.g. error attribute set by OTEL instrumentation, match by the attribute too.
+func addSynthesizedTagFilter(stmt *kql.Builder, params *kql.Parameters, filter tagFilter, expression string, i int) (*kql.Builder, *kql.Parameters) {
+	keyParam := fmt.Sprintf("ParamTagKey%d", i)
+	valueParam := fmt.Sprintf("ParamTagValue%d", i)
+	columnValueParam := fmt.Sprintf("ParamTagColumnValue%d", i)
+
+	condition := ""
+	if filter.Operator == tagEquals {
+		switch value := filter.Value; {
+		case filter.Key == "error" && strings.EqualFold(value, "true"):
+			condition = `SpanStatus == "STATUS_CODE_ERROR"`
+		case filter.Key == "error" && strings.EqualFold(value, "false"):
+			condition = `SpanStatus != "STATUS_CODE_ERROR"`
+		case filter.Key == "otel.status_code" && (strings.EqualFold(value, "ERROR") || strings.EqualFold(value, "OK")):
+			condition = "SpanStatus == " + columnValueParam
+			params = params.AddString(columnValueParam, "STATUS_CODE_"+strings.ToUpper(value))
+		case filter.Key == "span.kind" && spanKindTag(otelSpanKind(strings.ToLower(value))) != "":
+			condition = "SpanKind == " + columnValueParam
+			params = params.AddString(columnValueParam, otelSpanKind(strings.ToLower(value)))
+		}
+	}
+
+	params = filter.addValueParam(params, valueParam)
+	if condition == "" {
+		condition = filter.predicate(expression, valueParam)
+	}
+	params = params.AddString(keyParam, filter.Key)
+	condition += " or " + filter.predicate(fmt.Sprintf("TraceAttributes[%s]", keyParam), valueParam)
+
+	if filter.Negate {
+		return stmt.AddUnsafe(fmt.Sprintf(" | where not(%s)", condition)), params
+	}
+	return stmt.AddUnsafe(fmt.Sprintf(" | where %s", condition)), params
+}
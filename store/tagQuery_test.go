@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTagFilter(t *testing.T) {
+	cases := []struct {
+		key      string
+		value    string
+		expected tagFilter
+	}{
+		{"http.method", "GET", tagFilter{Key: "http.method", Operator: tagEquals, Value: "GET"}},
+		{"http.method!", "GET", tagFilter{Key: "http.method", Operator: tagEquals, Negate: true, Value: "GET"}},
+		{"http.url", "~^/api/.*", tagFilter{Key: "http.url", Operator: tagMatches, Value: "^/api/.*"}},
+		{"http.url!", "~^/health", tagFilter{Key: "http.url", Operator: tagMatches, Negate: true, Value: "^/health"}},
+		{"db.statement", "*", tagFilter{Key: "db.statement", Operator: tagExists, Value: "*"}},
+		{"db.statement!", "*", tagFilter{Key: "db.statement", Operator: tagExists, Negate: true, Value: "*"}},
+		{"http.status_code>", "500", tagFilter{Key: "http.status_code", Operator: tagGreaterOrEqual, Value: "500", Number: 500}},
+		{"http.status_code<", "299", tagFilter{Key: "http.status_code", Operator: tagLessOrEqual, Value: "299", Number: 299}},
+		{"retries", ">2", tagFilter{Key: "retries", Operator: tagGreater, Value: "2", Number: 2}},
+		{"latency", "<0.5", tagFilter{Key: "latency", Operator: tagLess, Value: "0.5", Number: 0.5}},
+		{"path", `\*`, tagFilter{Key: "path", Operator: tagEquals, Value: "*"}},
+		{"msg", "<html>", tagFilter{Key: "msg", Operator: tagEquals, Value: "<html>"}},
+		{"path", "~user", tagFilter{Key: "path", Operator: tagMatches, Value: "user"}},
+		{"http.url", "~[", tagFilter{Key: "http.url", Operator: tagEquals, Value: "~["}},
+		{"retries!", ">many", tagFilter{Key: "retries", Operator: tagEquals, Negate: true, Value: ">many"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key+"="+c.value, func(t *testing.T) {
+			filter, err := parseTagFilter(c.key, c.value, true)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, filter)
+		})
+	}
+}
+
+func TestParseTagFilter_ExpressionsDisabled(t *testing.T) {
+	for key, value := range map[string]string{
+		"msg":               "<html>",
+		"path":              "~user",
+		"db.statement":      "*",
+		"http.method!":      "GET",
+		"http.status_code>": "500",
+	} {
+		filter, err := parseTagFilter(key, value, false)
+		assert.NoError(t, err)
+		assert.Equal(t, tagFilter{Key: key, Operator: tagEquals, Value: value}, filter, key+"="+value)
+	}
+}
+
+func TestParseTagFilter_Invalid(t *testing.T) {
+	for key, value := range map[string]string{
+		"!":                 "value",
+		"http.status_code>": "five hundred",
+		"http.status_code<": "",
+	} {
+		_, err := parseTagFilter(key, value, true)
+		assert.ErrorIs(t, err, ErrInvalidTagExpression, key+"="+value)
+	}
+}
+
+func TestAddTagFilters(t *testing.T) {
+	stmt, params, err := addTagFilters(kql.New("OTELTraces"), kql.NewParameters(), map[string]string{
+		"http.status_code>": "500",
+		"component!":        "*",
+	}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "OTELTraces"+
+		" | mv-apply Event=Events to typeof(dynamic) on (summarize TagEventMatch0=countif(isnotnull(Event.EventAttributes[ParamTagKey0])))"+
+		" | where not(isnotnull(TraceAttributes[ParamTagKey0]) or isnotnull(ResourceAttributes[ParamTagKey0]) or TagEventMatch0 > 0)"+
+		" | mv-apply Event=Events to typeof(dynamic) on (summarize TagEventMatch1=countif(todouble(Event.EventAttributes[ParamTagKey1]) >= ParamTagValue1 or todouble(Event.EventAttributes[ParamTagKey1Replaced]) >= ParamTagValue1))"+
+		" | where todouble(TraceAttributes[ParamTagKey1]) >= ParamTagValue1 or todouble(ResourceAttributes[ParamTagKey1]) >= ParamTagValue1"+
+		" or todouble(TraceAttributes[ParamTagKey1Replaced]) >= ParamTagValue1 or todouble(ResourceAttributes[ParamTagKey1Replaced]) >= ParamTagValue1 or TagEventMatch1 > 0",
+		stmt.String())
+	assert.Equal(t, map[string]string{
+		"ParamTagKey0":         `"component"`,
+		"ParamTagKey1":         `"http.status_code"`,
+		"ParamTagKey1Replaced": `"http_status_code"`,
+		"ParamTagValue1":       "real(500)",
+	}, params.ToParameterCollection())
+}
+
+func TestFindTraces_InvalidTagExpression(t *testing.T) {
+	client := &fakeKustoClient{}
+	reader := &kustoSpanReader{
+		client:         client,
+		router:         &tableRouter{defaultRead: newDependenciesTestSource()},
+		logger:         hclog.NewNullLogger(),
+		tagExpressions: true,
+	}
+
+	_, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		Tags:         map[string]string{"retries>": "many"},
+		StartTimeMin: time.Now().Add(-time.Hour),
+		StartTimeMax: time.Now(),
+	})
+	assert.ErrorIs(t, err, ErrInvalidTagExpression)
+	assert.Empty(t, client.statements)
+}
+
+func TestAddTagFilters_SynthesizedTags(t *testing.T) {
+	cases := []struct {
+		key      string
+		value    string
+		expected string
+		params   map[string]string
+	}{
+		{"error", "true", ` | where SpanStatus == "STATUS_CODE_ERROR" or tostring(TraceAttributes[ParamTagKey0]) == ParamTagValue0`,
+			map[string]string{"ParamTagKey0": `"error"`, "ParamTagValue0": `"true"`}},
+		{"error!", "true", ` | where not(SpanStatus == "STATUS_CODE_ERROR" or tostring(TraceAttributes[ParamTagKey0]) == ParamTagValue0)`,
+			map[string]string{"ParamTagKey0": `"error"`, "ParamTagValue0": `"true"`}},
+		{"error", "false", ` | where SpanStatus != "STATUS_CODE_ERROR" or tostring(TraceAttributes[ParamTagKey0]) == ParamTagValue0`,
+			map[string]string{"ParamTagKey0": `"error"`, "ParamTagValue0": `"false"`}},
+		{"otel.status_code", "error", " | where SpanStatus == ParamTagColumnValue0 or tostring(TraceAttributes[ParamTagKey0]) == ParamTagValue0",
+			map[string]string{"ParamTagKey0": `"otel.status_code"`, "ParamTagValue0": `"error"`, "ParamTagColumnValue0": `"STATUS_CODE_ERROR"`}},
+		{"span.kind", "Server", " | where SpanKind == ParamTagColumnValue0 or tostring(TraceAttributes[ParamTagKey0]) == ParamTagValue0",
+			map[string]string{"ParamTagKey0": `"span.kind"`, "ParamTagValue0": `"Server"`, "ParamTagColumnValue0": `"SPAN_KIND_SERVER"`}},
+		{"span.kind!", "*", " | where not(isnotnull(" + synthesizedTags["span.kind"] + ") or isnotnull(TraceAttributes[ParamTagKey0]))",
+			map[string]string{"ParamTagKey0": `"span.kind"`}},
+		{"otel.status_code", "~^(OK|ERROR)$", " | where tostring(" + synthesizedTags["otel.status_code"] + ") matches regex ParamTagValue0 or tostring(TraceAttributes[ParamTagKey0]) matches regex ParamTagValue0",
+			map[string]string{"ParamTagKey0": `"otel.status_code"`, "ParamTagValue0": `"^(OK|ERROR)$"`}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key+"="+c.value, func(t *testing.T) {
+			stmt, params, err := addTagFilters(kql.New(""), kql.NewParameters(), map[string]string{c.key: c.value}, true)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, stmt.String())
+			assert.Equal(t, c.params, params.ToParameterCollection())
+		})
+	}
+}
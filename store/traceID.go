@@ -0,0 +1,38 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// formatTraceID formats trace id as 32 lowercase hex characters padded with zeros, the way OTEL exporters store it.
+// Jaeger TraceID.String() drops the high part of 64-bit ids instead, so it can't be compared with stored ids directly.
+func formatTraceID(traceID model.TraceID) string {
+	return fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+}
+
+// traceIDVariants returns all forms the trace id may be stored in: OTEL padded form, 16 characters form
+// of 64-bit ids written by legacy Jaeger clients and earlier plugin versions, and form without leading zeros
+// written by some clients. Stored ids are compared case-insensitively, so only lowercase forms are returned.
+func traceIDVariants(traceID model.TraceID) []string {
+	padded := formatTraceID(traceID)
+	variants := []string{padded}
+	if traceID.High == 0 {
+		variants = append(variants, fmt.Sprintf("%016x", traceID.Low))
+	}
+	if stripped := strings.TrimLeft(padded, "0"); stripped != "" && stripped != variants[len(variants)-1] {
+		variants = append(variants, stripped)
+	}
+	return variants
+}
+
+// normalizeTraceID converts trace id in any of the stored forms to the padded form, keeps value as is if it can't be parsed
+func normalizeTraceID(traceID string) string {
+	parsed, err := model.TraceIDFromString(traceID)
+	if err != nil {
+		return traceID
+	}
+	return formatTraceID(parsed)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTraceID(t *testing.T) {
+	cases := []struct {
+		name     string
+		traceID  model.TraceID
+		expected string
+	}{
+		{"128-bit", model.NewTraceID(0x3f6d8f4c50083520, 0x55c14804949d1e57), "3f6d8f4c5008352055c14804949d1e57"},
+		{"leading zeros in high part", model.NewTraceID(0xabc, 0x55c14804949d1e57), "0000000000000abc55c14804949d1e57"},
+		{"leading zeros in low part", model.NewTraceID(0x3f6d8f4c50083520, 0x1), "3f6d8f4c500835200000000000000001"},
+		{"64-bit", model.NewTraceID(0, 0x55c14804949d1e57), "000000000000000055c14804949d1e57"},
+		{"zero", model.NewTraceID(0, 0), "00000000000000000000000000000000"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, formatTraceID(c.traceID))
+		})
+	}
+}
+
+func TestTraceIDVariants(t *testing.T) {
+	cases := []struct {
+		name     string
+		traceID  model.TraceID
+		expected []string
+	}{
+		{"128-bit", model.NewTraceID(0x3f6d8f4c50083520, 0x55c14804949d1e57), []string{"3f6d8f4c5008352055c14804949d1e57"}},
+		{"leading zeros", model.NewTraceID(0xabc, 0x55c14804949d1e57), []string{"0000000000000abc55c14804949d1e57", "abc55c14804949d1e57"}},
+		{"64-bit", model.NewTraceID(0, 0x55c14804949d1e57), []string{"000000000000000055c14804949d1e57", "55c14804949d1e57"}},
+		{"short 64-bit", model.NewTraceID(0, 0x1e57), []string{"00000000000000000000000000001e57", "0000000000001e57", "1e57"}},
+		{"zero", model.NewTraceID(0, 0), []string{"00000000000000000000000000000000", "0000000000000000"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, traceIDVariants(c.traceID))
+		})
+	}
+}
+
+func TestNormalizeTraceID(t *testing.T) {
+	assert.Equal(t, "0000000000000abc55c14804949d1e57", normalizeTraceID("abc55c14804949d1e57"))
+	assert.Equal(t, "0000000000000abc55c14804949d1e57", normalizeTraceID("0000000000000ABC55C14804949D1E57"))
+	assert.Equal(t, "000000000000000055c14804949d1e57", normalizeTraceID("55c14804949d1e57"))
+	assert.Equal(t, "not-a-trace-id", normalizeTraceID("not-a-trace-id"))
+}
+
+func TestTransformSpanToStringArray_PadsTraceIDs(t *testing.T) {
+	traceID := model.NewTraceID(0, 0x1e57)
+	span := &model.Span{
+		TraceID:    traceID,
+		SpanID:     model.NewSpanID(2),
+		StartTime:  time.Date(2024, time.March, 13, 10, 0, 0, 0, time.UTC),
+		References: []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(1))},
+		Process:    model.NewProcess("frontend", nil),
+	}
+
+	row, err := TransformSpanToStringArray(span)
+	assert.NoError(t, err)
+	assert.Equal(t, "00000000000000000000000000001e57", row[0])
+	assert.Contains(t, row[3], `"traceID":"00000000000000000000000000001e57"`)
+}
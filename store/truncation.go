@@ -0,0 +1,49 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// TruncatedTagKey is the tag set on root span of a trace whose spans were cut by read limits
+const TruncatedTagKey = "kusto.truncated"
+
+// truncateSpans keeps the first limit spans ordered by start time, returns true when spans were dropped
+func truncateSpans(spans []*model.Span, limit int) ([]*model.Span, bool) {
+	if limit <= 0 || len(spans) <= limit {
+		return spans, false
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartTime.Before(spans[j].StartTime)
+	})
+	return spans[:limit], true
+}
+
+// markTruncated adds truncation tag and warning to the root span, or to the earliest span when root wasn't read
+func markTruncated(spans []*model.Span, reason string) {
+	if len(spans) == 0 {
+		return
+	}
+	root := spans[0]
+	for _, span := range spans {
+		if span.ParentSpanID() == 0 {
+			root = span
+			break
+		}
+		if span.StartTime.Before(root.StartTime) {
+			root = span
+		}
+	}
+	root.Tags = append(root.Tags, model.Bool(TruncatedTagKey, true))
+	root.Warnings = append(root.Warnings, reason)
+}
+
+func spansPerTraceWarning(limit int) string {
+	return fmt.Sprintf("trace is truncated to the first %d spans by start time, raise readMaxSpansPerTrace to see all spans", limit)
+}
+
+func searchRowsWarning(limit int) string {
+	return fmt.Sprintf("search results are truncated to the first %d spans by start time, raise readMaxSearchRows or narrow the search to see all spans", limit)
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTruncationTestSpans() []*model.Span {
+	start := time.Date(2024, time.March, 13, 10, 0, 0, 0, time.UTC)
+	traceID := model.NewTraceID(0, 1)
+	root := &model.Span{TraceID: traceID, SpanID: 1, StartTime: start}
+	return []*model.Span{
+		{TraceID: traceID, SpanID: 3, StartTime: start.Add(2 * time.Second), References: []model.SpanRef{model.NewChildOfRef(traceID, 1)}},
+		root,
+		{TraceID: traceID, SpanID: 2, StartTime: start.Add(time.Second), References: []model.SpanRef{model.NewChildOfRef(traceID, 1)}},
+	}
+}
+
+func TestTruncateSpans(t *testing.T) {
+	spans, truncated := truncateSpans(newTruncationTestSpans(), 0)
+	assert.False(t, truncated)
+	assert.Len(t, spans, 3)
+
+	spans, truncated = truncateSpans(newTruncationTestSpans(), 3)
+	assert.False(t, truncated)
+	assert.Len(t, spans, 3)
+
+	spans, truncated = truncateSpans(newTruncationTestSpans(), 2)
+	assert.True(t, truncated)
+	assert.Equal(t, []model.SpanID{1, 2}, []model.SpanID{spans[0].SpanID, spans[1].SpanID})
+}
+
+func TestMarkTruncated(t *testing.T) {
+	spans := newTruncationTestSpans()
+	markTruncated(spans, "truncated")
+
+	root := spans[1]
+	assert.Equal(t, []model.KeyValue{model.Bool(TruncatedTagKey, true)}, root.Tags)
+	assert.Equal(t, []string{"truncated"}, root.Warnings)
+	assert.Empty(t, spans[0].Tags)
+
+	// earliest span is marked when root span is missing
+	orphans := newTruncationTestSpans()[:1]
+	orphans = append(orphans, newTruncationTestSpans()[2])
+	markTruncated(orphans, "truncated")
+	assert.Equal(t, model.SpanID(2), orphans[1].SpanID)
+	assert.Len(t, orphans[1].Tags, 1)
+	assert.Empty(t, orphans[0].Tags)
+}
+
+func TestGetTrace_LimitsSpans(t *testing.T) {
+	client := &fakeKustoClient{results: []*kusto.MockRows{newSpanRows(t,
+		newTestKustoSpan(testTraceID, "0000000000000001", ""),
+		newTestKustoSpan(testTraceID, "0000000000000002", "0000000000000001"),
+		newTestKustoSpan(testTraceID, "0000000000000003", "0000000000000001"),
+	)}}
+	reader := &kustoSpanReader{
+		client:           client,
+		router:           &tableRouter{defaultRead: newDependenciesTestSource()},
+		logger:           hclog.NewNullLogger(),
+		maxSpansPerTrace: 2,
+	}
+
+	traceID, _ := model.TraceIDFromString(testTraceID)
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	assert.NoError(t, err)
+	assert.Len(t, trace.Spans, 2)
+	assert.Equal(t, []string{spansPerTraceWarning(2)}, trace.Spans[0].Warnings)
+	assert.Len(t, client.statements, 1)
+	assert.Contains(t, client.statements[0], "| top ParamMaxSpansPerTrace by StartTime asc")
+}
@@ -3,51 +3,131 @@ package store
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/Azure/azure-kusto-go/kusto/ingest/ingestoptions"
 	"github.com/dodopizza/jaeger-kusto/config"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
-	"github.com/tushar2708/altcsv"
 )
 
+// ErrWriterClosed occurs when attempting to write span after writer was closed
+var ErrWriterClosed = errors.New("span writer is closed")
+
 type kustoIngest interface {
 	FromReader(ctx context.Context, reader io.Reader, options ...ingest.FileOption) (*ingest.Result, error)
 }
 
+// routedSpan is a span encoded for ingestion along with index of its destination table
+type routedSpan struct {
+	table int
+	row   []string
+}
+
 type kustoSpanWriter struct {
-	batchMaxBytes         int
-	batchTimeout          time.Duration
-	workersCount          int
-	ingest                kustoIngest
-	logger                hclog.Logger
-	spanInput             chan []string
-	shutdown              chan struct{}
-	shutdownWg            sync.WaitGroup
+	// batch settings are read by workers on every span and tick, so they can be changed on config reload
+	batchMaxBytes   atomic.Int64
+	batchTimeout    atomic.Int64
+	workersCount    int
+	ingests         []kustoIngest
+	router          *tableRouter
+	format          ingest.DataFormat
+	compress        bool
+	ingestOptions   []ingest.FileOption
+	logger          hclog.Logger
+	spanInput       chan routedSpan
+	shutdownWg      sync.WaitGroup
+	shutdownTimeout time.Duration
+	// closeLock guards closed and registration of writes in writesWg, it's never held while span is sent
+	closeLock sync.RWMutex
+	closed    bool
+	// closing is closed when shutdown starts, it unblocks writes waiting for free space in spanInput
+	closing               chan struct{}
+	writesWg              sync.WaitGroup
 	disableJaegerUiTraces bool
+
+	statusReporting bool
+	statusTimeout   time.Duration
+	// abortCtx is cancelled when shutdown times out, it stops ingestions and status polling in progress
+	abortCtx    context.Context
+	abort       context.CancelFunc
+	statusSlots chan struct{}
+	statusWg    sync.WaitGroup
+	// waitStatus returns channel receiving final status of ingestion, it's replaced in tests
+	waitStatus    func(ctx context.Context, result *ingest.Result) <-chan error
+	failedBatches uint64
+}
+
+func waitIngestionResult(ctx context.Context, result *ingest.Result) <-chan error {
+	return result.Wait(ctx)
 }
 
 func newKustoSpanWriter(factory *kustoFactory, logger hclog.Logger, pc *config.PluginConfig) (*kustoSpanWriter, error) {
-	in, err := factory.Ingest()
+	var ingests []kustoIngest
+	for _, table := range factory.Router.Tables() {
+		in, err := factory.Ingest(table)
+		if err != nil {
+			return nil, err
+		}
+		ingests = append(ingests, in)
+	}
+
+	return startKustoSpanWriter(ingests, factory.Router, logger, pc)
+}
+
+// startKustoSpanWriter creates writer on top of provided ingest clients, one per router table, and starts its workers
+func startKustoSpanWriter(ingests []kustoIngest, router *tableRouter, logger hclog.Logger, pc *config.PluginConfig) (*kustoSpanWriter, error) {
+	format, err := parseIngestionFormat(pc.WriterIngestionFormat)
 	if err != nil {
 		return nil, err
 	}
+	if pc.WriterIngestionStatusReporting && pc.WriterIngestionStatusConcurrency <= 0 {
+		// no status slot would ever be free, every batch would be reported as saturated
+		return nil, errors.New("writerIngestionStatusConcurrency must be positive when writerIngestionStatusReporting is set")
+	}
 
 	writer := &kustoSpanWriter{
-		batchMaxBytes:         factory.PluginConfig.WriterBatchMaxBytes,
-		batchTimeout:          time.Duration(factory.PluginConfig.WriterBatchTimeoutSeconds) * time.Second,
-		workersCount:          factory.PluginConfig.WriterWorkersCount,
-		ingest:                in,
+		workersCount:          pc.WriterWorkersCount,
+		ingests:               ingests,
+		router:                router,
+		format:                format,
+		compress:              pc.WriterCompressionEnabled,
+		ingestOptions:         []ingest.FileOption{ingest.FileFormat(format)},
 		logger:                logger,
-		spanInput:             make(chan []string, factory.PluginConfig.WriterSpanBufferSize),
-		shutdown:              make(chan struct{}),
+		spanInput:             make(chan routedSpan, pc.WriterSpanBufferSize),
+		closing:               make(chan struct{}),
 		shutdownWg:            sync.WaitGroup{},
+		shutdownTimeout:       time.Duration(pc.WriterShutdownTimeoutSeconds) * time.Second,
 		disableJaegerUiTraces: pc.DisableJaegerUiTraces,
+		statusReporting:       pc.WriterIngestionStatusReporting,
+		statusTimeout:         time.Duration(pc.WriterIngestionStatusTimeoutSeconds) * time.Second,
+		statusSlots:           make(chan struct{}, max(pc.WriterIngestionStatusConcurrency, 0)),
+		waitStatus:            waitIngestionResult,
+	}
+	writer.SetBatchSettings(pc)
+
+	if pc.WriterIngestionMappingRef != "" {
+		writer.ingestOptions = append(writer.ingestOptions, ingest.IngestionMappingRef(pc.WriterIngestionMappingRef, format))
+	}
+	if writer.compress {
+		writer.ingestOptions = append(writer.ingestOptions, ingest.CompressionType(ingestoptions.GZIP))
+	} else {
+		// without explicit option SDK compresses the batch on its own before upload
+		writer.ingestOptions = append(writer.ingestOptions, ingest.DontCompress())
+	}
+
+	writer.abortCtx, writer.abort = context.WithCancel(context.Background())
+	if writer.statusReporting {
+		writer.ingestOptions = append(writer.ingestOptions, ingest.ReportResultToTable())
 	}
 
+	writer.shutdownWg.Add(writer.workersCount)
 	for i := 0; i < writer.workersCount; i++ {
 		go writer.ingestWorker()
 	}
@@ -55,30 +135,183 @@ func newKustoSpanWriter(factory *kustoFactory, logger hclog.Logger, pc *config.P
 	return writer, nil
 }
 
-func (kw *kustoSpanWriter) WriteSpan(_ context.Context, span *model.Span) error {
+func (kw *kustoSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
 	spanStringArray, err := TransformSpanToStringArray(span)
+	if err != nil {
+		return err
+	}
+
+	kw.closeLock.RLock()
+	if kw.closed {
+		kw.closeLock.RUnlock()
+		return ErrWriterClosed
+	}
+	kw.writesWg.Add(1)
+	kw.closeLock.RUnlock()
+	defer kw.writesWg.Done()
 
-	kw.spanInput <- spanStringArray
-	return err
+	select {
+	case kw.spanInput <- routedSpan{table: kw.router.WriteTable(ctx, span), row: spanStringArray}:
+		return nil
+	case <-kw.closing:
+		return ErrWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// Close stops accepting new spans and waits until workers flush their batches and pending ingestion statuses
+// are checked. Returns error if shutdown doesn't complete within configured timeout, ingestions and status checks
+// still in progress are cancelled then.
 func (kw *kustoSpanWriter) Close() error {
+	timeout := time.NewTimer(kw.shutdownTimeout)
+	defer timeout.Stop()
+
+	kw.closeLock.Lock()
+	if kw.closed {
+		kw.closeLock.Unlock()
+		return nil
+	}
+	kw.closed = true
+	close(kw.closing)
+	kw.closeLock.Unlock()
+
 	kw.logger.Debug("plugin shutdown started")
 
-	kw.shutdownWg.Add(kw.workersCount)
-	kw.shutdown <- struct{}{}
-	kw.shutdownWg.Wait()
-	close(kw.spanInput)
+	done := make(chan struct{})
+	go func() {
+		// input is closed once writes in progress returned, so that workers flush everything they accepted
+		kw.writesWg.Wait()
+		close(kw.spanInput)
+		kw.shutdownWg.Wait()
+		kw.statusWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-timeout.C:
+		kw.abort()
+		return fmt.Errorf("span writer shutdown did not complete in %s", kw.shutdownTimeout)
+	}
 
 	kw.logger.Debug("plugin shutdown completed")
 	return nil
 }
 
+// SetBatchSettings applies batch size and timeout of plugin config, workers pick up new timeout after the next tick
+func (kw *kustoSpanWriter) SetBatchSettings(pc *config.PluginConfig) {
+	kw.batchMaxBytes.Store(int64(pc.WriterBatchMaxBytes))
+	kw.batchTimeout.Store(int64(time.Duration(pc.WriterBatchTimeoutSeconds) * time.Second))
+}
+
+// FailedBatches returns the number of batches Kusto failed to accept or reported as failed
+func (kw *kustoSpanWriter) FailedBatches() uint64 {
+	return atomic.LoadUint64(&kw.failedBatches)
+}
+
 func (kw *kustoSpanWriter) ingestWorker() {
-	ticker := time.NewTicker(kw.batchTimeout)
+	timeout := time.Duration(kw.batchTimeout.Load())
+	ticker := time.NewTicker(timeout)
 	defer ticker.Stop()
 
-	b := &bytes.Buffer{}
-	writer := altcsv.NewWriter(b)
-	writer.AllQuotes = true
+	batches := make([]*spanBatch, len(kw.ingests))
+	for i := range batches {
+		batches[i] = newSpanBatch(kw.format, kw.compress)
+	}
+
+	for {
+		select {
+		case span, ok := <-kw.spanInput:
+			if !ok {
+				// input closed, flush partial batches and exit
+				for i, batch := range batches {
+					kw.ingestBatch(i, batch)
+				}
+				kw.shutdownWg.Done()
+				return
+			}
+			batch := batches[span.table]
+			if err := batch.Add(span.row); err != nil {
+				kw.logger.Error("failed to write span to batch", "error", err)
+				continue
+			}
+			if int64(batch.Len()) >= kw.batchMaxBytes.Load() {
+				kw.ingestBatch(span.table, batch)
+			}
+		case <-ticker.C:
+			for i, batch := range batches {
+				kw.ingestBatch(i, batch)
+			}
+			if current := time.Duration(kw.batchTimeout.Load()); current != timeout {
+				timeout = current
+				ticker.Reset(timeout)
+			}
+		}
+	}
+}
+
+// ingestBatch sends buffered spans to Kusto table and resets the batch
+func (kw *kustoSpanWriter) ingestBatch(table int, batch *spanBatch) {
+	if batch.Rows() == 0 {
+		return
+	}
+	defer batch.Reset()
+
+	size := batch.Len()
+	destination := kw.router.Tables()[table]
+	payload, err := batch.Bytes()
+	if err != nil {
+		failed := atomic.AddUint64(&kw.failedBatches, 1)
+		kw.logger.Error("failed to encode batch", "table", destination.Table, "bytes", size, "failedBatches", failed, "error", err)
+		return
+	}
+
+	options := append([]ingest.FileOption{ingest.RawDataSize(int64(size))}, kw.ingestOptions...)
+	result, err := kw.ingests[table].FromReader(kw.abortCtx, bytes.NewReader(payload), options...)
+	if err != nil {
+		failed := atomic.AddUint64(&kw.failedBatches, 1)
+		kw.logger.Error("failed to ingest batch", "database", destination.Database, "table", destination.Table, "bytes", size, "sentBytes", len(payload), "failedBatches", failed, "error", err)
+		return
+	}
+	kw.logger.Debug("batch queued for ingestion", "database", destination.Database, "table", destination.Table, "spans", batch.Rows(), "bytes", size, "sentBytes", len(payload))
+
+	if kw.statusReporting {
+		kw.trackIngestionStatus(result, size)
+	}
+}
+
+// trackIngestionStatus polls ingestion status in background, bounded by the configured concurrency.
+// When all status slots are busy the batch is not tracked, so that status polling never blocks ingestion.
+func (kw *kustoSpanWriter) trackIngestionStatus(result *ingest.Result, size int) {
+	select {
+	case kw.statusSlots <- struct{}{}:
+	default:
+		kw.logger.Warn("ingestion status tracking is saturated, batch status will not be checked", "bytes", size)
+		return
+	}
+
+	kw.statusWg.Add(1)
+	go func() {
+		defer func() {
+			<-kw.statusSlots
+			kw.statusWg.Done()
+		}()
+
+		ctx, cancel := context.WithTimeout(kw.abortCtx, kw.statusTimeout)
+		defer cancel()
+
+		err := <-kw.waitStatus(ctx, result)
+		if err == nil {
+			kw.logger.Debug("batch ingested", "bytes", size)
+			return
+		}
+
+		failed := atomic.AddUint64(&kw.failedBatches, 1)
+		status, _ := ingest.GetIngestionStatus(err)
+		errorCode, _ := ingest.GetErrorCode(err)
+		// the status record error contains the IngestionSourceId of the batch, which can be used to look up
+		// the failure with `.show ingestion failures`
+		kw.logger.Error("kusto rejected batch", "bytes", size, "status", status, "errorCode", errorCode, "failedBatches", failed, "error", err)
+	}()
 }
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestBatch_CountsFailures(t *testing.T) {
+	in := &fakeIngest{err: errors.New("mapping error")}
+	writer := &kustoSpanWriter{
+		ingests: []kustoIngest{in},
+		router:  newTestRouter(),
+		logger:  hclog.NewNullLogger(),
+	}
+
+	batch := newSpanBatch(ingest.CSV, false)
+	assert.NoError(t, batch.Add([]string{"a", "b"}))
+	writer.ingestBatch(0, batch)
+
+	assert.Equal(t, uint64(1), writer.FailedBatches())
+	assert.Equal(t, 0, batch.Rows())
+	assert.Len(t, in.batches, 1)
+}
+
+func TestIngestBatch_SkipsEmptyBatch(t *testing.T) {
+	in := &fakeIngest{}
+	writer := &kustoSpanWriter{
+		ingests: []kustoIngest{in},
+		router:  newTestRouter(),
+		logger:  hclog.NewNullLogger(),
+	}
+
+	writer.ingestBatch(0, newSpanBatch(ingest.CSV, false))
+
+	assert.Empty(t, in.batches)
+	assert.Equal(t, uint64(0), writer.FailedBatches())
+}
+
+func TestClose_FlushesAllWorkers(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 3
+	pc.WriterBatchTimeoutSeconds = 60
+
+	in := &fakeIngest{}
+	writer, err := startKustoSpanWriter([]kustoIngest{in}, newTestRouter(), hclog.NewNullLogger(), pc)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, writer.WriteSpan(context.Background(), newTestSpan(uint64(i+1))))
+	}
+	assert.NoError(t, writer.Close())
+
+	lines := 0
+	for _, batch := range in.batches {
+		r, err := gzip.NewReader(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		lines += strings.Count(string(data), "\n")
+	}
+	assert.Equal(t, 10, lines)
+	assert.ErrorIs(t, writer.WriteSpan(context.Background(), newTestSpan(11)), ErrWriterClosed)
+	assert.NoError(t, writer.Close())
+}
+
+func TestKustoSpanWriter_Pipeline(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 1
+	pc.WriterBatchTimeoutSeconds = 60
+
+	in := &fakeIngest{}
+	writer, err := startKustoSpanWriter([]kustoIngest{in}, newTestRouter(), hclog.NewNullLogger(), pc)
+	assert.NoError(t, err)
+
+	span := newTestSpan(1)
+	span.Tags = []model.KeyValue{model.String("http.method", "GET")}
+	span.References = []model.SpanRef{model.NewChildOfRef(span.TraceID, 2)}
+	assert.NoError(t, writer.WriteSpan(context.Background(), span))
+	assert.NoError(t, writer.Close())
+
+	assert.Len(t, in.batches, 1)
+	r, err := gzip.NewReader(bytes.NewReader(in.batches[0]))
+	assert.NoError(t, err)
+	records, err := csv.NewReader(r).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	row := records[0]
+	assert.Len(t, row, len(kustoSpanColumns))
+	assert.Equal(t, "00000000000000000000000000000001", row[0])
+	assert.Equal(t, "0000000000000001", row[1])
+	assert.Equal(t, "testOperation", row[2])
+	assert.Contains(t, row[3], `"spanID":"0000000000000002"`)
+	assert.Contains(t, row[7], `"http_method":"GET"`)
+	assert.Equal(t, "testService", row[9])
+}
+
+func TestSetBatchSettings_AppliesToRunningWorkers(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 1
+	pc.WriterBatchTimeoutSeconds = 600
+
+	in := &fakeIngest{}
+	writer, err := startKustoSpanWriter([]kustoIngest{in}, newTestRouter(), hclog.NewNullLogger(), pc)
+	assert.NoError(t, err)
+	defer writer.Close()
+
+	reloaded := *pc
+	reloaded.WriterBatchMaxBytes = 1
+	writer.SetBatchSettings(&reloaded)
+
+	assert.NoError(t, writer.WriteSpan(context.Background(), newTestSpan(1)))
+	assert.Eventually(t, func() bool { return in.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func newStatusTrackingWriter(concurrency int, wait func(ctx context.Context, result *ingest.Result) <-chan error) *kustoSpanWriter {
+	writer := &kustoSpanWriter{
+		logger:          hclog.NewNullLogger(),
+		statusReporting: true,
+		statusTimeout:   time.Minute,
+		statusSlots:     make(chan struct{}, concurrency),
+		waitStatus:      wait,
+	}
+	writer.abortCtx, writer.abort = context.WithCancel(context.Background())
+	return writer
+}
+
+func TestTrackIngestionStatus_CountsAsynchronousFailures(t *testing.T) {
+	statuses := make(chan error, 2)
+	statuses <- nil
+	statuses <- errors.New("mapping failure")
+	writer := newStatusTrackingWriter(2, func(context.Context, *ingest.Result) <-chan error {
+		ch := make(chan error, 1)
+		ch <- <-statuses
+		return ch
+	})
+
+	writer.trackIngestionStatus(&ingest.Result{}, 10)
+	writer.trackIngestionStatus(&ingest.Result{}, 10)
+	writer.statusWg.Wait()
+
+	assert.Equal(t, uint64(1), writer.FailedBatches())
+	assert.Empty(t, writer.statusSlots)
+}
+
+func TestTrackIngestionStatus_SkipsBatchesWhenSaturated(t *testing.T) {
+	release := make(chan error)
+	polled := 0
+	writer := newStatusTrackingWriter(1, func(context.Context, *ingest.Result) <-chan error {
+		polled++
+		return release
+	})
+
+	writer.trackIngestionStatus(&ingest.Result{}, 10)
+	writer.trackIngestionStatus(&ingest.Result{}, 10)
+	close(release)
+	writer.statusWg.Wait()
+
+	assert.Equal(t, 1, polled)
+	assert.Equal(t, uint64(0), writer.FailedBatches())
+}
+
+func TestTrackIngestionStatus_CancelledOnShutdownTimeout(t *testing.T) {
+	writer := newStatusTrackingWriter(1, func(ctx context.Context, _ *ingest.Result) <-chan error {
+		ch := make(chan error, 1)
+		go func() {
+			<-ctx.Done()
+			ch <- ctx.Err()
+		}()
+		return ch
+	})
+
+	writer.trackIngestionStatus(&ingest.Result{}, 10)
+	writer.abort()
+	writer.statusWg.Wait()
+
+	assert.Equal(t, uint64(1), writer.FailedBatches())
+}
+
+func TestStartKustoSpanWriter_RequiresStatusConcurrency(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterIngestionStatusReporting = true
+	pc.WriterIngestionStatusConcurrency = 0
+
+	_, err := startKustoSpanWriter([]kustoIngest{&fakeIngest{}}, newTestRouter(), hclog.NewNullLogger(), pc)
+	assert.ErrorContains(t, err, "writerIngestionStatusConcurrency must be positive")
+}
+
+// hangingIngest blocks every ingestion until its context is cancelled
+type hangingIngest struct {
+	started chan struct{}
+}
+
+func (h *hangingIngest) FromReader(ctx context.Context, _ io.Reader, _ ...ingest.FileOption) (*ingest.Result, error) {
+	h.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClose_TimesOutWhenIngestionHangsWithFullBuffer(t *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 1
+	pc.WriterSpanBufferSize = 1
+	pc.WriterBatchMaxBytes = 1
+	pc.WriterShutdownTimeoutSeconds = 1
+
+	in := &hangingIngest{started: make(chan struct{}, 1)}
+	writer, err := startKustoSpanWriter([]kustoIngest{in}, newTestRouter(), hclog.NewNullLogger(), pc)
+	assert.NoError(t, err)
+
+	// the worker hangs on the first span, the second fills the buffer and the third waits for space
+	assert.NoError(t, writer.WriteSpan(context.Background(), newTestSpan(1)))
+	<-in.started
+	assert.NoError(t, writer.WriteSpan(context.Background(), newTestSpan(2)))
+	blocked := make(chan error)
+	go func() { blocked <- writer.WriteSpan(context.Background(), newTestSpan(3)) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, writer.WriteSpan(ctx, newTestSpan(4)), context.DeadlineExceeded)
+
+	closed := make(chan error)
+	go func() { closed <- writer.Close() }()
+	select {
+	case err := <-closed:
+		assert.ErrorContains(t, err, "span writer shutdown did not complete in 1s")
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't return within shutdown timeout")
+	}
+	assert.ErrorIs(t, <-blocked, ErrWriterClosed)
+}
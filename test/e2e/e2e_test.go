@@ -0,0 +1,282 @@
+package e2e
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/store"
+	"github.com/dodopizza/jaeger-kusto/test/emulator"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testPlugin is the plugin served over in-memory gRPC connection on top of kusto emulator
+type testPlugin struct {
+	emulator *emulator.Emulator
+	store    shared.StoragePlugin
+	client   shared.StoragePlugin
+}
+
+func newTestPlugin(t *testing.T, pc *config.PluginConfig) *testPlugin {
+	em := emulator.New()
+	t.Cleanup(em.Close)
+
+	kc := &config.KustoConfig{Endpoint: emulator.Endpoint, Database: "jaeger", UseManagedIdentity: true}
+	require.NoError(t, kc.Validate())
+	client, err := kusto.New(kusto.NewConnectionStringBuilder(emulator.Endpoint), kusto.WithHttpClient(em.Client()))
+	require.NoError(t, err)
+
+	kustoStore, err := store.NewStoreWithClient(client, pc, kc, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	plugin := &shared.StorageGRPCPlugin{Impl: kustoStore}
+	server := grpc.NewServer()
+	require.NoError(t, plugin.GRPCServer(nil, server))
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	grpcClient, err := plugin.GRPCClient(context.Background(), nil, conn)
+	require.NoError(t, err)
+
+	return &testPlugin{emulator: em, store: kustoStore, client: grpcClient.(shared.StoragePlugin)}
+}
+
+func newTestPluginConfig() *config.PluginConfig {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterWorkersCount = 1
+	pc.WriterBatchTimeoutSeconds = 1
+	return pc
+}
+
+// newTestTrace returns trace of frontend calling backend, which failed
+func newTestTrace(traceID model.TraceID, start time.Time) []*model.Span {
+	frontend := &model.Process{ServiceName: "frontend", Tags: []model.KeyValue{model.String("host.name", "web-1")}}
+	backend := &model.Process{ServiceName: "backend"}
+	rootID := model.NewSpanID(traceID.Low + 1)
+	return []*model.Span{
+		{
+			TraceID:       traceID,
+			SpanID:        rootID,
+			OperationName: "GET /orders",
+			StartTime:     start,
+			Duration:      20 * time.Millisecond,
+			Tags: []model.KeyValue{
+				model.String("span.kind", "server"),
+				model.String("http.method", "GET"),
+				model.Int64("http.status_code", 200),
+			},
+			Process: frontend,
+		},
+		{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(traceID.Low + 2),
+			OperationName: "query orders",
+			References:    []model.SpanRef{model.NewChildOfRef(traceID, rootID)},
+			StartTime:     start.Add(time.Millisecond),
+			Duration:      10 * time.Millisecond,
+			Tags: []model.KeyValue{
+				model.String("span.kind", "server"),
+				model.Bool("error", true),
+			},
+			Logs: []model.Log{{
+				Timestamp: start.Add(5 * time.Millisecond),
+				Fields:    []model.KeyValue{model.String("event", "exception"), model.String("exception.message", "timeout")},
+			}},
+			Process: backend,
+		},
+	}
+}
+
+func (p *testPlugin) writeSpans(t *testing.T, spans ...*model.Span) {
+	for _, span := range spans {
+		require.NoError(t, p.client.SpanWriter().WriteSpan(context.Background(), span))
+	}
+}
+
+func (p *testPlugin) waitIngested(t *testing.T, count int) {
+	assert.Eventually(t, func() bool {
+		return len(p.emulator.Spans()) >= count
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func findTag(tags []model.KeyValue, key string) (model.KeyValue, bool) {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag, true
+		}
+	}
+	return model.KeyValue{}, false
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	plugin := newTestPlugin(t, newTestPluginConfig())
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond).UTC()
+	traceID := model.NewTraceID(0xabc, 0x100)
+	plugin.writeSpans(t, newTestTrace(traceID, start)...)
+	plugin.waitIngested(t, 2)
+
+	trace, err := plugin.client.SpanReader().GetTrace(context.Background(), traceID)
+	require.NoError(t, err)
+	require.Len(t, trace.Spans, 2)
+
+	byOperation := map[string]*model.Span{}
+	for _, span := range trace.Spans {
+		byOperation[span.OperationName] = span
+	}
+	root, child := byOperation["GET /orders"], byOperation["query orders"]
+	require.NotNil(t, root)
+	require.NotNil(t, child)
+
+	assert.Equal(t, traceID, root.TraceID)
+	assert.True(t, start.Equal(root.StartTime))
+	assert.Equal(t, 20*time.Millisecond, root.Duration)
+	assert.Equal(t, "frontend", root.Process.ServiceName)
+	host, _ := findTag(root.Process.Tags, "host.name")
+	assert.Equal(t, "web-1", host.VStr)
+	method, _ := findTag(root.Tags, "http.method")
+	assert.Equal(t, "GET", method.VStr)
+	kind, _ := findTag(root.Tags, "span.kind")
+	assert.Equal(t, "server", kind.VStr)
+
+	assert.Equal(t, root.SpanID, child.ParentSpanID())
+	failed, _ := findTag(child.Tags, "error")
+	assert.True(t, failed.Bool())
+	require.Len(t, child.Logs, 1)
+	assert.True(t, start.Add(5*time.Millisecond).Equal(child.Logs[0].Timestamp))
+	event, _ := findTag(child.Logs[0].Fields, "event")
+	assert.Equal(t, "exception", event.VStr)
+
+	_, err = plugin.client.SpanReader().GetTrace(context.Background(), model.NewTraceID(0, 1))
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+}
+
+func TestServicesAndOperations(t *testing.T) {
+	plugin := newTestPlugin(t, newTestPluginConfig())
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x100), time.Now().Add(-time.Minute))...)
+	plugin.waitIngested(t, 2)
+
+	services, err := plugin.client.SpanReader().GetServices(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backend", "frontend"}, services)
+
+	operations, err := plugin.client.SpanReader().GetOperations(context.Background(),
+		spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "server"})
+	require.NoError(t, err)
+	assert.Equal(t, []spanstore.Operation{{Name: "GET /orders", SpanKind: "server"}}, operations)
+
+	operations, err = plugin.client.SpanReader().GetOperations(context.Background(),
+		spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "client"})
+	require.NoError(t, err)
+	assert.Empty(t, operations)
+}
+
+func TestSearch(t *testing.T) {
+	plugin := newTestPlugin(t, newTestPluginConfig())
+	start := time.Now().Add(-time.Minute)
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x100), start)...)
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x200), start.Add(time.Second))...)
+	plugin.waitIngested(t, 4)
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	}
+	traces, err := plugin.client.SpanReader().FindTraces(context.Background(), query)
+	require.NoError(t, err)
+	assert.Len(t, traces, 2)
+	for _, trace := range traces {
+		assert.Len(t, trace.Spans, 2)
+	}
+
+	query.Tags = map[string]string{"http.method": "GET"}
+	traceIDs, err := plugin.client.SpanReader().FindTraceIDs(context.Background(), query)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []model.TraceID{model.NewTraceID(0, 0x100), model.NewTraceID(0, 0x200)}, traceIDs)
+
+	query.Tags = map[string]string{"http.method": "POST"}
+	traces, err = plugin.client.SpanReader().FindTraces(context.Background(), query)
+	require.NoError(t, err)
+	assert.Empty(t, traces)
+
+	query.ServiceName, query.Tags = "backend", map[string]string{"error": "true"}
+	query.StartTimeMin, query.StartTimeMax = start.Add(500*time.Millisecond), start.Add(time.Minute)
+	traceIDs, err = plugin.client.SpanReader().FindTraceIDs(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{model.NewTraceID(0, 0x200)}, traceIDs)
+}
+
+func TestSearchRowsLimitMarksCutOffTraces(t *testing.T) {
+	pc := newTestPluginConfig()
+	pc.ReadMaxSearchRows = 3
+	plugin := newTestPlugin(t, pc)
+	start := time.Now().Add(-time.Minute)
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x100), start)...)
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x200), start.Add(time.Second))...)
+	plugin.waitIngested(t, 4)
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	}
+	traces, err := plugin.client.SpanReader().FindTraces(context.Background(), query)
+	require.NoError(t, err)
+	require.Len(t, traces, 2)
+
+	truncated := map[model.TraceID]bool{}
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			if _, ok := findTag(span.Tags, store.TruncatedTagKey); ok {
+				truncated[span.TraceID] = true
+			}
+		}
+	}
+	assert.Equal(t, map[model.TraceID]bool{model.NewTraceID(0, 0x200): true}, truncated)
+}
+
+func TestDependencies(t *testing.T) {
+	plugin := newTestPlugin(t, newTestPluginConfig())
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x100), time.Now().Add(-time.Minute))...)
+	plugin.waitIngested(t, 2)
+
+	links, err := plugin.client.DependencyReader().GetDependencies(context.Background(), time.Now(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 1, Source: model.JaegerDependencyLinkSource}}, links)
+}
+
+func TestShutdownFlushesSpans(t *testing.T) {
+	pc := newTestPluginConfig()
+	pc.WriterBatchTimeoutSeconds = 600
+	plugin := newTestPlugin(t, pc)
+	plugin.writeSpans(t, newTestTrace(model.NewTraceID(0, 0x100), time.Now().Add(-time.Minute))...)
+	assert.Empty(t, plugin.emulator.Spans())
+
+	// the same as host does on termination signal
+	closer, ok := plugin.store.SpanWriter().(io.Closer)
+	require.True(t, ok)
+	require.NoError(t, closer.Close())
+	assert.Len(t, plugin.emulator.Spans(), 2)
+
+	err := plugin.client.SpanWriter().WriteSpan(context.Background(), newTestTrace(model.NewTraceID(0, 0x200), time.Now())[0])
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/integration"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// kustoStorageIntegration runs Jaeger storage integration suite against the plugin served on top of emulator.
+// Queries are evaluated by the emulator's Go re-implementation of them, not by kusto.
+type kustoStorageIntegration struct {
+	integration.StorageIntegration
+	plugin  *testPlugin
+	written atomic.Int64
+}
+
+func newKustoStorageIntegration(t *testing.T) *kustoStorageIntegration {
+	s := &kustoStorageIntegration{plugin: newTestPlugin(t, newTestPluginConfig())}
+	s.SpanWriter = &countingSpanWriter{Writer: s.plugin.client.SpanWriter(), written: &s.written}
+	s.SpanReader = s.plugin.client.SpanReader()
+	s.DependencyWriter = &spanDependencyWriter{writer: s.SpanWriter}
+	s.DependencyReader = s.plugin.client.DependencyReader()
+	s.GetDependenciesReturnsSource = true
+	s.Refresh = s.refresh
+	s.CleanUp = s.cleanUp
+	// Fixtures of these cases have binary tags, which are read back as hex strings, because attributes of OTELTraces
+	// have no binary type. Spans of "Tags + Operation name" also have CHILD_OF references to other traces, which
+	// become links. Search by tags in all spots is still covered by the rest of cases.
+	s.SkipList = []string{
+		"FindTraces/Tags_in_one_spot",
+		"FindTraces/Tags_+_",
+		"FindTraces/Multi-spot_Tags_+_Operation_name_+_",
+		"FindTraces/Multi-spot_Tags_+_Duration_range",
+		"FindTraces/Multi-spot_Tags_+_max_Duration",
+	}
+	return s
+}
+
+// refresh waits until all written spans are ingested, as ingestion is asynchronous
+func (s *kustoStorageIntegration) refresh() error {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		ingested, written := len(s.plugin.emulator.Spans()), s.written.Load()
+		if int64(ingested) >= written {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d of %d written spans are ingested", ingested, written)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *kustoStorageIntegration) cleanUp() error {
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	s.plugin.emulator.Reset()
+	s.written.Store(0)
+	return nil
+}
+
+// countingSpanWriter counts written spans, so ingestion can be awaited
+type countingSpanWriter struct {
+	spanstore.Writer
+	written *atomic.Int64
+}
+
+func (w *countingSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	if err := w.Writer.WriteSpan(ctx, span); err != nil {
+		return err
+	}
+	w.written.Add(1)
+	return nil
+}
+
+// spanDependencyWriter writes dependency links as client and server spans, since plugin computes dependencies
+// from spans and has no storage for links
+type spanDependencyWriter struct {
+	writer spanstore.Writer
+}
+
+func (w *spanDependencyWriter) WriteDependencies(ts time.Time, dependencies []model.DependencyLink) error {
+	var id uint64
+	for _, link := range dependencies {
+		for i := uint64(0); i < link.CallCount; i++ {
+			id++
+			traceID := model.NewTraceID(0xdeb, id)
+			start := ts.Add(-time.Minute)
+			parent := &model.Span{
+				TraceID:       traceID,
+				SpanID:        model.NewSpanID(1),
+				OperationName: "call " + link.Child,
+				StartTime:     start,
+				Duration:      time.Millisecond,
+				Tags:          []model.KeyValue{model.String("span.kind", "client")},
+				Process:       &model.Process{ServiceName: link.Parent},
+			}
+			child := &model.Span{
+				TraceID:       traceID,
+				SpanID:        model.NewSpanID(2),
+				OperationName: "serve " + link.Parent,
+				References:    []model.SpanRef{model.NewChildOfRef(traceID, parent.SpanID)},
+				StartTime:     start,
+				Duration:      time.Millisecond,
+				Tags:          []model.KeyValue{model.String("span.kind", "server")},
+				Process:       &model.Process{ServiceName: link.Child},
+			}
+			for _, span := range []*model.Span{parent, child} {
+				if err := w.writer.WriteSpan(context.Background(), span); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestJaegerStorageIntegration(t *testing.T) {
+	s := newKustoStorageIntegration(t)
+	s.IntegrationTestAll(t)
+}
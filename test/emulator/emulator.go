@@ -0,0 +1,134 @@
+// Package emulator provides a local stand-in for Kusto query, management and queued ingestion endpoints,
+// so that the plugin can be tested end to end without network access.
+//
+// The emulator is not a Kusto engine. It keeps ingested spans in memory in the shape of OTELTraces table and
+// recognizes queries issued by the plugin, evaluating them with their query parameters. Queries it doesn't
+// recognize fail with bad request error.
+package emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	// Endpoint is the cluster endpoint served by emulator, kusto client must use http client of the emulator
+	Endpoint = "https://emulator.kusto.windows.net"
+
+	storageAccount = "emulatorstorage"
+	sasToken       = "sv=emulator&sig=emulator"
+)
+
+// Emulator serves Kusto and Azure storage endpoints used by the plugin from a single local TLS server
+type Emulator struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	blocks  map[string][]byte
+	blobs   map[string][]byte
+	spans   []Span
+	queries []string
+	// compressed records for every ingested blob whether it was gzip compressed
+	compressed []bool
+}
+
+// New starts emulator, it must be closed after use
+func New() *Emulator {
+	e := &Emulator{
+		blocks: map[string][]byte{},
+		blobs:  map[string][]byte{},
+	}
+	e.server = httptest.NewTLSServer(http.HandlerFunc(e.serveHTTP))
+	return e
+}
+
+// Close stops emulator server
+func (e *Emulator) Close() {
+	e.server.Close()
+}
+
+// Client returns http client, which sends requests to any host to the emulator
+func (e *Emulator) Client() *http.Client {
+	addr := e.server.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			// certificate of the test server isn't issued for emulated hosts
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// AddSpans stores spans as if they were ingested
+func (e *Emulator) AddSpans(spans ...Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+}
+
+// Spans returns copy of ingested spans
+func (e *Emulator) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Reset drops ingested spans, pending uploads and recorded queries
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+	e.queries = nil
+	e.compressed = nil
+	e.blocks = map[string][]byte{}
+	e.blobs = map[string][]byte{}
+}
+
+// CompressedBlobs returns for every ingested blob in order of ingestion whether it was gzip compressed
+func (e *Emulator) CompressedBlobs() []bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]bool(nil), e.compressed...)
+}
+
+// Queries returns text of queries and management commands received by emulator
+func (e *Emulator) Queries() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.queries...)
+}
+
+func (e *Emulator) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	switch {
+	case host == storageAccount+".blob.core.windows.net":
+		e.serveBlob(w, r)
+	case host == storageAccount+".queue.core.windows.net":
+		e.serveQueue(w, r)
+	case r.URL.Path == "/v1/rest/mgmt":
+		e.serveMgmt(w, r)
+	case r.URL.Path == "/v2/rest/query":
+		e.serveQuery(w, r)
+	default:
+		// cloud metadata isn't served, client falls back to public cloud defaults
+		http.NotFound(w, r)
+	}
+}
+
+func (e *Emulator) recordQuery(csl string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queries = append(e.queries, strings.TrimSpace(csl))
+}
@@ -0,0 +1,74 @@
+package emulator
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// column describes column of a result table, type is one of kusto scalar types
+type column struct {
+	Name string `json:"ColumnName"`
+	Type string `json:"ColumnType"`
+}
+
+// dataTable is a v2 DataTable frame. Frames are structs rather than maps because kusto client expects
+// FrameType to be the first property of every frame.
+type dataTable struct {
+	FrameType string          `json:"FrameType"`
+	TableID   int             `json:"TableId"`
+	TableKind string          `json:"TableKind"`
+	TableName string          `json:"TableName"`
+	Columns   []column        `json:"Columns"`
+	Rows      [][]interface{} `json:"Rows"`
+}
+
+type dataSetHeader struct {
+	FrameType     string `json:"FrameType"`
+	IsProgressive bool   `json:"IsProgressive"`
+	Version       string `json:"Version"`
+}
+
+type dataSetCompletion struct {
+	FrameType string `json:"FrameType"`
+	HasErrors bool   `json:"HasErrors"`
+	Cancelled bool   `json:"Cancelled"`
+}
+
+// writeQueryResult writes result in v2 frames format of /v2/rest/query endpoint as non progressive data set
+func writeQueryResult(w http.ResponseWriter, columns []column, rows [][]interface{}) {
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	frames := []interface{}{
+		dataSetHeader{FrameType: "DataSetHeader", Version: "v2.0"},
+		dataTable{FrameType: "DataTable", TableKind: "PrimaryResult", TableName: "PrimaryResult", Columns: columns, Rows: rows},
+		dataSetCompletion{FrameType: "DataSetCompletion"},
+	}
+	writeJSON(w, frames)
+}
+
+// writeMgmtResult writes result in v1 format of /v1/rest/mgmt endpoint
+func writeMgmtResult(w http.ResponseWriter, columns []column, rows [][]interface{}) {
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"Tables": []interface{}{
+			map[string]interface{}{"TableName": "Table_0", "Columns": columns, "Rows": rows},
+		},
+	})
+}
+
+// writeError writes error in the format of kusto service errors
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": "BadRequest", "message": message, "@permanent": true},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
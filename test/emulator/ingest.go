@@ -0,0 +1,192 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// queuedIngestion is the part of ingestion message posted to the queue by kusto client
+type queuedIngestion struct {
+	BlobPath             string
+	DatabaseName         string
+	TableName            string
+	AdditionalProperties struct {
+		Format string `json:"format"`
+	}
+}
+
+// serveBlob accepts blocks of blob uploads and commits them when block list is put
+func (e *Emulator) serveBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "only uploads are supported by emulator", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	query := r.URL.Query()
+	switch query.Get("comp") {
+	case "block":
+		e.blocks[r.URL.Path+"#"+query.Get("blockid")] = body
+	case "blocklist":
+		var list struct {
+			Blocks []string `xml:",any"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, id := range list.Blocks {
+			blob = append(blob, e.blocks[r.URL.Path+"#"+id]...)
+			delete(e.blocks, r.URL.Path+"#"+id)
+		}
+		e.blobs[r.URL.Path] = blob
+	default:
+		e.blobs[r.URL.Path] = body
+	}
+
+	w.Header().Set("ETag", `"emulator"`)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveQueue ingests blob referenced by the queued message synchronously
+func (e *Emulator) serveQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/messages") {
+		http.Error(w, "only enqueueing messages is supported by emulator", http.StatusMethodNotAllowed)
+		return
+	}
+	var message struct {
+		MessageText string `xml:"MessageText"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := e.ingestMessage(message.MessageText); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><QueueMessagesList><QueueMessage><MessageId>%d</MessageId>`+
+		`<InsertionTime>%s</InsertionTime><ExpirationTime>%s</ExpirationTime><PopReceipt>emulator</PopReceipt>`+
+		`<TimeNextVisible>%s</TimeNextVisible></QueueMessage></QueueMessagesList>`,
+		now.UnixNano(), now.Format(http.TimeFormat), now.Add(time.Hour).Format(http.TimeFormat), now.Format(http.TimeFormat))
+}
+
+func (e *Emulator) ingestMessage(text string) error {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return err
+	}
+	var ingestion queuedIngestion
+	if err := json.Unmarshal(data, &ingestion); err != nil {
+		return err
+	}
+	blobURL, err := url.Parse(ingestion.BlobPath)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	blob, ok := e.blobs[blobURL.Path]
+	delete(e.blobs, blobURL.Path)
+	if ok {
+		e.compressed = append(e.compressed, isGzip(blob))
+	}
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("blob %s is not uploaded", blobURL.Path)
+	}
+
+	rows, err := readRows(blob, ingestion.AdditionalProperties.Format)
+	if err != nil {
+		return fmt.Errorf("ingestion of %s.%s failed: %w", ingestion.DatabaseName, ingestion.TableName, err)
+	}
+	spans := make([]Span, 0, len(rows))
+	for _, row := range rows {
+		span, err := spanFromJaegerRow(row)
+		if err != nil {
+			return fmt.Errorf("ingestion of %s.%s failed: %w", ingestion.DatabaseName, ingestion.TableName, err)
+		}
+		span.Table = ingestion.TableName
+		spans = append(spans, span)
+	}
+	e.AddSpans(spans...)
+	return nil
+}
+
+func isGzip(blob []byte) bool {
+	return len(blob) > 2 && blob[0] == 0x1f && blob[1] == 0x8b
+}
+
+// readRows decodes batch to rows keyed by column name, values of dynamic columns are kept JSON encoded
+func readRows(blob []byte, format string) ([]map[string]string, error) {
+	var reader io.Reader = bytes.NewReader(blob)
+	if isGzip(blob) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	}
+
+	var rows []map[string]string
+	switch format {
+	case "csv":
+		records, err := csv.NewReader(reader).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if len(record) != len(jaegerColumns) {
+				return nil, fmt.Errorf("row has %d columns, expected %d", len(record), len(jaegerColumns))
+			}
+			row := map[string]string{}
+			for i, column := range jaegerColumns {
+				row[column] = record[i]
+			}
+			rows = append(rows, row)
+		}
+	case "json", "multijson":
+		decoder := json.NewDecoder(reader)
+		for decoder.More() {
+			var object map[string]json.RawMessage
+			if err := decoder.Decode(&object); err != nil {
+				return nil, err
+			}
+			row := map[string]string{}
+			for column, raw := range object {
+				var text string
+				if err := json.Unmarshal(raw, &text); err != nil {
+					text = string(raw)
+				}
+				row[column] = text
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("format %q is not supported by emulator", format)
+	}
+	return rows, nil
+}
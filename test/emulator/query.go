@@ -0,0 +1,500 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+)
+
+// queryRequest is the body of query and management requests
+type queryRequest struct {
+	DB         string `json:"db"`
+	CSL        string `json:"csl"`
+	Properties struct {
+		Parameters map[string]string
+	} `json:"properties"`
+}
+
+// parameters are query parameters sent along with the query, parsed from their KQL literals
+type parameters map[string]string
+
+func (p parameters) has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+func (p parameters) string(name string) string {
+	literal, ok := p[name]
+	if !ok {
+		return ""
+	}
+	if text, err := strconv.Unquote(literal); err == nil {
+		return text
+	}
+	return literal
+}
+
+func (p parameters) inner(name string, kind string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(p[name], kind+"("), ")")
+}
+
+func (p parameters) time(name string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, p.inner(name, "datetime"))
+	return t
+}
+
+func (p parameters) duration(name string) time.Duration {
+	timespan := value.Timespan{}
+	_ = timespan.Unmarshal(p.inner(name, "timespan"))
+	return timespan.Value
+}
+
+func (p parameters) long(name string) int64 {
+	literal := p.inner(name, "long")
+	if strings.HasPrefix(literal, "int(") {
+		literal = p.inner(name, "int")
+	}
+	n, _ := strconv.ParseInt(literal, 10, 64)
+	return n
+}
+
+func (p parameters) dynamic(name string, v interface{}) error {
+	return json.Unmarshal([]byte(p.inner(name, "dynamic")), v)
+}
+
+var spanColumns = []column{
+	{"TraceID", "string"}, {"SpanID", "string"}, {"ParentID", "string"}, {"SpanName", "string"},
+	{"SpanStatus", "string"}, {"SpanKind", "string"}, {"StartTime", "datetime"}, {"EndTime", "datetime"},
+	{"ProcessTags", "dynamic"}, {"Tags", "dynamic"}, {"Logs", "dynamic"}, {"Links", "dynamic"},
+	{"Duration", "long"}, {"ProcessServiceName", "string"}, {"References", "dynamic"},
+}
+
+func spanRow(span Span) []interface{} {
+	references := []interface{}{}
+	if span.ParentID != "" {
+		references = append(references, map[string]string{"refType": "CHILD_OF", "traceID": span.TraceID, "spanID": span.ParentID})
+	}
+	events, links := span.Events, span.Links
+	if events == nil {
+		events = []Event{}
+	}
+	if links == nil {
+		links = []Link{}
+	}
+	return []interface{}{
+		span.TraceID, span.SpanID, span.ParentID, span.SpanName,
+		span.SpanStatus, span.SpanKind, span.StartTime.UTC().Format(time.RFC3339Nano), span.EndTime.UTC().Format(time.RFC3339Nano),
+		span.ResourceAttributes, span.TraceAttributes, events, links,
+		span.DurationMicros(), span.ServiceName(), references,
+	}
+}
+
+func (e *Emulator) serveQuery(w http.ResponseWriter, r *http.Request) {
+	var request queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e.recordQuery(request.CSL)
+	params := parameters(request.Properties.Parameters)
+	csl := request.CSL
+	spans := spansOfTables(e.Spans(), csl)
+
+	switch {
+	case strings.Contains(csl, "ParamTraceIDs"):
+		e.getTrace(w, spans, params)
+	case strings.Contains(csl, "let TraceIDs = ("):
+		e.findTraces(w, csl, spans, params)
+	case strings.Contains(csl, "summarize by TraceID"):
+		e.findTraceIDs(w, csl, spans, params)
+	case strings.Contains(csl, "summarize by ProcessServiceName"):
+		e.getServices(w, spans, params)
+	case strings.Contains(csl, "project OperationName=SpanName,SpanKind"):
+		e.getOperations(w, spans, params)
+	case strings.Contains(csl, "union Calls, Messages"):
+		e.getDependencies(w, csl, spans, params)
+	default:
+		writeError(w, http.StatusBadRequest, "query is not supported by emulator: "+csl)
+	}
+}
+
+// spansOfTables returns spans of tables the query refers to, databases and clusters of tables aren't distinguished
+func spansOfTables(spans []Span, csl string) []Span {
+	referenced := map[string]bool{"": true}
+	var result []Span
+	for _, span := range spans {
+		read, ok := referenced[span.Table]
+		if !ok {
+			read = regexp.MustCompile(`(^|\W)` + regexp.QuoteMeta(span.Table) + `(\W|$)`).MatchString(csl)
+			referenced[span.Table] = read
+		}
+		if read {
+			result = append(result, span)
+		}
+	}
+	return result
+}
+
+func (e *Emulator) serveMgmt(w http.ResponseWriter, r *http.Request) {
+	var request queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e.recordQuery(request.CSL)
+
+	switch strings.TrimSpace(request.CSL) {
+	case ".get ingestion resources":
+		writeMgmtResult(w, []column{{"ResourceTypeName", "string"}, {"StorageRoot", "string"}}, [][]interface{}{
+			{"TempStorage", "https://" + storageAccount + ".blob.core.windows.net/ingest?" + sasToken},
+			{"SecuredReadyForAggregationQueue", "https://" + storageAccount + ".queue.core.windows.net/ready?" + sasToken},
+		})
+	case ".get kusto identity token":
+		writeMgmtResult(w, []column{{"AuthorizationContext", "string"}}, [][]interface{}{{"emulator"}})
+	default:
+		// table creation and other commands succeed without effect
+		writeMgmtResult(w, []column{{"Result", "string"}}, nil)
+	}
+}
+
+func (e *Emulator) getTrace(w http.ResponseWriter, spans []Span, params parameters) {
+	var traceIDs []string
+	if err := params.dynamic("ParamTraceIDs", &traceIDs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var result []Span
+	for _, span := range spans {
+		for _, traceID := range traceIDs {
+			if strings.EqualFold(span.TraceID, traceID) {
+				result = append(result, span)
+				break
+			}
+		}
+	}
+	if params.has("ParamMaxSpansPerTrace") {
+		result = firstByStartTime(result, int(params.long("ParamMaxSpansPerTrace")))
+	}
+	writeSpans(w, result)
+}
+
+func (e *Emulator) getServices(w http.ResponseWriter, spans []Span, params parameters) {
+	since := time.Now().Add(-params.duration("ParamLookBack"))
+	services := map[string]bool{}
+	for _, span := range spans {
+		if span.StartTime.After(since) && span.ServiceName() != "" {
+			services[span.ServiceName()] = true
+		}
+	}
+
+	var rows [][]interface{}
+	for _, service := range sortedKeys(services) {
+		rows = append(rows, []interface{}{service})
+	}
+	writeQueryResult(w, []column{{"ProcessServiceName", "string"}}, rows)
+}
+
+func (e *Emulator) getOperations(w http.ResponseWriter, spans []Span, params parameters) {
+	since := time.Now().Add(-params.duration("ParamLookBack"))
+	operations := map[string]bool{}
+	for _, span := range spans {
+		if !span.StartTime.After(since) {
+			continue
+		}
+		if params.has("ParamProcessServiceName") && span.ServiceName() != params.string("ParamProcessServiceName") {
+			continue
+		}
+		if params.has("ParamSpanKind") && span.SpanKind != params.string("ParamSpanKind") {
+			continue
+		}
+		operations[span.SpanName+"\x00"+span.SpanKind] = true
+	}
+
+	var rows [][]interface{}
+	for _, operation := range sortedKeys(operations) {
+		parts := strings.SplitN(operation, "\x00", 2)
+		rows = append(rows, []interface{}{parts[0], parts[1]})
+	}
+	writeQueryResult(w, []column{{"OperationName", "string"}, {"SpanKind", "string"}}, rows)
+}
+
+func (e *Emulator) findTraceIDs(w http.ResponseWriter, csl string, spans []Span, params parameters) {
+	traceIDs, err := searchTraceIDs(csl, spans, params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rows [][]interface{}
+	for _, traceID := range traceIDs {
+		rows = append(rows, []interface{}{traceID})
+	}
+	writeQueryResult(w, []column{{"TraceID", "string"}}, rows)
+}
+
+func (e *Emulator) findTraces(w http.ResponseWriter, csl string, spans []Span, params parameters) {
+	traceIDs, err := searchTraceIDs(csl, spans, params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	matched := map[string]bool{}
+	for _, traceID := range traceIDs {
+		matched[traceID] = true
+	}
+
+	byTrace := map[string][]Span{}
+	for _, span := range spans {
+		if matched[span.TraceID] && inTraceTimeRange(span, params) {
+			byTrace[span.TraceID] = append(byTrace[span.TraceID], span)
+		}
+	}
+
+	var result []Span
+	for _, traceID := range sortedKeys(matched) {
+		traceSpans := byTrace[traceID]
+		if params.has("ParamMaxSpansPerTrace") {
+			traceSpans = firstByStartTime(traceSpans, int(params.long("ParamMaxSpansPerTrace")))
+		}
+		result = append(result, traceSpans...)
+	}
+	if !params.has("ParamMaxSearchRows") {
+		writeSpans(w, result)
+		return
+	}
+
+	traceSpans := map[string]int64{}
+	for _, span := range result {
+		traceSpans[span.TraceID]++
+	}
+	result = firstByStartTime(result, int(params.long("ParamMaxSearchRows")))
+	rows := make([][]interface{}, 0, len(result))
+	for _, span := range result {
+		rows = append(rows, append(spanRow(span), traceSpans[span.TraceID]))
+	}
+	writeQueryResult(w, append(append([]column(nil), spanColumns...), column{"TraceSpans", "long"}), rows)
+}
+
+// searchTraceIDs evaluates search filters of FindTraceIDs and FindTraces queries
+func searchTraceIDs(csl string, spans []Span, params parameters) ([]string, error) {
+	for _, unsupported := range []string{"matches regex", "todouble(", "isnotnull(", "where not("} {
+		if strings.Contains(csl, unsupported) {
+			return nil, fmt.Errorf("tag expressions other than equality are not supported by emulator")
+		}
+	}
+
+	matched := map[string]bool{}
+	for _, span := range spans {
+		if params.has("ParamProcessServiceName") && span.ServiceName() != params.string("ParamProcessServiceName") {
+			continue
+		}
+		if params.has("ParamOperationName") && span.SpanName != params.string("ParamOperationName") {
+			continue
+		}
+		if !inTimeRange(span, params) {
+			continue
+		}
+		if !inDurationRange(csl, span, params) {
+			continue
+		}
+		if !matchesTags(csl, span, params) {
+			continue
+		}
+		matched[span.TraceID] = true
+	}
+
+	traceIDs := sortedKeys(matched)
+	if params.has("ParamNumTraces") {
+		if limit := int(params.long("ParamNumTraces")); limit < len(traceIDs) {
+			traceIDs = traceIDs[:limit]
+		}
+	}
+	return traceIDs, nil
+}
+
+// matchesTags evaluates tag equality filters, including filters on status and kind columns, which match
+// spans having the tag in TraceAttributes as well
+func matchesTags(csl string, span Span, params parameters) bool {
+	for i := 0; i < len(params); i++ {
+		valueParam := fmt.Sprintf("ParamTagValue%d", i)
+		keyParam := fmt.Sprintf("ParamTagKey%d", i)
+		columnParam := fmt.Sprintf("ParamTagColumnValue%d", i)
+		traceAttribute := fmt.Sprintf("tostring(TraceAttributes[%s]) == %s", keyParam, valueParam)
+		hasTraceAttribute := func() bool {
+			v, ok := span.TraceAttributes[params.string(keyParam)]
+			return ok && fmt.Sprint(v) == params.string(valueParam)
+		}
+
+		matches := true
+		switch {
+		case strings.Contains(csl, `SpanStatus == "STATUS_CODE_ERROR" or `+traceAttribute):
+			matches = span.SpanStatus == "STATUS_CODE_ERROR" || hasTraceAttribute()
+		case strings.Contains(csl, `SpanStatus != "STATUS_CODE_ERROR" or `+traceAttribute):
+			matches = span.SpanStatus != "STATUS_CODE_ERROR" || hasTraceAttribute()
+		case strings.Contains(csl, "SpanStatus == "+columnParam):
+			matches = span.SpanStatus == params.string(columnParam) || hasTraceAttribute()
+		case strings.Contains(csl, "SpanKind == "+columnParam):
+			matches = span.SpanKind == params.string(columnParam) || hasTraceAttribute()
+		case params.has(keyParam):
+			matches = hasAttribute(span, params.string(valueParam), params.string(keyParam), params.string(keyParam+"Replaced"))
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAttribute(span Span, expected string, keys ...string) bool {
+	attributes := []map[string]interface{}{span.TraceAttributes, span.ResourceAttributes}
+	for _, event := range span.Events {
+		attributes = append(attributes, event.EventAttributes)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		for _, attrs := range attributes {
+			if v, ok := attrs[key]; ok && fmt.Sprint(v) == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *Emulator) getDependencies(w http.ResponseWriter, csl string, spans []Span, params parameters) {
+	windowEnd := params.time("ParamEndTs")
+	windowStart := windowEnd.Add(-params.duration("ParamLookBack"))
+	parentWindowStart := windowStart.Add(-time.Hour)
+	byOperation := strings.Contains(csl, "strcat(ParentService")
+	byTraceID := strings.Contains(csl, "on TraceID, ChildOfSpanId")
+
+	inWindow := func(span Span, start time.Time) bool {
+		return !span.StartTime.Before(start) && span.StartTime.Before(windowEnd)
+	}
+	node := func(span Span) string {
+		if byOperation {
+			return span.ServiceName() + "::" + span.SpanName
+		}
+		return span.ServiceName()
+	}
+
+	type edge struct{ parent, child, source string }
+	calls := map[edge]int64{}
+	errors := map[edge]int64{}
+	count := func(parent Span, child Span, source string) {
+		key := edge{node(parent), node(child), source}
+		calls[key]++
+		if child.SpanStatus == "STATUS_CODE_ERROR" {
+			errors[key]++
+		}
+	}
+
+	for _, child := range spans {
+		if !inWindow(child, windowStart) {
+			continue
+		}
+		for _, parent := range spans {
+			if !inWindow(parent, parentWindowStart) {
+				continue
+			}
+			if child.ParentID != "" && sameSpan(parent, child.TraceID, child.ParentID, byTraceID) && parent.ServiceName() != child.ServiceName() {
+				count(parent, child, "calls")
+			}
+			if child.SpanKind == "SPAN_KIND_CONSUMER" && parent.SpanKind == "SPAN_KIND_PRODUCER" {
+				for _, link := range child.Links {
+					if sameSpan(parent, string(link.TraceID), link.SpanID, byTraceID) {
+						count(parent, child, "messaging")
+					}
+				}
+			}
+		}
+	}
+
+	var rows [][]interface{}
+	for key, callCount := range calls {
+		rows = append(rows, []interface{}{key.parent, key.child, key.source, callCount, errors[key]})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return fmt.Sprint(rows[i][:3]) < fmt.Sprint(rows[j][:3])
+	})
+	writeQueryResult(w, []column{{"Parent", "string"}, {"Child", "string"}, {"Source", "string"}, {"CallCount", "long"}, {"ErrorCount", "long"}}, rows)
+}
+
+// sameSpan tells whether span has the ids, trace ids are compared regardless of case as reader does and only
+// when query joins spans on them
+func sameSpan(span Span, traceID, spanID string, byTraceID bool) bool {
+	return span.SpanID == spanID && (!byTraceID || strings.EqualFold(span.TraceID, traceID))
+}
+
+func inTimeRange(span Span, params parameters) bool {
+	if params.has("ParamStartTimeMin") && !span.StartTime.After(params.time("ParamStartTimeMin")) {
+		return false
+	}
+	if params.has("ParamStartTimeMax") && !span.StartTime.Before(params.time("ParamStartTimeMax")) {
+		return false
+	}
+	return true
+}
+
+// inTraceTimeRange tells whether span of a found trace is read, which is limited by the searched range unless
+// query sets a wider one
+func inTraceTimeRange(span Span, params parameters) bool {
+	if !params.has("ParamTraceStartTimeMin") {
+		return inTimeRange(span, params)
+	}
+	return span.StartTime.After(params.time("ParamTraceStartTimeMin")) && span.StartTime.Before(params.time("ParamTraceStartTimeMax"))
+}
+
+// inDurationRange evaluates duration bounds, which are exclusive or inclusive as query compares them
+func inDurationRange(csl string, span Span, params parameters) bool {
+	duration := span.DurationMicros()
+	if params.has("ParamDurationMin") {
+		if min := params.long("ParamDurationMin"); duration < min || duration == min && !strings.Contains(csl, ">= ParamDurationMin") {
+			return false
+		}
+	}
+	if params.has("ParamDurationMax") {
+		if max := params.long("ParamDurationMax"); duration > max || duration == max && !strings.Contains(csl, "<= ParamDurationMax") {
+			return false
+		}
+	}
+	return true
+}
+
+func firstByStartTime(spans []Span, limit int) []Span {
+	sorted := append([]Span(nil), spans...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StartTime.Before(sorted[j].StartTime)
+	})
+	if limit < len(sorted) {
+		sorted = sorted[:limit]
+	}
+	return sorted
+}
+
+func writeSpans(w http.ResponseWriter, spans []Span) {
+	rows := make([][]interface{}, 0, len(spans))
+	for _, span := range spans {
+		rows = append(rows, spanRow(span))
+	}
+	writeQueryResult(w, spanColumns, rows)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
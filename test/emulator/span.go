@@ -0,0 +1,183 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+)
+
+// Span is a row of OTELTraces table
+type Span struct {
+	TraceID            string
+	SpanID             string
+	ParentID           string
+	SpanName           string
+	SpanStatus         string
+	SpanKind           string
+	StartTime          time.Time
+	EndTime            time.Time
+	ResourceAttributes map[string]interface{}
+	TraceAttributes    map[string]interface{}
+	Events             []Event
+	Links              []Link
+	// Table is the table span was ingested to, spans added without table are read from every table
+	Table string
+}
+
+// Event is an element of Events column
+type Event struct {
+	EventName       string                 `json:"EventName"`
+	Timestamp       string                 `json:"Timestamp"`
+	EventAttributes map[string]interface{} `json:"EventAttributes"`
+}
+
+// Link is an element of Links column
+type Link struct {
+	TraceID            string                 `json:"TraceID"`
+	SpanID             string                 `json:"SpanID"`
+	TraceState         string                 `json:"TraceState"`
+	SpanLinkAttributes map[string]interface{} `json:"SpanLinkAttributes"`
+}
+
+// ServiceName returns service.name resource attribute
+func (s Span) ServiceName() string {
+	name, _ := s.ResourceAttributes["service.name"].(string)
+	return name
+}
+
+// DurationMicros returns span duration as reader computes it with datetime_diff
+func (s Span) DurationMicros() int64 {
+	return s.EndTime.Sub(s.StartTime).Microseconds()
+}
+
+// jaegerColumns lists columns of batches written by the plugin in the same order
+var jaegerColumns = []string{
+	"TraceID", "SpanID", "OperationName", "References", "Flags", "StartTime", "Duration",
+	"Tags", "Logs", "ProcessServiceName", "ProcessTags", "ProcessID",
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerLog struct {
+	Timestamp int64 `json:"timestamp"`
+	Fields    []struct {
+		Key   string `json:"key"`
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+// typedValue converts value of log field to the type of field, as values of event attributes aren't strings
+func typedValue(valueType, value string) interface{} {
+	switch valueType {
+	case "int64":
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v
+		}
+	case "float64":
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	case "bool":
+		if v, err := strconv.ParseBool(value); err == nil {
+			return v
+		}
+	}
+	return value
+}
+
+// spanFromJaegerRow converts row written by the plugin to OTELTraces row. It plays the role of ingestion
+// mapping and update policy, which convert Jaeger spans to OTEL schema in a real cluster.
+func spanFromJaegerRow(row map[string]string) (Span, error) {
+	span := Span{
+		TraceID:         row["TraceID"],
+		SpanID:          row["SpanID"],
+		SpanName:        row["OperationName"],
+		SpanStatus:      "STATUS_CODE_UNSET",
+		SpanKind:        "SPAN_KIND_UNSPECIFIED",
+		TraceAttributes: map[string]interface{}{},
+	}
+
+	var err error
+	if span.StartTime, err = time.Parse(time.RFC3339Nano, row["StartTime"]); err != nil {
+		return span, fmt.Errorf("StartTime: %w", err)
+	}
+	duration := value.Timespan{}
+	if err := duration.Unmarshal(row["Duration"]); err != nil {
+		return span, fmt.Errorf("duration: %w", err)
+	}
+	span.EndTime = span.StartTime.Add(duration.Value)
+
+	var references []jaegerReference
+	if err := unmarshalColumn(row, "References", &references); err != nil {
+		return span, err
+	}
+	for _, ref := range references {
+		if ref.RefType == "CHILD_OF" && span.ParentID == "" {
+			span.ParentID = ref.SpanID
+			continue
+		}
+		span.Links = append(span.Links, Link{TraceID: ref.TraceID, SpanID: ref.SpanID, SpanLinkAttributes: map[string]interface{}{}})
+	}
+
+	if err := unmarshalColumn(row, "Tags", &span.TraceAttributes); err != nil {
+		return span, err
+	}
+	if kind, ok := span.TraceAttributes["span_kind"].(string); ok {
+		span.SpanKind = "SPAN_KIND_" + strings.ToUpper(kind)
+		delete(span.TraceAttributes, "span_kind")
+	}
+	if status, ok := span.TraceAttributes["otel_status_code"].(string); ok {
+		span.SpanStatus = "STATUS_CODE_" + strings.ToUpper(status)
+		delete(span.TraceAttributes, "otel_status_code")
+	}
+	if failed := span.TraceAttributes["error"]; failed == true || failed == "true" {
+		span.SpanStatus = "STATUS_CODE_ERROR"
+		delete(span.TraceAttributes, "error")
+	}
+
+	span.ResourceAttributes = map[string]interface{}{}
+	if err := unmarshalColumn(row, "ProcessTags", &span.ResourceAttributes); err != nil {
+		return span, err
+	}
+	span.ResourceAttributes["service.name"] = row["ProcessServiceName"]
+
+	var logs []jaegerLog
+	if err := unmarshalColumn(row, "Logs", &logs); err != nil {
+		return span, err
+	}
+	for _, log := range logs {
+		event := Event{
+			Timestamp:       time.UnixMicro(log.Timestamp).UTC().Format(time.RFC3339Nano),
+			EventAttributes: map[string]interface{}{},
+		}
+		for _, field := range log.Fields {
+			if field.Key == "event" {
+				event.EventName = field.Value
+				continue
+			}
+			event.EventAttributes[field.Key] = typedValue(field.Type, field.Value)
+		}
+		span.Events = append(span.Events, event)
+	}
+	return span, nil
+}
+
+func unmarshalColumn(row map[string]string, column string, v interface{}) error {
+	data := row[column]
+	if data == "" || data == "null" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return fmt.Errorf("%s: %w", column, err)
+	}
+	return nil
+}
@@ -26,7 +26,7 @@ import (
 func TestKustoSpanReader_GetTrace(tester *testing.T) {
 
 	kustoConfig, _ := config.ParseKustoConfig(testPluginConfig.KustoConfigPath, testPluginConfig.ReadNoTruncation, testPluginConfig.ReadNoTimeout)
-	expectedOutput := fmt.Sprintf(`%s | where TraceID == ParamTraceID | extend Duration=datetime_diff('microsecond',EndTime,StartTime) , ProcessServiceName=tostring(ResourceAttributes.['service.name']) | project-rename Tags=TraceAttributes,Logs=Events,ProcessTags=ResourceAttributes| extend References=iff(isempty(ParentID),todynamic("[]"),pack_array(bag_pack("refType","CHILD_OF","traceID",TraceID,"spanID",ParentID)))`, kustoConfig.TraceTableName)
+	expectedOutput := fmt.Sprintf(`%s | where TraceID in~ (ParamTraceIDs) | extend Duration=datetime_diff('microsecond',EndTime,StartTime) , ProcessServiceName=tostring(ResourceAttributes.['service.name']) | project-rename Tags=TraceAttributes,Logs=Events,ProcessTags=ResourceAttributes| extend References=iff(isempty(ParentID),todynamic("[]"),pack_array(bag_pack("refType","CHILD_OF","traceID",TraceID,"spanID",ParentID)))`, kustoConfig.TraceTableName)
 	trace, _ := model.TraceIDFromString("3f6d8f4c5008352055c14804949d1e57")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -171,8 +171,8 @@ func TestFindTracesWithDurationMaxVerification(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration < ParamDurationMax", 
-		"FindTraces should generate correct duration max condition with '<' operator")
+	assert.Contains(t, output, "| where Duration <= ParamDurationMax", 
+		"FindTraces should generate correct duration max condition with '<=' operator")
 
 	assert.NotContains(t, output, "| where Duration > ParamDurationMax", 
 		"FindTraces should not generate incorrect duration max condition with '>' operator")
@@ -215,8 +215,8 @@ func TestFindTracesWithDurationMax(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration < ParamDurationMax", 
-		"FindTraces should generate correct duration max condition with '<' operator")
+	assert.Contains(t, output, "| where Duration <= ParamDurationMax", 
+		"FindTraces should generate correct duration max condition with '<=' operator")
 
 	assert.NotContains(t, output, "| where Duration > ParamDurationMax", 
 		"FindTraces should not generate incorrect duration max condition with '>' operator")
@@ -260,10 +260,10 @@ func TestFindTracesWithBothDurationMinAndMax(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration > ParamDurationMin", 
-		"FindTraces should generate correct duration min condition with '>' operator")
-	assert.Contains(t, output, "| where Duration < ParamDurationMax", 
-		"FindTraces should generate correct duration max condition with '<' operator")
+	assert.Contains(t, output, "| where Duration >= ParamDurationMin", 
+		"FindTraces should generate correct duration min condition with '>=' operator")
+	assert.Contains(t, output, "| where Duration <= ParamDurationMax", 
+		"FindTraces should generate correct duration max condition with '<=' operator")
 		
 	assert.NotContains(t, output, "| where Duration < ParamDurationMin", 
 		"FindTraces should not generate incorrect duration min condition")
@@ -308,8 +308,8 @@ func TestFindTraceIDsWithDurationMax(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration < ParamDurationMax", 
-		"FindTraceIDs should generate correct duration max condition with '<' operator")
+	assert.Contains(t, output, "| where Duration <= ParamDurationMax", 
+		"FindTraceIDs should generate correct duration max condition with '<=' operator")
 
 	assert.NotContains(t, output, "| where Duration > ParamDurationMax", 
 		"FindTraceIDs should not generate incorrect duration max condition with '>' operator")
@@ -352,8 +352,8 @@ func TestFindTraceIDsWithDurationMin(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration > ParamDurationMin", 
-		"FindTraceIDs should generate correct duration min condition with '>' operator")
+	assert.Contains(t, output, "| where Duration >= ParamDurationMin", 
+		"FindTraceIDs should generate correct duration min condition with '>=' operator")
 }
 
 func TestFindTraceIDsWithBothDurationMinAndMax(t *testing.T) {
@@ -394,10 +394,10 @@ func TestFindTraceIDsWithBothDurationMinAndMax(t *testing.T) {
 
 	output := buf.String()
 
-	assert.Contains(t, output, "| where Duration > ParamDurationMin", 
-		"FindTraceIDs should generate correct duration min condition with '>' operator")
-	assert.Contains(t, output, "| where Duration < ParamDurationMax", 
-		"FindTraceIDs should generate correct duration max condition with '<' operator")
+	assert.Contains(t, output, "| where Duration >= ParamDurationMin", 
+		"FindTraceIDs should generate correct duration min condition with '>=' operator")
+	assert.Contains(t, output, "| where Duration <= ParamDurationMax", 
+		"FindTraceIDs should generate correct duration max condition with '<=' operator")
 		
 	assert.NotContains(t, output, "| where Duration < ParamDurationMin", 
 		"FindTraceIDs should not generate incorrect duration min condition")
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/dodopizza/jaeger-kusto/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+// validateTimeout bounds authentication and schema queries of validate command
+const validateTimeout = time.Minute
+
+// validate parses configs the same way as plugin does, then checks connection to kusto and schema of trace tables.
+// Every problem is written to out, returned exit code is non-zero when any problem is found.
+func validate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: jaeger-kusto validate [flags]")
+		fmt.Fprintln(out, "Checks plugin and kusto configs, credentials and schema of trace tables.")
+		fs.PrintDefaults()
+	}
+	flags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// kusto config is checked even when plugin config is invalid, problems of both are reported at once
+	pluginConfig, err := flags.ParsePluginConfig()
+	pluginConfigValid := report(out, "plugin configuration", err)
+	if pluginConfig == nil {
+		pluginConfig = config.NewDefaultPluginConfig()
+	}
+	kustoConfig, err := flags.ParseKustoConfig(pluginConfig)
+	if !report(out, "kusto configuration", err) || !pluginConfigValid {
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	logger := hclog.New(&hclog.LoggerOptions{Name: config.ServiceName, Level: hclog.Error, Output: out})
+	if !report(out, "kusto connection and trace tables", errors.Join(store.Check(ctx, pluginConfig, kustoConfig, logger)...)) {
+		return 1
+	}
+	return 0
+}
+
+// report writes result of the check, every problem of joined errors on its own line, and returns true when there are none
+func report(out io.Writer, check string, err error) bool {
+	if err == nil {
+		fmt.Fprintf(out, "OK    %s\n", check)
+		return true
+	}
+
+	fmt.Fprintf(out, "FAIL  %s\n", check)
+	for _, problem := range problems(err) {
+		fmt.Fprintf(out, "      - %s\n", problem)
+	}
+	return false
+}
+
+// problems flattens errors joined by errors.Join
+func problems(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var flat []error
+	for _, e := range joined.Unwrap() {
+		flat = append(flat, problems(e)...)
+	}
+	return flat
+}